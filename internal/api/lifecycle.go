@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tracks whether the server is ready to serve the API. It's not
+// while the storage is being loaded or the WAL is replayed, and once the
+// server is shutting down.
+type Readiness struct {
+	reason atomic.Pointer[string] // why the server isn't ready, nil if it is
+}
+
+// NewReadiness returns the readiness of a server that isn't ready yet.
+func NewReadiness() *Readiness {
+	r := &Readiness{}
+	r.NotReady("starting")
+
+	return r
+}
+
+// NotReady marks the server as not ready for the given reason.
+func (r *Readiness) NotReady(reason string) {
+	r.reason.Store(&reason)
+}
+
+// SetReady marks the server as ready.
+func (r *Readiness) SetReady() {
+	r.reason.Store(nil)
+}
+
+// Ready reports whether the server is ready, and why not if it isn't.
+func (r *Readiness) Ready() (bool, string) {
+	if reason := r.reason.Load(); reason != nil {
+		return false, *reason
+	}
+
+	return true, ""
+}
+
+// Gate responds with 503 Service Unavailable instead of calling next until
+// the server is ready.
+func (r *Readiness) Gate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ready, reason := r.Ready(); !ready {
+			http.Error(w, fmt.Sprintf("Service Unavailable: %s", reason), http.StatusServiceUnavailable)
+
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// InitLifecycleRoutes initializes the health and readiness routes, following
+// the Prometheus management API.
+func InitLifecycleRoutes(r *http.ServeMux, readiness *Readiness) {
+	r.HandleFunc("/-/healthy", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "mini-tsdb is Healthy.")
+	})
+	r.Handle("/-/ready", readiness.Gate(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "mini-tsdb is Ready.")
+	})))
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	readiness := NewReadiness()
+
+	r := http.NewServeMux()
+	InitLifecycleRoutes(r, readiness)
+	r.Handle("/api/v1/labels", readiness.Gate(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		return rec.Code, rec.Body.String()
+	}
+
+	testCases := []struct {
+		name          string
+		update        func()
+		expectedReady int
+		expectedBody  string
+	}{
+		{
+			name:          "starting",
+			update:        func() {},
+			expectedReady: http.StatusServiceUnavailable,
+			expectedBody:  "Service Unavailable: starting\n",
+		},
+		{
+			name:          "replaying",
+			update:        func() { readiness.NotReady("replaying WAL") },
+			expectedReady: http.StatusServiceUnavailable,
+			expectedBody:  "Service Unavailable: replaying WAL\n",
+		},
+		{
+			name:          "ready",
+			update:        readiness.SetReady,
+			expectedReady: http.StatusOK,
+			expectedBody:  "mini-tsdb is Ready.\n",
+		},
+		{
+			name:          "shutting down",
+			update:        func() { readiness.NotReady("shutting down") },
+			expectedReady: http.StatusServiceUnavailable,
+			expectedBody:  "Service Unavailable: shutting down\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.update()
+
+			// The server is healthy in every state
+			code, body := get("/-/healthy")
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, "mini-tsdb is Healthy.\n", body)
+
+			code, body = get("/-/ready")
+			assert.Equal(t, tc.expectedReady, code)
+			assert.Equal(t, tc.expectedBody, body)
+
+			// The API is only served when the server is ready
+			code, _ = get("/api/v1/labels")
+			assert.Equal(t, tc.expectedReady, code)
+		})
+	}
+}
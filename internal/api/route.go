@@ -3,14 +3,62 @@ package api
 import (
 	"log/slog"
 	"net/http"
+	"sync"
 
 	v1 "github.com/dstdfx/mini-tsdb/internal/api/v1"
 	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // InitRoutesV1 initializes HTTP routes for v1 API.
-func InitRoutesV1(r *http.ServeMux, log *slog.Logger, s domain.Storage, w domain.Wal) {
-	h := v1.NewHandler(log, s, w)
-	r.Handle("/api/v1/write", h.RemoteWrite())
-	r.Handle("/api/v1/read", h.RemoteRead())
+// The API metrics are registered with reg if it's set. appendMu must be
+// shared with the admin routes.
+func InitRoutesV1(
+	r *http.ServeMux,
+	log *slog.Logger,
+	s domain.Storage,
+	w domain.Wal,
+	e *query.Engine,
+	reg prometheus.Registerer,
+	appendMu *sync.RWMutex) {
+	m := v1.NewMetrics(reg)
+	h := v1.NewHandler(log, s, w, e, m, appendMu)
+
+	handle := func(pattern string, handler http.Handler) {
+		r.Handle(pattern, m.Instrument(pattern, handler))
+	}
+	handle("/api/v1/write", h.RemoteWrite())
+	handle("/api/v1/read", h.RemoteRead())
+	handle("/api/v1/query", h.Query())
+	handle("/api/v1/query_range", h.QueryRange())
+	handle("/api/v1/labels", h.LabelNames())
+	handle("/api/v1/label/{name}/values", h.LabelValues())
+	handle("/api/v1/series", h.Series())
+	handle("/api/v1/status/buildinfo", h.BuildInfo())
+	handle("/api/v1/status/tsdb", h.TSDBStatus())
+}
+
+// InitAdminRoutesV1 initializes HTTP routes for v1 TSDB admin API.
+// The snapshot endpoint is only registered if snapshot is set, it waits for
+// the appends of the v1 routes that share appendMu.
+func InitAdminRoutesV1(
+	r *http.ServeMux,
+	log *slog.Logger,
+	s domain.Storage,
+	w domain.Wal,
+	snapshot func() error,
+	appendMu *sync.RWMutex) {
+	h := v1.NewHandler(log, s, w, nil, nil, appendMu)
+	r.Handle("POST /api/v1/admin/tsdb/delete_series", h.DeleteSeries())
+	r.Handle("POST /api/v1/admin/tsdb/clean_tombstones", h.CleanTombstones())
+	if snapshot != nil {
+		r.Handle("POST /api/v1/admin/tsdb/snapshot", h.Snapshot(snapshot))
+	}
+}
+
+// InitMetricsRoute serves the metrics gathered by g on /metrics.
+func InitMetricsRoute(r *http.ServeMux, g prometheus.Gatherer) {
+	r.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
 }
@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// DeleteSeries deletes data of the series that match the selectors within
+// the time range, following the Prometheus TSDB admin API. Tombstones are
+// appended to the WAL first, so the deletion survives a restart.
+func (h *handler) DeleteSeries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseMetadataParams(r, true)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+
+		tombstones := make([]domain.Tombstone, 0, len(params.matcherSets))
+		for _, matchers := range params.matcherSets {
+			tombstones = append(tombstones, domain.Tombstone{
+				Matchers:  matchers,
+				MinTimeMs: params.fromMs,
+				MaxTimeMs: params.toMs,
+			})
+		}
+
+		affected, err := h.deleteSeries(tombstones)
+		if err != nil {
+			h.log.Error("failed to delete series", slog.Any("error", err))
+			h.respondError(w, errorInternal, err)
+
+			return
+		}
+
+		h.log.Info("deleted series",
+			slog.Any("match", r.Form["match[]"]),
+			slog.Int("series", affected))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteSeries appends the tombstones to the WAL and applies them to the
+// storage. It returns the number of affected series.
+func (h *handler) deleteSeries(tombstones []domain.Tombstone) (int, error) {
+	h.appendMu.RLock()
+	defer h.appendMu.RUnlock()
+
+	err := h.wal.Append(domain.WalEntity{
+		Timestamp:  time.Now().Unix(),
+		Tombstones: tombstones,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to append tombstones to wal: %w", err)
+	}
+
+	var affected int
+	for _, t := range tombstones {
+		n, err := h.storage.Delete(t)
+		if err != nil {
+			return affected, fmt.Errorf("failed to delete series: %w", err)
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// CleanTombstones reclaims the space of deleted data right away instead of
+// waiting for the periodic cleanup.
+func (h *handler) CleanTombstones() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		removed := h.storage.CleanTombstones()
+
+		h.log.Info("cleaned tombstones", slog.Int("removed_series", removed))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Snapshot persists the head, so only the WAL written after it needs to be
+// replayed on start. Writes wait until it's done.
+func (h *handler) Snapshot(snapshot func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		h.appendMu.Lock()
+		err := snapshot()
+		h.appendMu.Unlock()
+
+		if err != nil {
+			h.log.Error("failed to take snapshot", slog.Any("error", err))
+			h.respondError(w, errorInternal, fmt.Errorf("failed to take snapshot: %w", err))
+
+			return
+		}
+
+		h.log.Info("snapshot taken")
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
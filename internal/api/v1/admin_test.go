@@ -0,0 +1,181 @@
+package v1
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWal remembers appended entities.
+type recordingWal struct {
+	entities []domain.WalEntity
+}
+
+func (w *recordingWal) Append(e domain.WalEntity) error {
+	w.entities = append(w.entities, e)
+
+	return nil
+}
+
+func TestHandler_DeleteSeries(t *testing.T) {
+	testCases := []struct {
+		name               string
+		method             string
+		params             url.Values
+		expectedCode       int
+		expectedTombstones []domain.Tombstone
+		expectedJobs       []string
+	}{
+		{
+			name:         "whole series",
+			method:       http.MethodPost,
+			params:       url.Values{"match[]": {`up{job="api"}`}},
+			expectedCode: http.StatusNoContent,
+			expectedTombstones: []domain.Tombstone{
+				{
+					Matchers: []domain.LabelMatcher{
+						{Type: domain.EQ, Name: "job", Value: "api"},
+						{Type: domain.EQ, Name: "__name__", Value: "up"},
+					},
+					MinTimeMs: math.MinInt64,
+					MaxTimeMs: math.MaxInt64,
+				},
+			},
+			expectedJobs: []string{"db"},
+		},
+		{
+			name:   "time range of several selectors",
+			method: http.MethodPost,
+			params: url.Values{
+				"match[]": {`{job="api"}`, `{job="db"}`},
+				"start":   {"0"},
+				"end":     {"150"},
+			},
+			expectedCode: http.StatusNoContent,
+			expectedTombstones: []domain.Tombstone{
+				{
+					Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "api"}},
+					MinTimeMs: 0,
+					MaxTimeMs: 150_000,
+				},
+				{
+					Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+					MinTimeMs: 0,
+					MaxTimeMs: 150_000,
+				},
+			},
+			// The db sample is out of the range
+			expectedJobs: []string{"db"},
+		},
+		{
+			name:         "no selectors",
+			method:       http.MethodPost,
+			expectedCode: http.StatusBadRequest,
+			expectedJobs: []string{"api", "db"},
+		},
+		{
+			name:         "selector matching everything",
+			method:       http.MethodPost,
+			params:       url.Values{"match[]": {`{job=~".*"}`}},
+			expectedCode: http.StatusBadRequest,
+			expectedJobs: []string{"api", "db"},
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodGet,
+			params:       url.Values{"match[]": {`up`}},
+			expectedCode: http.StatusMethodNotAllowed,
+			expectedJobs: []string{"api", "db"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := storage.NewInMemory(storage.Opts{})
+			s.Write([]domain.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "api"},
+			}, []domain.Sample{{Timestamp: 100_000, Value: 1}})
+			s.Write([]domain.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "db"},
+			}, []domain.Sample{{Timestamp: 200_000, Value: 1}})
+
+			wal := &recordingWal{}
+			h := NewHandler(slog.New(slog.DiscardHandler), s, wal, nil, nil, nil)
+
+			mux := http.NewServeMux()
+			mux.Handle("POST /api/v1/admin/tsdb/delete_series", h.DeleteSeries())
+
+			req := httptest.NewRequest(tc.method, "/api/v1/admin/tsdb/delete_series",
+				strings.NewReader(tc.params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+
+			mux.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedTombstones != nil {
+				require.Len(t, wal.entities, 1)
+				assert.Empty(t, wal.entities[0].TimeSeries)
+				assert.Equal(t, tc.expectedTombstones, wal.entities[0].Tombstones)
+			} else {
+				assert.Empty(t, wal.entities)
+			}
+
+			assert.Equal(t, tc.expectedJobs, s.LabelValues("job", math.MinInt64, math.MaxInt64, nil))
+		})
+	}
+}
+
+func TestHandler_Snapshot(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		expectedCode int
+	}{
+		{
+			name:         "taken",
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "failed",
+			err:          errors.New("disk is full"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var appendMu sync.RWMutex
+			h := NewHandler(slog.New(slog.DiscardHandler), storage.NewInMemory(storage.Opts{}), &recordingWal{}, nil, nil, &appendMu)
+
+			var taken int
+			snapshot := func() error {
+				taken++
+
+				// Appends sharing the lock wait for the snapshot
+				assert.False(t, appendMu.TryRLock())
+
+				return tc.err
+			}
+
+			rec := httptest.NewRecorder()
+			h.Snapshot(snapshot)(rec, httptest.NewRequest(http.MethodPost, "/api/v1/admin/tsdb/snapshot", nil))
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			assert.Equal(t, 1, taken)
+		})
+	}
+}
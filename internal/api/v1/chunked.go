@@ -0,0 +1,52 @@
+package v1
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkedWriter writes frames of a streamed remote read response and flushes
+// every one of them to the client. Each frame is:
+//
+//	<uvarint frame size><big-endian CRC32C of the data><data>
+//
+// which is the framing Prometheus expects for STREAMED_XOR_CHUNKS responses.
+type chunkedWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func newChunkedWriter(w io.Writer, f http.Flusher) *chunkedWriter {
+	return &chunkedWriter{
+		w:       w,
+		flusher: f,
+	}
+}
+
+// Write writes the data as a single frame.
+func (cw *chunkedWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	header := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutUvarint(header, uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, castagnoliTable))
+
+	if _, err := cw.w.Write(header[:n+4]); err != nil {
+		return 0, err
+	}
+
+	written, err := cw.w.Write(data)
+	if err != nil {
+		return written, err
+	}
+
+	cw.flusher.Flush()
+
+	return written, nil
+}
@@ -1,28 +1,66 @@
 package v1
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
 	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/prometheus/prometheus/prompb"
 )
 
+// Response types of read queries in metrics.
+const (
+	responseTypeSamples  = "samples"
+	responseTypeStreamed = "streamed_xor_chunks"
+)
+
 type handler struct {
 	log     *slog.Logger
 	storage domain.Storage
 	wal     domain.Wal
+	engine  *query.Engine
+	metrics *Metrics
+
+	// appendMu keeps snapshots from being taken while data is appended to
+	// the WAL, but not applied to the storage yet. It must be shared by all
+	// the handlers that write to the same WAL and storage.
+	appendMu *sync.RWMutex
 }
 
-func NewHandler(log *slog.Logger, s domain.Storage, w domain.Wal) *handler {
+// NewHandler creates the API handlers, nil metrics are not registered.
+// Appends and snapshots are serialized by appendMu, a nil one gives the
+// handlers a lock of their own.
+func NewHandler(
+	log *slog.Logger,
+	s domain.Storage,
+	w domain.Wal,
+	e *query.Engine,
+	m *Metrics,
+	appendMu *sync.RWMutex) *handler {
+	if m == nil {
+		m = NewMetrics(nil)
+	}
+	if appendMu == nil {
+		appendMu = &sync.RWMutex{}
+	}
+
 	return &handler{
-		log:     log,
-		storage: s,
-		wal:     w,
+		log:      log,
+		storage:  s,
+		wal:      w,
+		engine:   e,
+		metrics:  m,
+		appendMu: appendMu,
 	}
 }
 
@@ -32,6 +70,22 @@ func (h *handler) RemoteWrite() http.HandlerFunc {
 			slog.String("method", r.Method),
 			slog.String("url", r.URL.String()))
 
+		// Figure out the protocol version
+		version, err := parseWriteProto(r.Header.Get("Content-Type"))
+		if err != nil {
+			h.log.Error("Unsupported content type", slog.String("error", err.Error()))
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		if enc := r.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "snappy") {
+			h.log.Error("Unsupported content encoding", slog.String("encoding", enc))
+			http.Error(w, "only snappy encoding is supported", http.StatusUnsupportedMediaType)
+
+			return
+		}
+
 		// Read the payload
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -51,58 +105,68 @@ func (h *handler) RemoteWrite() http.HandlerFunc {
 			return
 		}
 
-		// Unmarshal the request
-		var request prompb.WriteRequest
-		if err := proto.Unmarshal(decoded, &request); err != nil {
-			h.log.Error("Failed to unmarshal protobuf", slog.String("error", err.Error()))
-			http.Error(w, "cannot unmarshal protobuf", http.StatusBadRequest)
+		// Parse time series
+		var (
+			timeSeries []domain.TimeSeries
+			stats      writeStats
+		)
+		switch version {
+		case writeProtoV1:
+			timeSeries, stats, err = parseWriteRequestV1(decoded)
+		case writeProtoV2:
+			timeSeries, stats, err = parseWriteRequestV2(decoded)
+		}
+		if err != nil {
+			h.log.Error("Failed to parse write request", slog.String("error", err.Error()))
+			http.Error(w, err.Error(), http.StatusBadRequest)
 
 			return
 		}
 
-		// Parse time series
-		timeSeries := make([]domain.TimeSeries, 0, len(request.Timeseries))
-		for _, ts := range request.Timeseries {
-			labels := make([]domain.Label, len(ts.Labels))
-			for i, label := range ts.Labels {
-				labels[i] = domain.Label{
-					Name:  string(label.Name),
-					Value: string(label.Value),
-				}
-			}
-
-			samples := make([]domain.Sample, len(ts.Samples))
-			for i, sample := range ts.Samples {
-				samples[i] = domain.Sample{
-					Timestamp: sample.Timestamp,
-					Value:     sample.Value,
-				}
-			}
-
-			if len(labels) == 0 || len(samples) == 0 {
-				continue
-			}
+		unsupportedErr := stats.unsupported()
+		if unsupportedErr != nil {
+			h.log.Warn("Write request holds unsupported data", slog.String("error", unsupportedErr.Error()))
+		}
 
-			timeSeries = append(timeSeries, domain.TimeSeries{
-				Labels:  labels,
-				Samples: samples,
-			})
+		// Drop series over the limits before anything is persisted, the rest
+		// of the request is still written
+		timeSeries, limitsErr := h.storage.ApplyLimits(timeSeries)
+		if limitsErr != nil {
+			h.log.Warn("Write request exceeds limits", slog.String("error", limitsErr.Error()))
 		}
 
+		h.appendMu.RLock()
+
 		// Write data to WAL first
 		err = h.wal.Append(domain.WalEntity{
 			Timestamp:  time.Now().Unix(),
 			TimeSeries: timeSeries,
 		})
 		if err != nil {
+			h.appendMu.RUnlock()
 			h.log.Error("failed to append data to wal", slog.Any("error", err))
 			w.WriteHeader(http.StatusInternalServerError)
 
 			return
 		}
 
-		// Write data to in memory storage
-		h.storage.WriteMultiple(timeSeries)
+		// Write data to in memory storage, out-of-order samples and
+		// duplicates it drops don't count as written
+		stats.samples = h.storage.WriteMultiple(timeSeries)
+		h.appendMu.RUnlock()
+
+		stats.setHeaders(w)
+		if err := errors.Join(unsupportedErr, limitsErr); err != nil {
+			// Dropped data would be dropped again, don't let the client retry
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		if version == writeProtoV2 {
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 	}
@@ -142,15 +206,10 @@ func (h *handler) RemoteRead() http.HandlerFunc {
 			return
 		}
 
-		// Handle read queries
-		response := prompb.ReadResponse{
-			Results: make([]*prompb.QueryResult, 0, len(request.Queries)),
-		}
+		// Convert and validate matchers of all the queries upfront, a streamed
+		// response can't be turned into an error once it's started
+		queryMatchers := make([][]domain.LabelMatcher, 0, len(request.Queries))
 		for _, q := range request.Queries {
-			if q.Hints != nil {
-				h.log.Warn("got read hints in the read request, ignoring", slog.Any("hints", q.Hints))
-			}
-
 			// Collect matchers
 			matchers := make([]domain.LabelMatcher, 0, len(q.Matchers))
 			for _, m := range q.Matchers {
@@ -161,8 +220,45 @@ func (h *handler) RemoteRead() http.HandlerFunc {
 				})
 			}
 
+			// Make sure all the matchers are valid
+			if _, err := domain.NewMatchers(matchers); err != nil {
+				h.log.Error("Invalid label matchers", slog.String("error", err.Error()))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+
+			queryMatchers = append(queryMatchers, matchers)
+		}
+
+		responseType := negotiateResponseType(request.AcceptedResponseTypes)
+		if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+
+				return
+			}
+
+			h.remoteReadStreamed(w, flusher, request.Queries, queryMatchers)
+
+			return
+		}
+
+		// Handle read queries
+		response := prompb.ReadResponse{
+			Results: make([]*prompb.QueryResult, 0, len(request.Queries)),
+		}
+		for i, q := range request.Queries {
 			// Handle query
-			result := h.storage.Read(q.StartTimestampMs, q.EndTimestampMs, matchers)
+			start := time.Now()
+			var result []domain.TimeSeries
+			if q.Hints != nil {
+				result = h.storage.ReadWithHints(q.StartTimestampMs, q.EndTimestampMs, queryMatchers[i], readHints(q.Hints))
+			} else {
+				result = h.storage.Read(q.StartTimestampMs, q.EndTimestampMs, queryMatchers[i])
+			}
+			h.metrics.readDuration.WithLabelValues(responseTypeSamples).Observe(time.Since(start).Seconds())
 
 			h.log.Debug("got result from storage", slog.Any("result", result))
 
@@ -170,7 +266,9 @@ func (h *handler) RemoteRead() http.HandlerFunc {
 			queryResult := make([]*prompb.TimeSeries, 0, len(result))
 			for _, r := range result {
 				queryResult = append(queryResult, r.ToProto())
+				h.metrics.readSamples.Add(float64(len(r.Samples)))
 			}
+			h.metrics.readSeries.Add(float64(len(result)))
 
 			response.Results = append(response.Results, &prompb.QueryResult{
 				Timeseries: queryResult,
@@ -197,3 +295,98 @@ func (h *handler) RemoteRead() http.HandlerFunc {
 		}
 	}
 }
+
+// negotiateResponseType picks the first supported response type the client
+// accepts, clients that don't say anything get samples.
+func negotiateResponseType(accepted []prompb.ReadRequest_ResponseType) prompb.ReadRequest_ResponseType {
+	for _, t := range accepted {
+		switch t {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t
+		}
+	}
+
+	return prompb.ReadRequest_SAMPLES
+}
+
+// remoteReadStreamed writes query results as a stream of ChunkedReadResponse
+// frames, one per series chunk, so the response is never held in memory.
+func (h *handler) remoteReadStreamed(
+	w http.ResponseWriter,
+	flusher http.Flusher,
+	queries []*prompb.Query,
+	queryMatchers [][]domain.LabelMatcher) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+
+	cw := newChunkedWriter(w, flusher)
+
+	for i, q := range queries {
+		// Chunks are sent as they're stored, hints only narrow the time range
+		fromMs, toMs := q.StartTimestampMs, q.EndTimestampMs
+		if q.Hints != nil {
+			fromMs, toMs = readHints(q.Hints).Clip(fromMs, toMs)
+		}
+
+		start := time.Now()
+		err := h.storage.ReadChunks(fromMs, toMs, queryMatchers[i], func(series domain.ChunkedSeries) error {
+			h.metrics.readSeries.Inc()
+
+			labels := make([]prompb.Label, 0, len(series.Labels))
+			for _, l := range series.Labels {
+				labels = append(labels, prompb.Label{
+					Name:  l.Name,
+					Value: l.Value,
+				})
+			}
+
+			for _, c := range series.Chunks {
+				h.metrics.readSamples.Add(float64(chunk.NumSamples(c.Data)))
+
+				frame, err := proto.Marshal(&prompb.ChunkedReadResponse{
+					ChunkedSeries: []*prompb.ChunkedSeries{
+						{
+							Labels: labels,
+							Chunks: []prompb.Chunk{
+								{
+									MinTimeMs: c.MinTimeMs,
+									MaxTimeMs: c.MaxTimeMs,
+									Type:      prompb.Chunk_XOR,
+									Data:      c.Data,
+								},
+							},
+						},
+					},
+					QueryIndex: int64(i),
+				})
+				if err != nil {
+					return fmt.Errorf("failed to marshal frame: %w", err)
+				}
+
+				if _, err := cw.Write(frame); err != nil {
+					return fmt.Errorf("failed to write frame: %w", err)
+				}
+			}
+
+			return nil
+		})
+		h.metrics.readDuration.WithLabelValues(responseTypeStreamed).Observe(time.Since(start).Seconds())
+		if err != nil {
+			// The response has already started, the client sees a broken stream
+			h.log.Error("failed to stream read response", slog.Any("error", err))
+
+			return
+		}
+	}
+}
+
+func readHints(h *prompb.ReadHints) domain.ReadHints {
+	return domain.ReadHints{
+		StartMs:  h.StartMs,
+		EndMs:    h.EndMs,
+		StepMs:   h.StepMs,
+		Func:     h.Func,
+		RangeMs:  h.RangeMs,
+		Grouping: h.Grouping,
+		By:       h.By,
+	}
+}
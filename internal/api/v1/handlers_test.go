@@ -0,0 +1,292 @@
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_RemoteRead_Streamed(t *testing.T) {
+	s := storage.NewInMemory(storage.Opts{})
+
+	samples := make([]domain.Sample, 0, 300)
+	for i := 0; i < 300; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+	s.Write([]domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}, samples)
+	s.Write([]domain.Label{{Name: "__name__", Value: "down"}}, samples[:1])
+
+	h := NewHandler(slog.New(slog.DiscardHandler), s, nil, nil, nil, nil)
+
+	request := &prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: 0,
+				EndTimestampMs:   299,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				},
+			},
+			{
+				StartTimestampMs: 0,
+				EndTimestampMs:   299,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "down"},
+				},
+			},
+		},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	}
+	data, err := proto.Marshal(request)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.RemoteRead()(rec, httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, data))))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", rec.Header().Get("Content-Type"))
+
+	// Read the frames back
+	got := make(map[int64][]domain.Sample)
+	frames := 0
+	r := bufio.NewReader(rec.Body)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		var checksum uint32
+		require.NoError(t, binary.Read(r, binary.BigEndian, &checksum))
+
+		frame := make([]byte, size)
+		_, err = io.ReadFull(r, frame)
+		require.NoError(t, err)
+		require.Equal(t, crc32.Checksum(frame, castagnoliTable), checksum)
+
+		var resp prompb.ChunkedReadResponse
+		require.NoError(t, proto.Unmarshal(frame, &resp))
+		require.Len(t, resp.ChunkedSeries, 1)
+		require.Len(t, resp.ChunkedSeries[0].Chunks, 1)
+
+		c, err := chunk.FromBytes(resp.ChunkedSeries[0].Chunks[0].Data)
+		require.NoError(t, err)
+		decoded, err := c.Samples()
+		require.NoError(t, err)
+
+		got[resp.QueryIndex] = append(got[resp.QueryIndex], decoded...)
+		frames++
+	}
+
+	// One frame per chunk
+	assert.Equal(t, 4, frames)
+	assert.Equal(t, samples, got[0])
+	assert.Equal(t, samples[:1], got[1])
+}
+
+func TestNegotiateResponseType(t *testing.T) {
+	assert.Equal(t, prompb.ReadRequest_SAMPLES, negotiateResponseType(nil))
+	assert.Equal(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS, negotiateResponseType([]prompb.ReadRequest_ResponseType{
+		prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+		prompb.ReadRequest_SAMPLES,
+	}))
+	assert.Equal(t, prompb.ReadRequest_SAMPLES, negotiateResponseType([]prompb.ReadRequest_ResponseType{
+		prompb.ReadRequest_SAMPLES,
+		prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+	}))
+}
+
+type nopWal struct{}
+
+func (nopWal) Append(domain.WalEntity) error { return nil }
+
+func TestHandler_RemoteWrite(t *testing.T) {
+	v1Request := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+				Samples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+			},
+		},
+	}
+	v2Request := &writev2.Request{
+		Symbols: []string{"", "__name__", "up", "job", "a"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []writev2.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name            string
+		contentType     string
+		request         proto.Message
+		limits          storage.Limits
+		expectedCode    int
+		expectedWritten string
+		expectedError   string
+	}{
+		{
+			name:            "v1 without content type",
+			request:         v1Request,
+			expectedCode:    http.StatusOK,
+			expectedWritten: "2",
+		},
+		{
+			name:            "v1",
+			contentType:     "application/x-protobuf;proto=prometheus.WriteRequest",
+			request:         v1Request,
+			expectedCode:    http.StatusOK,
+			expectedWritten: "2",
+		},
+		{
+			name:            "v2",
+			contentType:     "application/x-protobuf;proto=io.prometheus.write.v2.Request",
+			request:         v2Request,
+			expectedCode:    http.StatusNoContent,
+			expectedWritten: "2",
+		},
+		{
+			name: "v1 with histograms and exemplars",
+			request: &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					{
+						Labels:    []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+						Samples:   []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+						Exemplars: []prompb.Exemplar{{Value: 1, Timestamp: 1}},
+					},
+					{
+						Labels:     []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+						Histograms: []prompb.Histogram{{Timestamp: 1}, {Timestamp: 2}},
+					},
+				},
+			},
+			expectedCode:    http.StatusBadRequest,
+			expectedWritten: "2",
+			expectedError:   "dropped 2 histogram samples and 1 exemplars: native histograms and exemplars are not supported\n",
+		},
+		{
+			name:        "v2 with histograms and exemplars",
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request",
+			request: &writev2.Request{
+				Symbols: []string{"", "__name__", "up", "job", "a", "b"},
+				Timeseries: []writev2.TimeSeries{
+					{
+						LabelsRefs: []uint32{1, 2, 3, 4},
+						Samples:    []writev2.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+						Exemplars:  []writev2.Exemplar{{Value: 1, Timestamp: 1}},
+					},
+					{
+						LabelsRefs: []uint32{1, 2, 3, 5},
+						Histograms: []writev2.Histogram{{Timestamp: 1}},
+					},
+				},
+			},
+			expectedCode:    http.StatusBadRequest,
+			expectedWritten: "2",
+			expectedError:   "dropped 1 histogram samples and 1 exemplars: native histograms and exemplars are not supported\n",
+		},
+		{
+			name:         "unknown proto",
+			contentType:  "application/x-protobuf;proto=io.prometheus.write.v3.Request",
+			request:      v2Request,
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "symbol out of range",
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request",
+			request: &writev2.Request{
+				Symbols: []string{"", "__name__"},
+				Timeseries: []writev2.TimeSeries{
+					{
+						LabelsRefs: []uint32{1, 2},
+						Samples:    []writev2.Sample{{Timestamp: 1, Value: 1}},
+					},
+				},
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name: "series limit",
+			request: &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+						Samples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+					},
+					{
+						Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+						Samples: []prompb.Sample{{Timestamp: 1, Value: 1}},
+					},
+				},
+			},
+			limits:          storage.Limits{MaxSeriesPerMetric: 1},
+			expectedCode:    http.StatusBadRequest,
+			expectedWritten: "2",
+			expectedError:   "dropped 1 of 2 series: too many series: metric \"up\" exceeds the limit of 1 series per metric\n",
+		},
+		{
+			name:          "label value length limit",
+			request:       v1Request,
+			limits:        storage.Limits{MaxLabelValueLength: 1},
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "dropped 1 of 1 series: invalid series: value of label \"__name__\" of metric \"up\" is 2 bytes long, the limit is 1\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := storage.NewInMemory(storage.Opts{Limits: tc.limits})
+			h := NewHandler(slog.New(slog.DiscardHandler), s, nopWal{}, nil, nil, nil)
+
+			data, err := proto.Marshal(tc.request)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, data)))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			req.Header.Set("Content-Encoding", "snappy")
+
+			rec := httptest.NewRecorder()
+			h.RemoteWrite()(rec, req)
+
+			require.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedError != "" {
+				assert.Equal(t, tc.expectedError, rec.Body.String())
+			}
+			if tc.expectedWritten == "" {
+				return
+			}
+
+			assert.Equal(t, tc.expectedWritten, rec.Header().Get("X-Prometheus-Remote-Write-Samples-Written"))
+			assert.Equal(t, "0", rec.Header().Get("X-Prometheus-Remote-Write-Histograms-Written"))
+			assert.Equal(t, "0", rec.Header().Get("X-Prometheus-Remote-Write-Exemplars-Written"))
+
+			got := s.Read(0, 10, []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "a"}})
+			if assert.Len(t, got, 1) {
+				assert.Equal(t, []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}, got[0].Samples)
+			}
+			assert.Empty(t, s.Read(0, 10, []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "b"}}))
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package v1
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// LabelNames lists label names, following the Prometheus HTTP API.
+func (h *handler) LabelNames() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseMetadataParams(r, false)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+
+		var names []string
+		for _, matchers := range params.matcherSets {
+			names = append(names, h.storage.LabelNames(params.fromMs, params.toMs, matchers)...)
+		}
+
+		h.respondList(w, mergeSorted(names), params.limit)
+	}
+}
+
+// LabelValues lists values of the label from the path, following the
+// Prometheus HTTP API.
+func (h *handler) LabelValues() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !model.LabelName(name).IsValid() {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid label name: %q", name))
+
+			return
+		}
+
+		params, err := parseMetadataParams(r, false)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+
+		var values []string
+		for _, matchers := range params.matcherSets {
+			values = append(values, h.storage.LabelValues(name, params.fromMs, params.toMs, matchers)...)
+		}
+
+		h.respondList(w, mergeSorted(values), params.limit)
+	}
+}
+
+// Series lists label sets of the series that match the selectors, following
+// the Prometheus HTTP API.
+func (h *handler) Series() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseMetadataParams(r, true)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+
+		var series [][]domain.Label
+		for _, matchers := range params.matcherSets {
+			series = append(series, h.storage.Series(params.fromMs, params.toMs, matchers)...)
+		}
+
+		// Several selectors can match the same series
+		slices.SortFunc(series, compareLabelSets)
+		series = slices.CompactFunc(series, func(a, b []domain.Label) bool {
+			return compareLabelSets(a, b) == 0
+		})
+
+		var warnings []string
+		if params.limit > 0 && len(series) > params.limit {
+			series = series[:params.limit]
+			warnings = append(warnings, "results truncated due to limit")
+		}
+
+		data := make([]map[string]string, 0, len(series))
+		for _, labels := range series {
+			m := make(map[string]string, len(labels))
+			for _, l := range labels {
+				m[l.Name] = l.Value
+			}
+			data = append(data, m)
+		}
+
+		h.respond(w, http.StatusOK, apiResponse{
+			Status:   "success",
+			Data:     data,
+			Warnings: warnings,
+		})
+	}
+}
+
+// metadataParams are the common parameters of the metadata endpoints.
+type metadataParams struct {
+	fromMs, toMs int64
+	// matcherSets holds matchers of every match[] selector, a single empty
+	// set selects every series
+	matcherSets [][]domain.LabelMatcher
+	limit       int
+}
+
+func parseMetadataParams(r *http.Request, requireMatch bool) (metadataParams, error) {
+	params := metadataParams{
+		fromMs: math.MinInt64,
+		toMs:   math.MaxInt64,
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return params, fmt.Errorf("failed to parse form: %w", err)
+	}
+
+	if v := r.FormValue("start"); v != "" {
+		start, err := parseTime(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter \"start\": %w", err)
+		}
+		params.fromMs = start.UnixMilli()
+	}
+
+	if v := r.FormValue("end"); v != "" {
+		end, err := parseTime(v)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter \"end\": %w", err)
+		}
+		params.toMs = end.UnixMilli()
+	}
+
+	if v := r.FormValue("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return params, fmt.Errorf("invalid parameter \"limit\": %q", v)
+		}
+		params.limit = limit
+	}
+
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		if requireMatch {
+			return params, errors.New("no match[] parameter provided")
+		}
+
+		params.matcherSets = [][]domain.LabelMatcher{nil}
+
+		return params, nil
+	}
+
+	for _, selector := range selectors {
+		matchers, err := parser.ParseMetricSelector(selector)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter \"match[]\": %w", err)
+		}
+
+		// Selectors that match everything are too expensive
+		if !slices.ContainsFunc(matchers, func(m *labels.Matcher) bool { return !m.Matches("") }) {
+			return params, errors.New("match[] must contain at least one non-empty matcher")
+		}
+
+		params.matcherSets = append(params.matcherSets, query.ToDomainMatchers(matchers))
+	}
+
+	return params, nil
+}
+
+// respondList responds with a sorted list of strings truncated to the limit.
+func (h *handler) respondList(w http.ResponseWriter, list []string, limit int) {
+	var warnings []string
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+		warnings = append(warnings, "results truncated due to limit")
+	}
+
+	h.respond(w, http.StatusOK, apiResponse{
+		Status:   "success",
+		Data:     list,
+		Warnings: warnings,
+	})
+}
+
+// mergeSorted sorts and deduplicates the list, never returning nil.
+func mergeSorted(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+
+	slices.Sort(list)
+
+	return slices.Compact(list)
+}
+
+// compareLabelSets compares label sets sorted by name.
+func compareLabelSets(a, b []domain.Label) int {
+	return slices.CompareFunc(a, b, func(x, y domain.Label) int {
+		if c := cmp.Compare(x.Name, y.Name); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(x.Value, y.Value)
+	})
+}
@@ -0,0 +1,118 @@
+package v1
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Metadata(t *testing.T) {
+	s := storage.NewInMemory(storage.Opts{})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}, []domain.Sample{{Timestamp: 100_000, Value: 1}})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "db"},
+	}, []domain.Sample{{Timestamp: 200_000, Value: 1}})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "requests_total"},
+		{Name: "job", Value: "api"},
+		{Name: "path", Value: "/"},
+	}, []domain.Sample{{Timestamp: 300_000, Value: 1}})
+
+	h := NewHandler(slog.New(slog.DiscardHandler), s, nil, nil, nil, nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/labels", h.LabelNames())
+	mux.Handle("/api/v1/label/{name}/values", h.LabelValues())
+	mux.Handle("/api/v1/series", h.Series())
+
+	testCases := []struct {
+		name         string
+		path         string
+		params       url.Values
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "all label names",
+			path:         "/api/v1/labels",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":["__name__","job","path"]}`,
+		},
+		{
+			name:         "label names of several selectors",
+			path:         "/api/v1/labels",
+			params:       url.Values{"match[]": {`up`, `{path="/"}`}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":["__name__","job","path"]}`,
+		},
+		{
+			name:         "label names within range",
+			path:         "/api/v1/labels",
+			params:       url.Values{"start": {"50"}, "end": {"250"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":["__name__","job"]}`,
+		},
+		{
+			name:         "label values",
+			path:         "/api/v1/label/job/values",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":["api","db"]}`,
+		},
+		{
+			name:         "label values with limit",
+			path:         "/api/v1/label/__name__/values",
+			params:       url.Values{"limit": {"1"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":["requests_total"],"warnings":["results truncated due to limit"]}`,
+		},
+		{
+			name:         "unknown label values",
+			path:         "/api/v1/label/missing/values",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":[]}`,
+		},
+		{
+			name:         "series",
+			path:         "/api/v1/series",
+			params:       url.Values{"match[]": {`up`, `{job="api"}`}, "start": {"150"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":[` +
+				`{"__name__":"requests_total","job":"api","path":"/"},` +
+				`{"__name__":"up","job":"db"}]}`,
+		},
+		{
+			name:         "series without selectors",
+			path:         "/api/v1/series",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "series with an empty selector",
+			path:         "/api/v1/series",
+			params:       url.Values{"match[]": {`{job=~".*"}`}},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path+"?"+tc.params.Encode(), nil))
+
+			require.Equal(t, tc.expectedCode, rec.Code, rec.Body.String())
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
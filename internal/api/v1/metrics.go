@@ -0,0 +1,58 @@
+package v1
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the metrics of the HTTP API.
+type Metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	readDuration    *prometheus.HistogramVec
+	readSeries      prometheus.Counter
+	readSamples     prometheus.Counter
+}
+
+// NewMetrics creates the API metrics, they are only registered if reg is
+// not nil.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+
+	return &Metrics{
+		requests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "minitsdb_http_requests_total",
+			Help: "Total number of HTTP requests by handler and status code.",
+		}, []string{"handler", "code"}),
+		requestDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "minitsdb_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests by handler.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler"}),
+		readDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "minitsdb_read_query_duration_seconds",
+			Help:    "Duration of remote read queries by response type.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"response_type"}),
+		readSeries: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_read_series_total",
+			Help: "Total number of series returned by remote read queries.",
+		}),
+		readSamples: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_read_samples_total",
+			Help: "Total number of samples returned by remote read queries.",
+		}),
+	}
+}
+
+// Instrument counts requests served by the handler and measures their
+// duration, the handler label is set to name.
+func (m *Metrics) Instrument(name string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+
+	return promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(m.requestDuration.MustCurryWith(labels), next))
+}
@@ -0,0 +1,64 @@
+package v1
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_RemoteRead_Metrics(t *testing.T) {
+	s := storage.NewInMemory(storage.Opts{})
+
+	samples := make([]domain.Sample, 0, 150)
+	for i := 0; i < 150; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+	s.Write([]domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}, samples)
+	s.Write([]domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}}, samples[:10])
+
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	read := m.Instrument("/api/v1/read", NewHandler(slog.New(slog.DiscardHandler), s, nil, nil, m, nil).RemoteRead())
+
+	for _, responseType := range []prompb.ReadRequest_ResponseType{
+		prompb.ReadRequest_SAMPLES,
+		prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+	} {
+		data, err := proto.Marshal(&prompb.ReadRequest{
+			Queries: []*prompb.Query{
+				{
+					StartTimestampMs: 0,
+					EndTimestampMs:   149,
+					Matchers: []*prompb.LabelMatcher{
+						{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+					},
+				},
+			},
+			AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{responseType},
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		read.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, data))))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// Both responses are counted
+	assert.Equal(t, float64(4), testutil.ToFloat64(m.readSeries))
+	assert.Equal(t, float64(2*160), testutil.ToFloat64(m.readSamples))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.readDuration))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.requests.WithLabelValues("/api/v1/read", "200")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.requestDuration))
+}
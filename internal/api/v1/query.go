@@ -0,0 +1,286 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxPointsPerSeries is the Prometheus limit of range query resolution.
+const maxPointsPerSeries = 11_000
+
+// Error types of the Prometheus HTTP API.
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+	errorTimeout   = "timeout"
+	errorCanceled  = "canceled"
+	errorInternal  = "internal"
+)
+
+// apiResponse is the envelope of the Prometheus HTTP API responses.
+type apiResponse struct {
+	Status    string   `json:"status"`
+	Data      any      `json:"data,omitempty"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	Infos     []string `json:"infos,omitempty"`
+}
+
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+// Query evaluates an instant query, following the Prometheus HTTP API.
+func (h *handler) Query() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("failed to parse form: %w", err))
+
+			return
+		}
+
+		ts := time.Now()
+		if v := r.FormValue("time"); v != "" {
+			var err error
+			if ts, err = parseTime(v); err != nil {
+				h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err))
+
+				return
+			}
+		}
+
+		ctx, cancel, err := queryContext(r)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+		defer cancel()
+
+		q, err := h.engine.NewInstantQuery(ctx, r.FormValue("query"), ts)
+		if err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+
+			return
+		}
+		defer q.Close()
+
+		h.respondQuery(w, q, q.Exec(ctx))
+	}
+}
+
+// QueryRange evaluates a range query, following the Prometheus HTTP API.
+func (h *handler) QueryRange() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("failed to parse form: %w", err))
+
+			return
+		}
+
+		start, err := parseTime(r.FormValue("start"))
+		if err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err))
+
+			return
+		}
+
+		end, err := parseTime(r.FormValue("end"))
+		if err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err))
+
+			return
+		}
+		if end.Before(start) {
+			h.respondError(w, errorBadData, errors.New("end timestamp must not be before start time"))
+
+			return
+		}
+
+		step, err := parseDuration(r.FormValue("step"))
+		if err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err))
+
+			return
+		}
+		if step <= 0 {
+			h.respondError(w, errorBadData,
+				errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer"))
+
+			return
+		}
+		if end.Sub(start)/step > maxPointsPerSeries {
+			h.respondError(w, errorBadData,
+				errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"))
+
+			return
+		}
+
+		ctx, cancel, err := queryContext(r)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+		defer cancel()
+
+		q, err := h.engine.NewRangeQuery(ctx, r.FormValue("query"), start, end, step)
+		if err != nil {
+			h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+
+			return
+		}
+		defer q.Close()
+
+		h.respondQuery(w, q, q.Exec(ctx))
+	}
+}
+
+// queryContext applies the optional timeout parameter to the request context.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	v := r.FormValue("timeout")
+	if v == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+
+		return ctx, cancel, nil
+	}
+
+	timeout, err := parseDuration(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid parameter \"timeout\": %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+
+	return ctx, cancel, nil
+}
+
+func (h *handler) respondQuery(w http.ResponseWriter, q promql.Query, res *promql.Result) {
+	if res.Err != nil {
+		var (
+			errorType = errorExecution
+			canceled  promql.ErrQueryCanceled
+			timeout   promql.ErrQueryTimeout
+			storage   promql.ErrStorage
+		)
+		switch {
+		case errors.As(res.Err, &canceled):
+			errorType = errorCanceled
+		case errors.As(res.Err, &timeout):
+			errorType = errorTimeout
+		case errors.As(res.Err, &storage):
+			errorType = errorInternal
+		}
+
+		h.respondError(w, errorType, res.Err)
+
+		return
+	}
+
+	// Empty results are encoded as empty lists rather than nulls
+	value := res.Value
+	switch v := value.(type) {
+	case promql.Vector:
+		if v == nil {
+			value = promql.Vector{}
+		}
+	case promql.Matrix:
+		if v == nil {
+			value = promql.Matrix{}
+		}
+	}
+
+	warnings, infos := res.Warnings.AsStrings(q.Statement().String(), 10, 10)
+
+	h.respond(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: value.Type(),
+			Result:     value,
+		},
+		Warnings: warnings,
+		Infos:    infos,
+	})
+}
+
+func (h *handler) respondError(w http.ResponseWriter, errorType string, err error) {
+	code := http.StatusInternalServerError
+	switch errorType {
+	case errorBadData:
+		code = http.StatusBadRequest
+	case errorExecution:
+		code = http.StatusUnprocessableEntity
+	case errorTimeout, errorCanceled:
+		code = http.StatusServiceUnavailable
+	}
+
+	h.respond(w, code, apiResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+func (h *handler) respond(w http.ResponseWriter, code int, response apiResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		h.log.Error("failed to marshal response", slog.Any("error", err))
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if _, err := w.Write(data); err != nil {
+		h.log.Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+// parseTime parses a unix timestamp in seconds or an RFC3339 time.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+
+		return time.Unix(int64(sec), int64(ns*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a duration in seconds or a Prometheus duration.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration, it overflows int64", s)
+		}
+
+		return time.Duration(ts), nil
+	}
+
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
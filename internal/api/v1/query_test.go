@@ -0,0 +1,135 @@
+package v1
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_Query(t *testing.T) {
+	s := storage.NewInMemory(storage.Opts{})
+
+	// Counters growing by 1 every 15 seconds for 10 minutes
+	var samples []domain.Sample
+	for i := 0; i <= 40; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i) * 15_000, Value: float64(i)})
+	}
+	s.Write([]domain.Label{{Name: "__name__", Value: "requests_total"}, {Name: "job", Value: "a"}}, samples)
+	s.Write([]domain.Label{{Name: "__name__", Value: "requests_total"}, {Name: "job", Value: "b"}}, samples)
+
+	logger := slog.New(slog.DiscardHandler)
+	h := NewHandler(logger, s, nil, query.NewEngine(logger, s, query.Opts{}), nil, nil)
+
+	testCases := []struct {
+		name         string
+		handler      http.HandlerFunc
+		method       string
+		params       url.Values
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "instant vector",
+			handler:      h.Query(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`requests_total{job="a"}`}, "time": {"600"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"requests_total","job":"a"},"value":[600,"40"]}]}}`,
+		},
+		{
+			name:         "aggregation",
+			handler:      h.Query(),
+			method:       http.MethodPost,
+			params:       url.Values{"query": {`sum(rate(requests_total[5m]))`}, "time": {"600"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{},"value":[600,"0.13333333333333333"]}]}}`,
+		},
+		{
+			name:         "scalar",
+			handler:      h.Query(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`1 + 1`}, "time": {"600"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{"resultType":"scalar","result":[600,"2"]}}`,
+		},
+		{
+			name:         "empty",
+			handler:      h.Query(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`missing`}, "time": {"600"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		},
+		{
+			name:         "range",
+			handler:      h.QueryRange(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`requests_total{job="b"}`}, "start": {"0"}, "end": {"60"}, "step": {"30s"}},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"requests_total","job":"b"},"values":[[0,"0"],[30,"2"],[60,"4"]]}]}}`,
+		},
+		{
+			name:         "bad query",
+			handler:      h.Query(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`sum(`}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "bad step",
+			handler:      h.QueryRange(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`up`}, "start": {"0"}, "end": {"60"}, "step": {"0"}},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "too many points",
+			handler:      h.QueryRange(),
+			method:       http.MethodGet,
+			params:       url.Values{"query": {`up`}, "start": {"0"}, "end": {"100000"}, "step": {"1"}},
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "/", strings.NewReader(tc.params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(tc.method, "/?"+tc.params.Encode(), nil)
+			}
+
+			rec := httptest.NewRecorder()
+			tc.handler(rec, req)
+
+			require.Equal(t, tc.expectedCode, rec.Code, rec.Body.String())
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+
+				return
+			}
+
+			var resp apiResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, "error", resp.Status)
+			assert.Equal(t, errorBadData, resp.ErrorType)
+		})
+	}
+}
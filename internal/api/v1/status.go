@@ -0,0 +1,156 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// defaultStatsLimit is the default number of entries in the top lists of the
+// TSDB status, the same as in Prometheus.
+const defaultStatsLimit = 10
+
+// buildInfo follows the build information of the Prometheus HTTP API.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Branch    string `json:"branch"`
+	BuildUser string `json:"buildUser"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// readBuildInfo returns the build information embedded in the binary by the
+// Go toolchain, the VCS details are only there for builds of a checkout.
+var readBuildInfo = sync.OnceValue(func() buildInfo {
+	info := buildInfo{Version: "unknown"}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.GoVersion = bi.GoVersion
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.BuildDate = s.Value
+		}
+	}
+
+	return info
+})
+
+// tsdbStatus follows the TSDB status of the Prometheus HTTP API.
+type tsdbStatus struct {
+	HeadStats                   headStats `json:"headStats"`
+	SeriesCountByMetricName     []stat    `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []stat    `json:"labelValueCountByLabelName"`
+	MemoryInBytesByLabelName    []stat    `json:"memoryInBytesByLabelName"`
+	SeriesCountByLabelValuePair []stat    `json:"seriesCountByLabelValuePair"`
+	MemoryInBytesByMetricName   []stat    `json:"memoryInBytesByMetricName"`
+}
+
+type headStats struct {
+	NumSeries  int   `json:"numSeries"`
+	ChunkCount int   `json:"chunkCount"`
+	MinTime    int64 `json:"minTime"`
+	MaxTime    int64 `json:"maxTime"`
+}
+
+type stat struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// BuildInfo responds with the build information, following the Prometheus
+// HTTP API.
+func (h *handler) BuildInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, http.StatusOK, apiResponse{
+			Status: "success",
+			Data:   readBuildInfo(),
+		})
+	}
+}
+
+// TSDBStatus responds with the stats of the in-memory head, following the
+// Prometheus HTTP API. The limit parameter caps the top lists, an optional
+// match[] selector narrows the stats down to the series it selects.
+func (h *handler) TSDBStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultStatsLimit
+		if v := r.FormValue("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"limit\": %q", v))
+
+				return
+			}
+		}
+
+		var matchers []domain.LabelMatcher
+		switch selectors := r.Form["match[]"]; len(selectors) {
+		case 0:
+		case 1:
+			parsed, err := parser.ParseMetricSelector(selectors[0])
+			if err != nil {
+				h.respondError(w, errorBadData, fmt.Errorf("invalid parameter \"match[]\": %w", err))
+
+				return
+			}
+			matchers = query.ToDomainMatchers(parsed)
+		default:
+			h.respondError(w, errorBadData, errors.New("only a single match[] parameter is supported"))
+
+			return
+		}
+
+		stats, err := h.storage.HeadStats(limit, matchers)
+		if err != nil {
+			h.respondError(w, errorBadData, err)
+
+			return
+		}
+
+		h.respond(w, http.StatusOK, apiResponse{
+			Status: "success",
+			Data: tsdbStatus{
+				HeadStats: headStats{
+					NumSeries:  stats.NumSeries,
+					ChunkCount: stats.NumChunks,
+					MinTime:    stats.MinTimeMs,
+					MaxTime:    stats.MaxTimeMs,
+				},
+				SeriesCountByMetricName:     toStats(stats.Cardinality.SeriesCountByMetricName),
+				LabelValueCountByLabelName:  toStats(stats.Cardinality.LabelValueCountByLabelName),
+				MemoryInBytesByLabelName:    toStats(stats.Cardinality.MemoryInBytesByLabelName),
+				SeriesCountByLabelValuePair: toStats(stats.Cardinality.SeriesCountByLabelValuePair),
+				MemoryInBytesByMetricName:   toStats(stats.Cardinality.MemoryInBytesByMetricName),
+			},
+		})
+	}
+}
+
+// toStats converts stats for the response, never returning nil.
+func toStats(stats []domain.Stat) []stat {
+	result := make([]stat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, stat{Name: s.Name, Value: s.Value})
+	}
+
+	return result
+}
@@ -0,0 +1,137 @@
+package v1
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_TSDBStatus(t *testing.T) {
+	s := storage.NewInMemory(storage.Opts{})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}, []domain.Sample{{Timestamp: 100_000, Value: 1}})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "db"},
+	}, []domain.Sample{{Timestamp: 200_000, Value: 1}})
+
+	h := NewHandler(slog.New(slog.DiscardHandler), s, nil, nil, nil, nil)
+
+	testCases := []struct {
+		name         string
+		query        string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "default limit",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{
+				"headStats":{"numSeries":2,"chunkCount":2,"minTime":100000,"maxTime":200000},
+				"seriesCountByMetricName":[{"name":"up","value":2}],
+				"labelValueCountByLabelName":[{"name":"job","value":2},{"name":"__name__","value":1}],
+				"memoryInBytesByLabelName":[{"name":"job","value":5},{"name":"__name__","value":4}],
+				"seriesCountByLabelValuePair":[
+					{"name":"__name__=up","value":2},
+					{"name":"job=api","value":1},
+					{"name":"job=db","value":1}
+				],
+				"memoryInBytesByMetricName":[{"name":"up","value":287}]
+			}}`,
+		},
+		{
+			name:         "limit",
+			query:        "?limit=1",
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{
+				"headStats":{"numSeries":2,"chunkCount":2,"minTime":100000,"maxTime":200000},
+				"seriesCountByMetricName":[{"name":"up","value":2}],
+				"labelValueCountByLabelName":[{"name":"job","value":2}],
+				"memoryInBytesByLabelName":[{"name":"job","value":5}],
+				"seriesCountByLabelValuePair":[{"name":"__name__=up","value":2}],
+				"memoryInBytesByMetricName":[{"name":"up","value":287}]
+			}}`,
+		},
+		{
+			name:         "match",
+			query:        `?match[]={job="db"}`,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{
+				"headStats":{"numSeries":1,"chunkCount":1,"minTime":200000,"maxTime":200000},
+				"seriesCountByMetricName":[{"name":"up","value":1}],
+				"labelValueCountByLabelName":[{"name":"__name__","value":1},{"name":"job","value":1}],
+				"memoryInBytesByLabelName":[{"name":"__name__","value":2},{"name":"job","value":2}],
+				"seriesCountByLabelValuePair":[{"name":"__name__=up","value":1},{"name":"job=db","value":1}],
+				"memoryInBytesByMetricName":[{"name":"up","value":143}]
+			}}`,
+		},
+		{
+			name:         "no matching series",
+			query:        `?match[]=down`,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"status":"success","data":{
+				"headStats":{"numSeries":0,"chunkCount":0,"minTime":0,"maxTime":0},
+				"seriesCountByMetricName":[],
+				"labelValueCountByLabelName":[],
+				"memoryInBytesByLabelName":[],
+				"seriesCountByLabelValuePair":[],
+				"memoryInBytesByMetricName":[]
+			}}`,
+		},
+		{
+			name:         "invalid match",
+			query:        `?match[]={job=}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "several matches",
+			query:        `?match[]=up&match[]=down`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status":"error","errorType":"bad_data","error":"only a single match[] parameter is supported"}`,
+		},
+		{
+			name:         "invalid limit",
+			query:        "?limit=0",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"status":"error","errorType":"bad_data","error":"invalid parameter \"limit\": \"0\""}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.TSDBStatus()(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status/tsdb"+tc.query, nil))
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedBody != "" {
+				assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_BuildInfo(t *testing.T) {
+	h := NewHandler(slog.New(slog.DiscardHandler), storage.NewInMemory(storage.Opts{}), nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	h.BuildInfo()(rec, httptest.NewRequest(http.MethodGet, "/api/v1/status/buildinfo", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response struct {
+		Status string    `json:"status"`
+		Data   buildInfo `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "success", response.Status)
+	assert.NotEmpty(t, response.Data.Version)
+	assert.NotEmpty(t, response.Data.GoVersion)
+}
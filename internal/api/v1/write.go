@@ -0,0 +1,200 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// writeProto is the protobuf message of a remote write request.
+type writeProto string
+
+const (
+	writeProtoV1 writeProto = "prometheus.WriteRequest"
+	writeProtoV2 writeProto = "io.prometheus.write.v2.Request"
+)
+
+const (
+	writtenSamplesHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	writtenHistogramsHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	writtenExemplarsHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// parseWriteProto negotiates the remote write version from the content type,
+// e.g. "application/x-protobuf;proto=io.prometheus.write.v2.Request".
+// Requests without the proto parameter or the content type are remote write 1.0.
+func parseWriteProto(contentType string) (writeProto, error) {
+	if contentType == "" {
+		return writeProtoV1, nil
+	}
+
+	mediaType, params, _ := strings.Cut(contentType, ";")
+	if strings.TrimSpace(mediaType) != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %q, expected application/x-protobuf", contentType)
+	}
+
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name != "proto" {
+			continue
+		}
+
+		switch proto := writeProto(value); proto {
+		case writeProtoV1, writeProtoV2:
+			return proto, nil
+		}
+
+		return "", fmt.Errorf("unsupported protobuf message %q, expected one of: %s, %s",
+			value, writeProtoV1, writeProtoV2)
+	}
+
+	return writeProtoV1, nil
+}
+
+// writeStats counts what's been written from a remote write request.
+type writeStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+
+	// Native histograms and exemplars can't be stored, they are dropped
+	droppedHistograms int
+	droppedExemplars  int
+}
+
+// unsupported reports the dropped native histograms and exemplars.
+func (s writeStats) unsupported() error {
+	if s.droppedHistograms == 0 && s.droppedExemplars == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("dropped %d histogram samples and %d exemplars: native histograms and exemplars are not supported",
+		s.droppedHistograms, s.droppedExemplars)
+}
+
+func (s writeStats) setHeaders(w http.ResponseWriter) {
+	w.Header().Set(writtenSamplesHeader, strconv.Itoa(s.samples))
+	w.Header().Set(writtenHistogramsHeader, strconv.Itoa(s.histograms))
+	w.Header().Set(writtenExemplarsHeader, strconv.Itoa(s.exemplars))
+}
+
+// parseWriteRequestV1 parses a remote write 1.0 request.
+func parseWriteRequestV1(data []byte) ([]domain.TimeSeries, writeStats, error) {
+	var stats writeStats
+
+	// Unmarshal the request
+	var request prompb.WriteRequest
+	if err := proto.Unmarshal(data, &request); err != nil {
+		return nil, stats, fmt.Errorf("cannot unmarshal protobuf: %w", err)
+	}
+
+	// Parse time series
+	timeSeries := make([]domain.TimeSeries, 0, len(request.Timeseries))
+	for _, ts := range request.Timeseries {
+		stats.droppedHistograms += len(ts.Histograms)
+		stats.droppedExemplars += len(ts.Exemplars)
+
+		labels := make([]domain.Label, len(ts.Labels))
+		for i, label := range ts.Labels {
+			labels[i] = domain.Label{
+				Name:  string(label.Name),
+				Value: string(label.Value),
+			}
+		}
+
+		samples := make([]domain.Sample, len(ts.Samples))
+		for i, sample := range ts.Samples {
+			samples[i] = domain.Sample{
+				Timestamp: sample.Timestamp,
+				Value:     sample.Value,
+			}
+		}
+
+		if len(labels) == 0 || len(samples) == 0 {
+			continue
+		}
+
+		timeSeries = append(timeSeries, domain.TimeSeries{
+			Labels:  labels,
+			Samples: samples,
+		})
+		stats.samples += len(samples)
+	}
+
+	return timeSeries, stats, nil
+}
+
+// parseWriteRequestV2 parses a remote write 2.0 request. Labels reference
+// strings of the request symbol table instead of copying them, and labels and
+// samples of all the series share a single allocation each. Only float
+// samples are stored: native histograms and exemplars are counted as
+// dropped, metadata and created timestamps are ignored.
+func parseWriteRequestV2(data []byte) ([]domain.TimeSeries, writeStats, error) {
+	var stats writeStats
+
+	// Unmarshal the request
+	var request writev2.Request
+	if err := proto.Unmarshal(data, &request); err != nil {
+		return nil, stats, fmt.Errorf("cannot unmarshal protobuf: %w", err)
+	}
+
+	var totalLabels, totalSamples int
+	for _, ts := range request.Timeseries {
+		totalLabels += len(ts.LabelsRefs) / 2
+		totalSamples += len(ts.Samples)
+	}
+
+	labels := make([]domain.Label, 0, totalLabels)
+	samples := make([]domain.Sample, 0, totalSamples)
+	timeSeries := make([]domain.TimeSeries, 0, len(request.Timeseries))
+
+	symbols := request.Symbols
+	for _, ts := range request.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 {
+			return nil, stats, fmt.Errorf("odd number of label references: %d", len(ts.LabelsRefs))
+		}
+
+		stats.droppedHistograms += len(ts.Histograms)
+		stats.droppedExemplars += len(ts.Exemplars)
+
+		if len(ts.LabelsRefs) == 0 || len(ts.Samples) == 0 {
+			continue
+		}
+
+		labelsStart := len(labels)
+		for i := 0; i < len(ts.LabelsRefs); i += 2 {
+			nameRef, valueRef := ts.LabelsRefs[i], ts.LabelsRefs[i+1]
+			if int(nameRef) >= len(symbols) || int(valueRef) >= len(symbols) {
+				return nil, stats, fmt.Errorf("label reference out of the symbols table of size %d", len(symbols))
+			}
+
+			labels = append(labels, domain.Label{
+				Name:  symbols[nameRef],
+				Value: symbols[valueRef],
+			})
+		}
+
+		samplesStart := len(samples)
+		for _, sample := range ts.Samples {
+			samples = append(samples, domain.Sample{
+				Timestamp: sample.Timestamp,
+				Value:     sample.Value,
+			})
+		}
+
+		timeSeries = append(timeSeries, domain.TimeSeries{
+			// Cap the slices so appending to one series can't overwrite the next one
+			Labels:  labels[labelsStart:len(labels):len(labels)],
+			Samples: samples[samplesStart:len(samples):len(samples)],
+		})
+		stats.samples += len(ts.Samples)
+	}
+
+	return timeSeries, stats, nil
+}
@@ -0,0 +1,225 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+)
+
+// Block directory layout, the same as in Prometheus TSDB:
+//
+//	<ulid>/
+//	  meta.json
+//	  index
+//	  chunks/000001
+//	  tombstones
+const (
+	metaFilename  = "meta.json"
+	indexFilename = "index"
+	chunksDirname = "chunks"
+
+	// metaVersion is the only meta.json version Prometheus supports.
+	metaVersion = 1
+
+	// tmpSuffix marks a block that is still being written.
+	tmpSuffix = ".tmp-for-creation"
+)
+
+// Meta describes a block, it's stored in meta.json.
+type Meta struct {
+	ULID ulid.ULID `json:"ulid"`
+	// MinTime and MaxTime are the time range of the block in milliseconds,
+	// MaxTime is exclusive like in Prometheus.
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+
+	Stats      Stats      `json:"stats,omitempty"`
+	Compaction Compaction `json:"compaction"`
+	Version    int        `json:"version"`
+}
+
+// Stats are the block statistics.
+type Stats struct {
+	NumSamples    uint64 `json:"numSamples,omitempty"`
+	NumSeries     uint64 `json:"numSeries,omitempty"`
+	NumChunks     uint64 `json:"numChunks,omitempty"`
+	NumTombstones uint64 `json:"numTombstones,omitempty"`
+}
+
+// Compaction describes how the block was created.
+type Compaction struct {
+	// Level is 1 for blocks cut from the head and grows with every
+	// compaction.
+	Level int `json:"level"`
+	// Sources are the level 1 blocks the block is made of.
+	Sources []ulid.ULID `json:"sources,omitempty"`
+	// Parents are the blocks the block was compacted from.
+	Parents []BlockDesc `json:"parents,omitempty"`
+}
+
+// BlockDesc identifies a block and its time range.
+type BlockDesc struct {
+	ULID    ulid.ULID `json:"ulid"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+}
+
+// Block is an immutable block on disk opened for reading. Only its
+// tombstones can change.
+type Block struct {
+	log *slog.Logger
+	dir string
+
+	index  *index.Reader
+	chunks *chunks.Reader
+
+	mu         sync.RWMutex
+	meta       Meta
+	tombstones *tombstones.MemTombstones
+}
+
+// Open opens the block in the given directory.
+func Open(log *slog.Logger, dir string) (*Block, error) {
+	meta, err := readMeta(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta: %w", err)
+	}
+
+	ir, err := index.NewFileReader(filepath.Join(dir, indexFilename), index.DecodePostingsRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, chunksDirname), nil)
+	if err != nil {
+		ir.Close()
+
+		return nil, fmt.Errorf("failed to open chunks: %w", err)
+	}
+
+	tr, _, err := tombstones.ReadTombstones(dir)
+	if err != nil {
+		ir.Close()
+		cr.Close()
+
+		return nil, fmt.Errorf("failed to read tombstones: %w", err)
+	}
+
+	// Copy tombstones over to be able to add new ones
+	stones := tombstones.NewMemTombstones()
+	_ = tr.Iter(func(ref storage.SeriesRef, intervals tombstones.Intervals) error {
+		stones.AddInterval(ref, intervals...)
+
+		return nil
+	})
+
+	return &Block{
+		log:        log,
+		dir:        dir,
+		index:      ir,
+		chunks:     cr,
+		meta:       meta,
+		tombstones: stones,
+	}, nil
+}
+
+// Meta returns the block meta.
+func (b *Block) Meta() Meta {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.meta
+}
+
+// Dir returns the block directory.
+func (b *Block) Dir() string {
+	return b.dir
+}
+
+// Overlaps reports whether the block may hold samples within the time
+// range (inclusive).
+func (b *Block) Overlaps(fromMs, toMs int64) bool {
+	meta := b.Meta()
+
+	return meta.MinTime <= toMs && meta.MaxTime > fromMs
+}
+
+// Close releases the block files.
+func (b *Block) Close() error {
+	return errors.Join(b.index.Close(), b.chunks.Close())
+}
+
+// IsBlockDir reports whether the directory entry looks like a complete block.
+func IsBlockDir(name string) bool {
+	_, err := ulid.ParseStrict(name)
+
+	return err == nil
+}
+
+// IsTmpDir reports whether the directory entry is a block left over from
+// an interrupted write.
+func IsTmpDir(name string) bool {
+	return filepath.Ext(name) == tmpSuffix
+}
+
+func readMeta(dir string) (Meta, error) {
+	var meta Meta
+
+	data, err := os.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return meta, err
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, err
+	}
+	if meta.Version != metaVersion {
+		return meta, fmt.Errorf("unexpected meta version %d", meta.Version)
+	}
+
+	return meta, nil
+}
+
+// writeMeta atomically writes meta.json to the directory.
+func writeMeta(dir string, meta Meta) error {
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, metaFilename)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return fileutil.Replace(tmp, path)
+}
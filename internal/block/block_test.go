@@ -0,0 +1,297 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSeries(t *testing.T, labels []domain.Label, samples []domain.Sample) domain.ChunkedSeries {
+	t.Helper()
+
+	series := domain.ChunkedSeries{Labels: labels}
+	for i := 0; i < len(samples); i += chunk.MaxSamples {
+		c, err := chunk.FromSamples(samples[i:min(i+chunk.MaxSamples, len(samples))])
+		require.NoError(t, err)
+
+		series.Chunks = append(series.Chunks, domain.Chunk{
+			MinTimeMs: c.MinTime(),
+			MaxTimeMs: c.MaxTime(),
+			Data:      c.Bytes(),
+		})
+	}
+
+	return series
+}
+
+func readAll(t *testing.T, b *Block, fromMs, toMs int64, matchers ...domain.LabelMatcher) []domain.TimeSeries {
+	t.Helper()
+
+	compiled, err := domain.NewMatchers(matchers)
+	require.NoError(t, err)
+
+	var result []domain.TimeSeries
+	require.NoError(t, b.ReadChunks(fromMs, toMs, compiled, func(cs domain.ChunkedSeries) error {
+		ts := domain.TimeSeries{Labels: cs.Labels}
+		for _, c := range cs.Chunks {
+			decoded, err := chunk.FromBytes(c.Data)
+			require.NoError(t, err)
+			samples, err := decoded.Samples()
+			require.NoError(t, err)
+			ts.Samples = append(ts.Samples, samples...)
+		}
+		result = append(result, ts)
+
+		return nil
+	}))
+
+	return result
+}
+
+func TestBlock_WriteRead(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	samples := make([]domain.Sample, 0, 3*chunk.MaxSamples)
+	for i := 0; i < 3*chunk.MaxSamples; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	api := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	// Labels are not sorted by name on purpose
+	db := []domain.Label{{Name: "job", Value: "db"}, {Name: "__name__", Value: "up"}}
+	other := []domain.Label{{Name: "__name__", Value: "requests_total"}, {Name: "path", Value: "/"}}
+
+	meta, err := Write(log, dir, 0, 1000, []domain.ChunkedSeries{
+		testSeries(t, db, samples[:10]),
+		testSeries(t, api, samples),
+		testSeries(t, other, samples[:1]),
+		{Labels: []domain.Label{{Name: "__name__", Value: "empty"}}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, Stats{
+		NumSamples: uint64(len(samples) + 11),
+		NumSeries:  3,
+		NumChunks:  5,
+	}, meta.Stats)
+
+	// The block is complete on disk
+	blockDir := filepath.Join(dir, meta.ULID.String())
+	for _, name := range []string{"meta.json", "index", "chunks/000001", "tombstones"} {
+		assert.FileExists(t, filepath.Join(blockDir, name))
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, IsBlockDir(entries[0].Name()))
+
+	data, err := os.ReadFile(filepath.Join(blockDir, "meta.json"))
+	require.NoError(t, err)
+
+	var raw map[string]any
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, meta.ULID.String(), raw["ulid"])
+	assert.EqualValues(t, 0, raw["minTime"])
+	assert.EqualValues(t, 1000, raw["maxTime"])
+	assert.EqualValues(t, 1, raw["version"])
+
+	b, err := Open(log, blockDir)
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.Equal(t, meta, b.Meta())
+
+	sortedDB := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+
+	testCases := []struct {
+		name     string
+		from, to int64
+		matchers []domain.LabelMatcher
+		expected []domain.TimeSeries
+	}{
+		{
+			name:     "equal matcher",
+			from:     math.MinInt64,
+			to:       math.MaxInt64,
+			matchers: []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+			expected: []domain.TimeSeries{
+				{Labels: api, Samples: samples},
+				{Labels: sortedDB, Samples: samples[:10]},
+			},
+		},
+		{
+			name: "time range across chunks",
+			from: 5,
+			to:   chunk.MaxSamples + 5,
+			matchers: []domain.LabelMatcher{
+				{Type: domain.RE, Name: "job", Value: "api|db"},
+			},
+			expected: []domain.TimeSeries{
+				{Labels: api, Samples: samples[5 : chunk.MaxSamples+6]},
+				{Labels: sortedDB, Samples: samples[5:10]},
+			},
+		},
+		{
+			name: "matchers accepting missing labels",
+			from: math.MinInt64,
+			to:   math.MaxInt64,
+			matchers: []domain.LabelMatcher{
+				{Type: domain.NEQ, Name: "job", Value: "api"},
+			},
+			expected: []domain.TimeSeries{
+				{Labels: other, Samples: samples[:1]},
+				{Labels: sortedDB, Samples: samples[:10]},
+			},
+		},
+		{
+			name:     "out of range",
+			from:     1000,
+			to:       2000,
+			matchers: []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, readAll(t, b, tc.from, tc.to, tc.matchers...))
+		})
+	}
+}
+
+func TestBlock_Delete(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	samples := make([]domain.Sample, 0, 100)
+	for i := 0; i < 100; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	api := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	db := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+
+	meta, err := Write(log, dir, 0, 100, []domain.ChunkedSeries{
+		testSeries(t, api, samples),
+		testSeries(t, db, samples),
+	})
+	require.NoError(t, err)
+
+	blockDir := filepath.Join(dir, meta.ULID.String())
+	b, err := Open(log, blockDir)
+	require.NoError(t, err)
+
+	n, err := b.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "api"}},
+		MinTimeMs: 10,
+		MaxTimeMs: 89,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = b.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		MinTimeMs: math.MinInt64,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	expected := []domain.TimeSeries{
+		{Labels: api, Samples: append(samples[:10:10], samples[90:]...)},
+	}
+	up := domain.LabelMatcher{Type: domain.EQ, Name: "__name__", Value: "up"}
+
+	assert.Equal(t, expected, readAll(t, b, math.MinInt64, math.MaxInt64, up))
+	require.NoError(t, b.Close())
+
+	// Tombstones survive reopening
+	b, err = Open(log, blockDir)
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.Equal(t, expected, readAll(t, b, math.MinInt64, math.MaxInt64, up))
+	assert.EqualValues(t, 2, b.Meta().Stats.NumTombstones)
+}
+
+// TestBlock_OpenPrometheus makes sure Prometheus reads the written blocks,
+// tombstones included.
+func TestBlock_OpenPrometheus(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	samples := make([]domain.Sample, 0, 2*chunk.MaxSamples)
+	for i := 0; i < 2*chunk.MaxSamples; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	api := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	db := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+
+	meta, err := Write(log, dir, 0, 1000, []domain.ChunkedSeries{
+		testSeries(t, db, samples[:10]),
+		testSeries(t, api, samples),
+	})
+	require.NoError(t, err)
+
+	blockDir := filepath.Join(dir, meta.ULID.String())
+
+	b, err := Open(log, blockDir)
+	require.NoError(t, err)
+	_, err = b.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		MinTimeMs: 0,
+		MaxTimeMs: 4,
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	pb, err := tsdb.OpenBlock(log, blockDir, nil, nil)
+	require.NoError(t, err)
+	defer pb.Close()
+
+	assert.Equal(t, meta.ULID, pb.Meta().ULID)
+	assert.Equal(t, meta.Stats.NumSamples, pb.Meta().Stats.NumSamples)
+
+	q, err := tsdb.NewBlockQuerier(pb, math.MinInt64, math.MaxInt64)
+	require.NoError(t, err)
+	defer q.Close()
+
+	set := q.Select(context.Background(), true, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+
+	var got []domain.TimeSeries
+	for set.Next() {
+		series := domain.TimeSeries{}
+		set.At().Labels().Range(func(l labels.Label) {
+			series.Labels = append(series.Labels, domain.Label{Name: l.Name, Value: l.Value})
+		})
+
+		it := set.At().Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			ts, v := it.At()
+			series.Samples = append(series.Samples, domain.Sample{Timestamp: ts, Value: v})
+		}
+		require.NoError(t, it.Err())
+
+		got = append(got, series)
+	}
+	require.NoError(t, set.Err())
+
+	assert.Equal(t, []domain.TimeSeries{
+		{Labels: api, Samples: samples},
+		{Labels: db, Samples: samples[5:10]},
+	}, got)
+}
@@ -0,0 +1,289 @@
+package block
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Plan picks groups of blocks to compact, every group is compacted into a
+// single block. Overlapping blocks are grouped first. Otherwise blocks are
+// grouped by windows aligned to the ranges, trying the smallest range
+// first, so the groups never share blocks. A window is only compacted once
+// it's complete, that is when the newest block reaches its end.
+func Plan(metas []Meta, ranges []int64) [][]Meta {
+	if len(metas) < 2 {
+		return nil
+	}
+
+	metas = slices.Clone(metas)
+	slices.SortFunc(metas, func(a, b Meta) int {
+		return cmp.Compare(a.MinTime, b.MinTime)
+	})
+
+	if groups := planOverlapping(metas); len(groups) > 0 {
+		return groups
+	}
+
+	var newest int64 = math.MinInt64
+	for _, m := range metas {
+		newest = max(newest, m.MaxTime)
+	}
+
+	for _, r := range ranges {
+		var (
+			groups [][]Meta
+			group  []Meta
+			start  int64
+		)
+		flush := func() {
+			if len(group) > 1 && start+r <= newest {
+				groups = append(groups, group)
+			}
+			group = nil
+		}
+
+		for _, m := range metas {
+			windowStart := RangeStart(m.MinTime, r)
+			if m.MaxTime > windowStart+r {
+				// Already larger than the window
+				flush()
+
+				continue
+			}
+
+			if windowStart != start {
+				flush()
+			}
+			group = append(group, m)
+			start = windowStart
+		}
+		flush()
+
+		if len(groups) > 0 {
+			return groups
+		}
+	}
+
+	return nil
+}
+
+// planOverlapping groups blocks with overlapping time ranges, the blocks
+// must be sorted by the min time.
+func planOverlapping(metas []Meta) [][]Meta {
+	var groups [][]Meta
+
+	group := []Meta{metas[0]}
+	maxt := metas[0].MaxTime
+	for _, m := range metas[1:] {
+		if m.MinTime < maxt {
+			group = append(group, m)
+			maxt = max(maxt, m.MaxTime)
+
+			continue
+		}
+
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = []Meta{m}
+		maxt = m.MaxTime
+	}
+	if len(group) > 1 {
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// Compact merges the blocks into a new block within parent directory that
+// covers all of their time ranges and returns its meta. Deleted samples are
+// dropped. Samples of a series with equal timestamps are deduplicated,
+// the sample of the later block in the given order wins.
+func Compact(log *slog.Logger, parent string, blocks []*Block) (Meta, error) {
+	meta := Meta{
+		ULID:    ulid.Make(),
+		MinTime: math.MaxInt64,
+		MaxTime: math.MinInt64,
+		Version: metaVersion,
+	}
+
+	for _, b := range blocks {
+		m := b.Meta()
+
+		meta.MinTime = min(meta.MinTime, m.MinTime)
+		meta.MaxTime = max(meta.MaxTime, m.MaxTime)
+		meta.Compaction.Level = max(meta.Compaction.Level, m.Compaction.Level+1)
+		meta.Compaction.Sources = append(meta.Compaction.Sources, m.Compaction.Sources...)
+		meta.Compaction.Parents = append(meta.Compaction.Parents, BlockDesc{
+			ULID:    m.ULID,
+			MinTime: m.MinTime,
+			MaxTime: m.MaxTime,
+		})
+	}
+
+	slices.SortFunc(meta.Compaction.Sources, func(a, b ulid.ULID) int {
+		return a.Compare(b)
+	})
+	meta.Compaction.Sources = slices.Compact(meta.Compaction.Sources)
+
+	symbols, err := mergeSymbols(blocks)
+	if err != nil {
+		return meta, err
+	}
+
+	return write(log, parent, meta, symbols, func(add addSeriesFunc) error {
+		return mergeSeries(blocks, add)
+	})
+}
+
+// mergeSymbols returns the sorted label names and values of all the blocks.
+// Symbols of deleted series are kept, like Prometheus does.
+func mergeSymbols(blocks []*Block) ([]string, error) {
+	var result []string
+	for _, b := range blocks {
+		symbols, err := b.symbols()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block %s: %w", b.Meta().ULID, err)
+		}
+		result = append(result, symbols...)
+	}
+	slices.Sort(result)
+
+	return slices.Compact(result), nil
+}
+
+// mergeSeries calls add for every series of the blocks in labels order,
+// with chunks of the same series merged. It's a k-way merge over the sorted
+// postings of the blocks, so only the current series of every block is
+// held in memory.
+func mergeSeries(blocks []*Block, add addSeriesFunc) error {
+	matchers, err := domain.NewMatchers(domain.AllSeries)
+	if err != nil {
+		return err
+	}
+
+	// Iterators with series left, in the blocks order
+	var heads []*seriesIterator
+	for _, b := range blocks {
+		it, err := b.iterate(math.MinInt64, math.MaxInt64, matchers)
+		if err != nil {
+			return fmt.Errorf("failed to read block %s: %w", b.Meta().ULID, err)
+		}
+
+		if it.Next() {
+			heads = append(heads, it)
+		} else if err := it.Err(); err != nil {
+			return fmt.Errorf("failed to read block %s: %w", b.Meta().ULID, err)
+		}
+	}
+
+	for len(heads) > 0 {
+		lset := heads[0].labels
+		for _, it := range heads[1:] {
+			if labels.Compare(it.labels, lset) < 0 {
+				lset = it.labels
+			}
+		}
+
+		// Blocks are merged in order, so samples of later blocks win
+		var merged []domain.Chunk
+		for _, it := range heads {
+			if labels.Compare(it.labels, lset) != 0 {
+				continue
+			}
+
+			visible, err := it.b.visibleChunks(it.ref, it.metas, math.MinInt64, math.MaxInt64)
+			if err != nil {
+				return fmt.Errorf("failed to read block %s: %w", it.b.Meta().ULID, err)
+			}
+
+			switch {
+			case len(visible) == 0:
+			case len(merged) == 0:
+				merged = visible
+			default:
+				if merged, err = mergeChunks(merged, visible); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(merged) > 0 {
+			if err := add(lset, merged); err != nil {
+				return err
+			}
+		}
+
+		// Move the merged iterators to their next series
+		left := heads[:0]
+		for _, it := range heads {
+			if labels.Compare(it.labels, lset) == 0 && !it.Next() {
+				if err := it.Err(); err != nil {
+					return fmt.Errorf("failed to read block %s: %w", it.b.Meta().ULID, err)
+				}
+
+				continue
+			}
+			left = append(left, it)
+		}
+		heads = left
+	}
+
+	return nil
+}
+
+// mergeChunks merges chunks of a series, samples of b win on equal
+// timestamps. Chunks are only re-encoded if they overlap.
+func mergeChunks(a, b []domain.Chunk) ([]domain.Chunk, error) {
+	if a[len(a)-1].MaxTimeMs < b[0].MinTimeMs {
+		return append(a, b...), nil
+	}
+
+	as, err := chunk.Decode(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := chunk.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make([]domain.Sample, 0, len(as)+len(bs))
+	for len(as) > 0 && len(bs) > 0 {
+		switch {
+		case as[0].Timestamp < bs[0].Timestamp:
+			merged = append(merged, as[0])
+			as = as[1:]
+		case as[0].Timestamp > bs[0].Timestamp:
+			merged = append(merged, bs[0])
+			bs = bs[1:]
+		default:
+			merged = append(merged, bs[0])
+			as, bs = as[1:], bs[1:]
+		}
+	}
+	merged = append(merged, as...)
+	merged = append(merged, bs...)
+
+	return chunk.Encode(merged)
+}
+
+// RangeStart returns the start of the range aligned window that holds the
+// timestamp, rounding towards negative infinity.
+func RangeStart(tsMs, rangeMs int64) int64 {
+	q := tsMs / rangeMs
+	if tsMs%rangeMs < 0 {
+		q--
+	}
+
+	return q * rangeMs
+}
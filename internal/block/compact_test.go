@@ -0,0 +1,190 @@
+package block
+
+import (
+	"log/slog"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	meta := func(id uint64, mint, maxt int64) Meta {
+		return Meta{ULID: ulid.ULID{15: byte(id)}, MinTime: mint, MaxTime: maxt}
+	}
+	ranges := []int64{30, 120}
+
+	testCases := []struct {
+		name     string
+		metas    []Meta
+		expected [][]Meta
+	}{
+		{
+			name:  "single block",
+			metas: []Meta{meta(1, 0, 10)},
+		},
+		{
+			name:  "window is not complete",
+			metas: []Meta{meta(1, 0, 10), meta(2, 10, 20)},
+		},
+		{
+			name: "complete windows",
+			metas: []Meta{
+				meta(4, 30, 40), meta(5, 40, 50), meta(6, 50, 60),
+				meta(1, 0, 10), meta(2, 10, 20), meta(3, 20, 30),
+				meta(7, 60, 70),
+			},
+			expected: [][]Meta{
+				{meta(1, 0, 10), meta(2, 10, 20), meta(3, 20, 30)},
+				{meta(4, 30, 40), meta(5, 40, 50), meta(6, 50, 60)},
+			},
+		},
+		{
+			name:     "window with gaps",
+			metas:    []Meta{meta(1, 0, 10), meta(2, 20, 30), meta(3, 30, 40)},
+			expected: [][]Meta{{meta(1, 0, 10), meta(2, 20, 30)}},
+		},
+		{
+			name: "larger range once smaller ones are compacted",
+			metas: []Meta{
+				meta(1, 0, 30), meta(2, 30, 60), meta(3, 60, 90), meta(4, 90, 120),
+				meta(5, 120, 130),
+			},
+			expected: [][]Meta{
+				{meta(1, 0, 30), meta(2, 30, 60), meta(3, 60, 90), meta(4, 90, 120)},
+			},
+		},
+		{
+			name: "overlapping blocks first",
+			metas: []Meta{
+				meta(1, 0, 10), meta(2, 10, 20), meta(3, 20, 30),
+				meta(4, 40, 50), meta(5, 45, 60), meta(6, 55, 70),
+			},
+			expected: [][]Meta{{meta(4, 40, 50), meta(5, 45, 60), meta(6, 55, 70)}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Plan(tc.metas, ranges))
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	samples := make([]domain.Sample, 0, 300)
+	for i := 0; i < 300; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+	overwritten := make([]domain.Sample, 0, 50)
+	for _, s := range samples[150:200] {
+		overwritten = append(overwritten, domain.Sample{Timestamp: s.Timestamp, Value: -s.Value})
+	}
+
+	api := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	db := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+	noName := []domain.Label{{Name: "job", Value: "db"}}
+
+	open := func(meta Meta, err error) *Block {
+		t.Helper()
+		require.NoError(t, err)
+
+		b, err := Open(log, filepath.Join(dir, meta.ULID.String()))
+		require.NoError(t, err)
+		t.Cleanup(func() { b.Close() })
+
+		return b
+	}
+
+	first := open(Write(log, dir, 0, 100, []domain.ChunkedSeries{
+		testSeries(t, api, samples[:100]),
+		testSeries(t, db, samples[:100]),
+		testSeries(t, noName, samples[:1]),
+	}))
+	second := open(Write(log, dir, 100, 200, []domain.ChunkedSeries{
+		testSeries(t, api, samples[100:200]),
+	}))
+	// Overlaps with the second block and overwrites some of its samples
+	third := open(Write(log, dir, 150, 300, []domain.ChunkedSeries{
+		testSeries(t, api, append(overwritten, samples[200:]...)),
+	}))
+
+	_, err := first.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		MinTimeMs: 50,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+
+	compacted := open(Compact(log, dir, []*Block{first, second, third}))
+
+	meta := compacted.Meta()
+	assert.Equal(t, int64(0), meta.MinTime)
+	assert.Equal(t, int64(300), meta.MaxTime)
+	assert.Equal(t, 2, meta.Compaction.Level)
+	assert.Len(t, meta.Compaction.Sources, 3)
+	assert.Equal(t, []BlockDesc{
+		{ULID: first.Meta().ULID, MinTime: 0, MaxTime: 100},
+		{ULID: second.Meta().ULID, MinTime: 100, MaxTime: 200},
+		{ULID: third.Meta().ULID, MinTime: 150, MaxTime: 300},
+	}, meta.Compaction.Parents)
+	assert.Equal(t, Stats{NumSamples: 351, NumSeries: 3, NumChunks: 5}, meta.Stats)
+
+	expectedAPI := append(append(samples[:150:150], overwritten...), samples[200:]...)
+	assert.Equal(t, []domain.TimeSeries{
+		{Labels: api, Samples: expectedAPI},
+		{Labels: db, Samples: samples[:50]},
+		{Labels: noName, Samples: samples[:1]},
+	}, readAll(t, compacted, math.MinInt64, math.MaxInt64, domain.LabelMatcher{Type: domain.RE, Name: "job", Value: ".+"}))
+}
+
+func TestCompact_InterleavedSeries(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	series := func(job string) []domain.Label {
+		return []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}}
+	}
+	sample := func(ts int64) []domain.Sample {
+		return []domain.Sample{{Timestamp: ts, Value: float64(ts)}}
+	}
+
+	var blocks []*Block
+	for i, jobs := range [][]string{{"a", "c"}, {"b", "c", "e"}, {"a", "d"}} {
+		var written []domain.ChunkedSeries
+		for _, job := range jobs {
+			written = append(written, testSeries(t, series(job), sample(int64(i))))
+		}
+
+		meta, err := Write(log, dir, int64(i), int64(i+1), written)
+		require.NoError(t, err)
+
+		b, err := Open(log, filepath.Join(dir, meta.ULID.String()))
+		require.NoError(t, err)
+		t.Cleanup(func() { b.Close() })
+		blocks = append(blocks, b)
+	}
+
+	meta, err := Compact(log, dir, blocks)
+	require.NoError(t, err)
+
+	compacted, err := Open(log, filepath.Join(dir, meta.ULID.String()))
+	require.NoError(t, err)
+	defer compacted.Close()
+
+	assert.Equal(t, Stats{NumSamples: 7, NumSeries: 5, NumChunks: 7}, meta.Stats)
+	assert.Equal(t, []domain.TimeSeries{
+		{Labels: series("a"), Samples: append(sample(0), sample(2)...)},
+		{Labels: series("b"), Samples: sample(1)},
+		{Labels: series("c"), Samples: append(sample(0), sample(1)...)},
+		{Labels: series("d"), Samples: sample(2)},
+		{Labels: series("e"), Samples: sample(1)},
+	}, readAll(t, compacted, math.MinInt64, math.MaxInt64, domain.LabelMatcher{Type: domain.EQ, Name: "__name__", Value: "up"}))
+}
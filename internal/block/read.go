@@ -0,0 +1,342 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+)
+
+// ReadChunks calls fn for every series that matches the matchers, sorted by
+// labels, with its chunks within the time range (inclusive). Chunks sticking
+// out of the range or holding deleted samples are re-encoded with only the
+// visible samples. It stops on the first error returned by fn.
+func (b *Block) ReadChunks(fromMs, toMs int64, matchers []*domain.Matcher, fn func(domain.ChunkedSeries) error) error {
+	return b.selectSeries(fromMs, toMs, matchers, func(ref storage.SeriesRef, lset []domain.Label, metas []chunks.Meta) error {
+		visible, err := b.visibleChunks(ref, metas, fromMs, toMs)
+		if err != nil || len(visible) == 0 {
+			return err
+		}
+
+		return fn(domain.ChunkedSeries{Labels: lset, Chunks: visible})
+	})
+}
+
+// visibleChunks loads the chunks of the series with only their samples
+// within the time range (inclusive) that are not deleted.
+func (b *Block) visibleChunks(ref storage.SeriesRef, metas []chunks.Meta, fromMs, toMs int64) ([]domain.Chunk, error) {
+	deleted, err := b.deleted(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []domain.Chunk
+	for _, m := range metas {
+		c, err := b.chunk(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.MinTime < fromMs || m.MaxTime > toMs || overlapsDeleted(m, deleted) {
+			samples, err := c.Samples()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode chunk: %w", err)
+			}
+
+			samples = slices.DeleteFunc(samples, func(s domain.Sample) bool {
+				return s.Timestamp < fromMs || s.Timestamp > toMs || isDeleted(s.Timestamp, deleted)
+			})
+			if len(samples) == 0 {
+				continue
+			}
+
+			c, _ = chunk.FromSamples(samples)
+		}
+
+		result = append(result, domain.Chunk{
+			MinTimeMs: c.MinTime(),
+			MaxTimeMs: c.MaxTime(),
+			Data:      c.Bytes(),
+		})
+	}
+
+	return result, nil
+}
+
+// Series returns label sets of the series that match the matchers and have
+// samples within the time range (inclusive), sorted by labels.
+func (b *Block) Series(fromMs, toMs int64, matchers []*domain.Matcher) ([][]domain.Label, error) {
+	var result [][]domain.Label
+
+	err := b.ReadChunks(fromMs, toMs, matchers, func(cs domain.ChunkedSeries) error {
+		result = append(result, cs.Labels)
+
+		return nil
+	})
+
+	return result, err
+}
+
+// Delete marks samples of the series selected by the tombstone within its
+// time range as deleted and persists the tombstones. It returns the number
+// of affected series.
+func (b *Block) Delete(tombstone domain.Tombstone) (int, error) {
+	matchers, err := domain.NewMatchers(tombstone.Matchers)
+	if err != nil {
+		return 0, err
+	}
+
+	meta := b.Meta()
+	interval := tombstones.Interval{
+		Mint: max(tombstone.MinTimeMs, meta.MinTime),
+		Maxt: min(tombstone.MaxTimeMs, meta.MaxTime-1),
+	}
+	if interval.Mint > interval.Maxt {
+		return 0, nil
+	}
+
+	var refs []storage.SeriesRef
+	err = b.selectSeries(interval.Mint, interval.Maxt, matchers, func(ref storage.SeriesRef, _ []domain.Label, _ []chunks.Meta) error {
+		refs = append(refs, ref)
+
+		return nil
+	})
+	if err != nil || len(refs) == 0 {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ref := range refs {
+		b.tombstones.AddInterval(ref, interval)
+	}
+
+	if _, err := tombstones.WriteFile(b.log, b.dir, b.tombstones); err != nil {
+		return 0, fmt.Errorf("failed to write tombstones: %w", err)
+	}
+
+	b.meta.Stats.NumTombstones = b.tombstones.Total()
+	if err := writeMeta(b.dir, b.meta); err != nil {
+		return 0, fmt.Errorf("failed to write meta: %w", err)
+	}
+
+	return len(refs), nil
+}
+
+// selectSeries calls fn for every series that matches the matchers and has
+// chunks overlapping with the time range (inclusive), in labels order.
+// No matchers select nothing.
+func (b *Block) selectSeries(
+	fromMs,
+	toMs int64,
+	matchers []*domain.Matcher,
+	fn func(storage.SeriesRef, []domain.Label, []chunks.Meta) error) error {
+	it, err := b.iterate(fromMs, toMs, matchers)
+	if err != nil {
+		return err
+	}
+
+	for it.Next() {
+		var lset []domain.Label
+		it.labels.Range(func(l labels.Label) {
+			lset = append(lset, domain.Label{Name: l.Name, Value: l.Value})
+		})
+
+		if err := fn(it.ref, lset, it.metas); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// seriesIterator iterates over the series of a block in labels order, the
+// order of the postings.
+type seriesIterator struct {
+	b            *Block
+	p            index.Postings
+	fromMs, toMs int64
+
+	builder labels.ScratchBuilder
+	ref     storage.SeriesRef
+	labels  labels.Labels
+	metas   []chunks.Meta // reused between the series
+	err     error
+}
+
+// iterate returns an iterator over the series that match the matchers and
+// have chunks overlapping with the time range (inclusive). No matchers
+// select nothing.
+func (b *Block) iterate(fromMs, toMs int64, matchers []*domain.Matcher) (*seriesIterator, error) {
+	it := &seriesIterator{b: b, p: index.EmptyPostings(), fromMs: fromMs, toMs: toMs}
+	if len(matchers) == 0 || !b.Overlaps(fromMs, toMs) {
+		return it, nil
+	}
+
+	p, err := b.postingsForMatchers(context.Background(), matchers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select postings: %w", err)
+	}
+	it.p = p
+
+	return it, nil
+}
+
+// Next moves to the next series, it returns false once there are no more
+// series or on an error.
+func (it *seriesIterator) Next() bool {
+	for it.err == nil && it.p.Next() {
+		it.ref = it.p.At()
+		if err := it.b.index.Series(it.ref, &it.builder, &it.metas); err != nil {
+			it.err = fmt.Errorf("failed to read series: %w", err)
+
+			return false
+		}
+
+		it.metas = slices.DeleteFunc(it.metas, func(m chunks.Meta) bool {
+			return !m.OverlapsClosedInterval(it.fromMs, it.toMs)
+		})
+		if len(it.metas) == 0 {
+			continue
+		}
+
+		it.labels = it.builder.Labels()
+
+		return true
+	}
+
+	return false
+}
+
+func (it *seriesIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.p.Err()
+}
+
+// postingsForMatchers returns postings of the series that match all the
+// matchers, with the same semantics as the in-memory index.
+func (b *Block) postingsForMatchers(ctx context.Context, matchers []*domain.Matcher) (index.Postings, error) {
+	var included, excluded []index.Postings
+
+	for _, m := range matchers {
+		if m.Matches("") {
+			// Series without the label match too, remove the rejected ones
+			p, err := b.postingsForMatcher(ctx, m.Inverse())
+			if err != nil {
+				return nil, err
+			}
+			excluded = append(excluded, p)
+
+			continue
+		}
+
+		p, err := b.postingsForMatcher(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, p)
+	}
+
+	if len(included) == 0 {
+		name, value := index.AllPostingsKey()
+		all, err := b.index.Postings(ctx, name, value)
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, all)
+	}
+
+	return index.Without(index.Intersect(included...), index.Merge(ctx, excluded...)), nil
+}
+
+// postingsForMatcher returns postings of the series that have the label of
+// the matcher with a value it accepts.
+func (b *Block) postingsForMatcher(ctx context.Context, m *domain.Matcher) (index.Postings, error) {
+	values, err := b.index.SortedLabelValues(ctx, m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	values = slices.DeleteFunc(values, func(v string) bool {
+		return !m.Matches(v)
+	})
+	if len(values) == 0 {
+		return index.EmptyPostings(), nil
+	}
+
+	return b.index.Postings(ctx, m.Name, values...)
+}
+
+// symbols returns the sorted label names and values of the block index.
+func (b *Block) symbols() ([]string, error) {
+	var result []string
+
+	it := b.index.Symbols()
+	for it.Next() {
+		result = append(result, it.At())
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read symbols: %w", err)
+	}
+
+	return result, nil
+}
+
+// chunk loads a chunk from the chunks files.
+func (b *Block) chunk(m chunks.Meta) (*chunk.XOR, error) {
+	chk, _, err := b.chunks.ChunkOrIterable(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if chk.Encoding() != chunkenc.EncXOR {
+		return nil, fmt.Errorf("unsupported chunk encoding %s", chk.Encoding())
+	}
+
+	// Chunk files are memory mapped, copy the data so it outlives the block
+	c, err := chunk.FromBytes(slices.Clone(chk.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunk: %w", err)
+	}
+
+	return c, nil
+}
+
+// deleted returns deleted intervals of the series.
+func (b *Block) deleted(ref storage.SeriesRef) (tombstones.Intervals, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.tombstones.Get(ref)
+}
+
+func overlapsDeleted(m chunks.Meta, deleted tombstones.Intervals) bool {
+	for _, d := range deleted {
+		if d.Mint <= m.MaxTime && d.Maxt >= m.MinTime {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDeleted(t int64, deleted tombstones.Intervals) bool {
+	for _, d := range deleted {
+		if d.InBounds(t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,194 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+)
+
+// Write persists the series as a new block within parent directory and
+// returns its meta. All the chunks must be within [mint, maxt), maxt is
+// exclusive like in Prometheus. The block is written to a temporary
+// directory first and renamed once it's complete.
+func Write(log *slog.Logger, parent string, mint, maxt int64, series []domain.ChunkedSeries) (Meta, error) {
+	id := ulid.Make()
+	meta := Meta{
+		ULID:    id,
+		MinTime: mint,
+		MaxTime: maxt,
+		Compaction: Compaction{
+			Level:   1,
+			Sources: []ulid.ULID{id},
+		},
+		Version: metaVersion,
+	}
+
+	// The index requires series sorted by labels
+	sorted := make([]indexSeries, 0, len(series))
+	symbols := make(map[string]struct{})
+	for _, s := range series {
+		if len(s.Chunks) == 0 {
+			continue
+		}
+
+		b := labels.NewScratchBuilder(len(s.Labels))
+		for _, l := range s.Labels {
+			b.Add(l.Name, l.Value)
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+		b.Sort()
+
+		sorted = append(sorted, indexSeries{labels: b.Labels(), chunks: s.Chunks})
+	}
+	slices.SortFunc(sorted, func(a, b indexSeries) int {
+		return labels.Compare(a.labels, b.labels)
+	})
+
+	sortedSymbols := make([]string, 0, len(symbols))
+	for s := range symbols {
+		sortedSymbols = append(sortedSymbols, s)
+	}
+	slices.Sort(sortedSymbols)
+
+	return write(log, parent, meta, sortedSymbols, func(add addSeriesFunc) error {
+		for _, s := range sorted {
+			if err := add(s.labels, s.chunks); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// addSeriesFunc adds a series with its chunks to the block being written.
+type addSeriesFunc func(lset labels.Labels, chunks []domain.Chunk) error
+
+// write persists the block described by meta, its stats are filled in.
+// Symbols are the sorted label names and values of all the series, series
+// calls add for every series in labels order.
+func write(
+	log *slog.Logger,
+	parent string,
+	meta Meta,
+	symbols []string,
+	series func(add addSeriesFunc) error) (Meta, error) {
+	dir := filepath.Join(parent, meta.ULID.String())
+	tmp := dir + tmpSuffix
+
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return meta, fmt.Errorf("failed to create block directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := writeData(tmp, symbols, series, &meta.Stats); err != nil {
+		return meta, err
+	}
+
+	if _, err := tombstones.WriteFile(log, tmp, tombstones.NewMemTombstones()); err != nil {
+		return meta, fmt.Errorf("failed to write tombstones: %w", err)
+	}
+
+	if err := writeMeta(tmp, meta); err != nil {
+		return meta, fmt.Errorf("failed to write meta: %w", err)
+	}
+
+	if err := fileutil.Replace(tmp, dir); err != nil {
+		return meta, fmt.Errorf("failed to rename block directory: %w", err)
+	}
+
+	return meta, nil
+}
+
+// indexSeries is a series prepared to be added to the index.
+type indexSeries struct {
+	labels labels.Labels
+	chunks []domain.Chunk
+}
+
+// writeData writes chunks and the index of the series.
+func writeData(dir string, symbols []string, series func(add addSeriesFunc) error, stats *Stats) error {
+	cw, err := chunks.NewWriter(filepath.Join(dir, chunksDirname))
+	if err != nil {
+		return fmt.Errorf("failed to create chunks writer: %w", err)
+	}
+
+	iw, err := index.NewWriter(context.Background(), filepath.Join(dir, indexFilename))
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to create index writer: %w", err), cw.Close())
+	}
+
+	if err := writeSeries(cw, iw, symbols, series, stats); err != nil {
+		// The directory is removed anyway, only release the files
+		return errors.Join(err, cw.Close(), iw.Close())
+	}
+
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("failed to close chunks writer: %w", err)
+	}
+	if err := iw.Close(); err != nil {
+		return fmt.Errorf("failed to close index writer: %w", err)
+	}
+
+	return nil
+}
+
+func writeSeries(
+	cw *chunks.Writer,
+	iw *index.Writer,
+	symbols []string,
+	series func(add addSeriesFunc) error,
+	stats *Stats) error {
+	for _, s := range symbols {
+		if err := iw.AddSymbol(s); err != nil {
+			return fmt.Errorf("failed to add symbol: %w", err)
+		}
+	}
+
+	var ref storage.SeriesRef
+
+	return series(func(lset labels.Labels, chks []domain.Chunk) error {
+		metas := make([]chunks.Meta, 0, len(chks))
+		for _, c := range chks {
+			chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+			if err != nil {
+				return fmt.Errorf("failed to load chunk: %w", err)
+			}
+
+			metas = append(metas, chunks.Meta{
+				Chunk:   chk,
+				MinTime: c.MinTimeMs,
+				MaxTime: c.MaxTimeMs,
+			})
+			stats.NumSamples += uint64(chk.NumSamples())
+		}
+
+		if err := cw.WriteChunks(metas...); err != nil {
+			return fmt.Errorf("failed to write chunks: %w", err)
+		}
+		if err := iw.AddSeries(ref, lset, metas...); err != nil {
+			return fmt.Errorf("failed to add series: %w", err)
+		}
+		ref++
+
+		stats.NumSeries++
+		stats.NumChunks += uint64(len(metas))
+
+		return nil
+	})
+}
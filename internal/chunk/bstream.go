@@ -0,0 +1,206 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The code in this file was largely written by Damian Gryski as part of
+// https://github.com/dgryski/go-tsz and published under the license below.
+// It received minor modifications to suit Prometheus's needs.
+//
+// Derived from github.com/prometheus/prometheus/tsdb/chunkenc/bstream.go.
+// It was adapted to the needs of mini-tsdb.
+
+// Copyright (c) 2015,2016 Damian Gryski <damian@gryski.com>
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package chunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// bstream is a stream of bits that is appended to from the most
+// significant bit of each byte.
+type bstream struct {
+	stream []byte // the data stream
+	count  uint8  // how many right-most bits are available for writing in the current byte
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	// Fill up the remaining bits of the current byte and
+	// carry the rest over to the next one
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, 0)
+	b.stream[i+1] = byt << b.count
+}
+
+// writeBits writes the nbits right-most bits of u to the stream
+// in left-to-right order.
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+func (b *bstream) writeVarint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	for _, byt := range buf[:binary.PutVarint(buf[:], v)] {
+		b.writeByte(byt)
+	}
+}
+
+func (b *bstream) writeUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	for _, byt := range buf[:binary.PutUvarint(buf[:], v)] {
+		b.writeByte(byt)
+	}
+}
+
+// bstreamReader reads bits from a byte slice written by bstream.
+type bstreamReader struct {
+	stream []byte
+	pos    int   // index of the current byte
+	count  uint8 // how many right-most bits are left to read in the current byte
+}
+
+func newBReader(b []byte) bstreamReader {
+	return bstreamReader{
+		stream: b,
+		count:  8,
+	}
+}
+
+func (r *bstreamReader) readBit() (bool, error) {
+	if r.pos >= len(r.stream) {
+		return false, io.EOF
+	}
+
+	bit := (r.stream[r.pos]>>(r.count-1))&1 == 1
+	r.count--
+	if r.count == 0 {
+		r.pos++
+		r.count = 8
+	}
+
+	return bit, nil
+}
+
+func (r *bstreamReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for i := 0; i < nbits; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+
+	return u, nil
+}
+
+// ReadByte implements io.ByteReader so varints can be decoded from the stream.
+func (r *bstreamReader) ReadByte() (byte, error) {
+	if r.count == 8 {
+		// Byte aligned, fast path
+		if r.pos >= len(r.stream) {
+			return 0, io.EOF
+		}
+		byt := r.stream[r.pos]
+		r.pos++
+
+		return byt, nil
+	}
+
+	v, err := r.readBits(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return byte(v), nil
+}
+
+var errInvalidVarint = errors.New("invalid varint")
+
+func (r *bstreamReader) readVarint() (int64, error) {
+	v, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, errInvalidVarint
+	}
+
+	return v, nil
+}
+
+func (r *bstreamReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, errInvalidVarint
+	}
+
+	return v, nil
+}
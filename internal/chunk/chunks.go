@@ -0,0 +1,45 @@
+package chunk
+
+import (
+	"fmt"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// Decode decodes samples of the chunks.
+func Decode(chunks []domain.Chunk) ([]domain.Sample, error) {
+	var result []domain.Sample
+	for _, c := range chunks {
+		decoded, err := FromBytes(c.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chunk: %w", err)
+		}
+
+		samples, err := decoded.Samples()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode chunk: %w", err)
+		}
+		result = append(result, samples...)
+	}
+
+	return result, nil
+}
+
+// Encode encodes sorted samples into full chunks.
+func Encode(samples []domain.Sample) ([]domain.Chunk, error) {
+	var result []domain.Chunk
+	for i := 0; i < len(samples); i += MaxSamples {
+		c, err := FromSamples(samples[i:min(i+MaxSamples, len(samples))])
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode chunk: %w", err)
+		}
+
+		result = append(result, domain.Chunk{
+			MinTimeMs: c.MinTime(),
+			MaxTimeMs: c.MaxTime(),
+			Data:      c.Bytes(),
+		})
+	}
+
+	return result, nil
+}
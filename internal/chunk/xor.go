@@ -0,0 +1,461 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The code in this file was largely written by Damian Gryski as part of
+// https://github.com/dgryski/go-tsz and published under the license below.
+// It was modified to accommodate reading from byte slices without modifying
+// the underlying bytes, which would panic when reading from mmapped
+// read-only byte slices.
+//
+// Derived from github.com/prometheus/prometheus/tsdb/chunkenc/xor.go.
+// It was adapted to the sample types of mini-tsdb.
+
+// Copyright (c) 2015,2016 Damian Gryski <damian@gryski.com>
+// All rights reserved.
+
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+
+// * Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package chunk implements compressed storage of samples.
+//
+// The encoding follows the Gorilla paper (http://www.vldb.org/pvldb/vol8/p1816-teller.pdf):
+// timestamps are stored as delta-of-deltas and values are XOR'ed with the
+// previous one. The layout is byte-compatible with Prometheus' XOR chunks so
+// the data can be handed over to Prometheus as is.
+package chunk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// MaxSamples is the number of samples after which a chunk is considered full.
+const MaxSamples = 120
+
+// headerSize is the size of the chunk header that holds the number of samples.
+const headerSize = 2
+
+// ErrFull is returned when appending to a chunk that can't hold more samples.
+var ErrFull = errors.New("chunk is full")
+
+// XOR is a chunk of samples encoded with delta-of-delta timestamps
+// and XOR'ed values.
+type XOR struct {
+	b bstream
+
+	minT, maxT int64
+
+	// Appender state
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+}
+
+// NewXOR returns an empty chunk.
+func NewXOR() *XOR {
+	b := make([]byte, headerSize, 128)
+
+	return &XOR{
+		b:       bstream{stream: b},
+		leading: 0xff,
+	}
+}
+
+// FromSamples encodes the given samples into a new chunk.
+func FromSamples(samples []domain.Sample) (*XOR, error) {
+	c := NewXOR()
+	for _, s := range samples {
+		if err := c.Append(s.Timestamp, s.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// FromBytes loads a chunk from its encoded form. The returned chunk is read-only.
+func FromBytes(b []byte) (*XOR, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("chunk is too short: %d bytes", len(b))
+	}
+
+	c := &XOR{b: bstream{stream: b}}
+
+	// Walk the samples to restore the time range
+	it := c.Iterator()
+	for i := 0; it.Next(); i++ {
+		if i == 0 {
+			c.minT = it.At().Timestamp
+		}
+		c.maxT = it.At().Timestamp
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NumSamples returns the number of samples in the chunk.
+func (c *XOR) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.b.bytes()))
+}
+
+// NumSamples returns the number of samples in an encoded chunk without
+// decoding it, 0 if it's too short to hold the header.
+func NumSamples(b []byte) int {
+	if len(b) < headerSize {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// MinTime returns the timestamp of the first sample.
+func (c *XOR) MinTime() int64 {
+	return c.minT
+}
+
+// MaxTime returns the timestamp of the last sample.
+func (c *XOR) MaxTime() int64 {
+	return c.maxT
+}
+
+// Bytes returns the encoded chunk data.
+func (c *XOR) Bytes() []byte {
+	return c.b.bytes()
+}
+
+// Size returns the number of bytes the chunk data occupies.
+func (c *XOR) Size() int {
+	return cap(c.b.stream)
+}
+
+// Seal trims unused capacity once no more samples are going to be appended.
+func (c *XOR) Seal() {
+	if cap(c.b.stream) > len(c.b.stream) {
+		c.b.stream = append([]byte(nil), c.b.stream...)
+	}
+}
+
+// Append adds a sample to the end of the chunk.
+func (c *XOR) Append(t int64, v float64) error {
+	num := c.NumSamples()
+	if num >= MaxSamples {
+		return ErrFull
+	}
+
+	switch num {
+	case 0:
+		c.b.writeVarint(t)
+		c.b.writeBits(math.Float64bits(v), 64)
+
+		c.minT = t
+	case 1:
+		tDelta := uint64(t - c.t)
+		c.b.writeUvarint(tDelta)
+		c.writeValue(v)
+
+		c.tDelta = tDelta
+	default:
+		tDelta := uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+
+		// Gorilla has a max resolution of seconds, Prometheus milliseconds.
+		// Thus we use higher value range steps with larger bit size.
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0b10, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0b110, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0b1110, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0b1111, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeValue(v)
+
+		c.tDelta = tDelta
+	}
+
+	c.t = t
+	c.v = v
+	c.maxT = t
+	binary.BigEndian.PutUint16(c.b.bytes(), uint16(num+1))
+
+	return nil
+}
+
+func (c *XOR) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.b.writeBit(false)
+
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+
+	// Clamp number of leading zeros to avoid overflow when encoding
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// Meaningful bits fit into the previous window
+		c.b.writeBit(false)
+		c.b.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+
+	// Note that if leading == trailing == 0, then sigbits == 64. But that value
+	// doesn't actually fit into the 6 bits we have. Luckily, we never need to
+	// encode 0 significant bits, since that would put us in the other case
+	// (delta == 0). So instead we write out a 0 and adjust it back to 64 on
+	// unpacking.
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(delta>>trailing, int(sigbits))
+}
+
+// bitRange reports whether the given integer can be represented by nbits.
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// Samples decodes all the samples of the chunk.
+func (c *XOR) Samples() ([]domain.Sample, error) {
+	samples := make([]domain.Sample, 0, c.NumSamples())
+
+	it := c.Iterator()
+	for it.Next() {
+		samples = append(samples, it.At())
+	}
+
+	return samples, it.Err()
+}
+
+// Iterator returns an iterator over the samples of the chunk.
+func (c *XOR) Iterator() *Iterator {
+	return &Iterator{
+		br:       newBReader(c.b.bytes()[headerSize:]),
+		numTotal: binary.BigEndian.Uint16(c.b.bytes()),
+	}
+}
+
+// Iterator iterates over the samples of a chunk in the order they were appended.
+type Iterator struct {
+	br       bstreamReader
+	numTotal uint16
+	numRead  uint16
+
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+
+	err error
+}
+
+// At returns the current sample.
+func (it *Iterator) At() domain.Sample {
+	return domain.Sample{
+		Timestamp: it.t,
+		Value:     it.v,
+	}
+}
+
+// Err returns the decoding error if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Next advances the iterator and reports whether there's a sample to read.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+
+	switch it.numRead {
+	case 0:
+		t, err := it.br.readVarint()
+		if err != nil {
+			return it.fail(err)
+		}
+		v, err := it.br.readBits(64)
+		if err != nil {
+			return it.fail(err)
+		}
+
+		it.t = t
+		it.v = math.Float64frombits(v)
+	case 1:
+		tDelta, err := it.br.readUvarint()
+		if err != nil {
+			return it.fail(err)
+		}
+
+		it.tDelta = tDelta
+		it.t += int64(tDelta)
+		if err := it.readValue(); err != nil {
+			return it.fail(err)
+		}
+	default:
+		// Read the delta-of-delta prefix: up to four 1 bits
+		var d byte
+		for i := 0; i < 4; i++ {
+			d <<= 1
+			bit, err := it.br.readBit()
+			if err != nil {
+				return it.fail(err)
+			}
+			if !bit {
+				break
+			}
+			d |= 1
+		}
+
+		var sz uint8
+		var dod int64
+		switch d {
+		case 0b0:
+			// dod == 0
+		case 0b10:
+			sz = 14
+		case 0b110:
+			sz = 17
+		case 0b1110:
+			sz = 20
+		case 0b1111:
+			// Do not use fast because it's very unlikely it will succeed
+			bits, err := it.br.readBits(64)
+			if err != nil {
+				return it.fail(err)
+			}
+			dod = int64(bits)
+		}
+
+		if sz != 0 {
+			bits, err := it.br.readBits(int(sz))
+			if err != nil {
+				return it.fail(err)
+			}
+
+			// Account for negative numbers, which come back as high unsigned numbers
+			if bits > (1 << (sz - 1)) {
+				bits -= 1 << sz
+			}
+			dod = int64(bits)
+		}
+
+		it.tDelta = uint64(int64(it.tDelta) + dod)
+		it.t += int64(it.tDelta)
+		if err := it.readValue(); err != nil {
+			return it.fail(err)
+		}
+	}
+
+	it.numRead++
+
+	return true
+}
+
+func (it *Iterator) readValue() error {
+	bit, err := it.br.readBit()
+	if err != nil {
+		return err
+	}
+	if !bit {
+		// Same value as the previous one
+		return nil
+	}
+
+	bit, err = it.br.readBit()
+	if err != nil {
+		return err
+	}
+	if bit {
+		// New leading and trailing zeros window
+		leading, err := it.br.readBits(5)
+		if err != nil {
+			return err
+		}
+		sigbits, err := it.br.readBits(6)
+		if err != nil {
+			return err
+		}
+
+		// 0 significant bits here means we overflowed and we actually need 64
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		it.leading = uint8(leading)
+		it.trailing = 64 - it.leading - uint8(sigbits)
+	}
+
+	sigbits := 64 - int(it.leading) - int(it.trailing)
+	delta, err := it.br.readBits(sigbits)
+	if err != nil {
+		return err
+	}
+
+	it.v = math.Float64frombits(math.Float64bits(it.v) ^ (delta << it.trailing))
+
+	return nil
+}
+
+func (it *Iterator) fail(err error) bool {
+	it.err = fmt.Errorf("corrupted chunk: %w", err)
+
+	return false
+}
@@ -0,0 +1,156 @@
+package chunk
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXOR_AppendIterate(t *testing.T) {
+	tableTest := []struct {
+		msg     string
+		samples []domain.Sample
+	}{
+		{
+			msg:     "empty",
+			samples: []domain.Sample{},
+		},
+		{
+			msg: "single sample",
+			samples: []domain.Sample{
+				{Timestamp: 1000, Value: 1},
+			},
+		},
+		{
+			msg: "regular interval",
+			samples: []domain.Sample{
+				{Timestamp: 1000, Value: 1},
+				{Timestamp: 2000, Value: 2},
+				{Timestamp: 3000, Value: 2},
+				{Timestamp: 4000, Value: 3.5},
+			},
+		},
+		{
+			msg: "irregular interval and special values",
+			samples: []domain.Sample{
+				{Timestamp: -5, Value: math.Inf(1)},
+				{Timestamp: 0, Value: math.Inf(-1)},
+				{Timestamp: 7_000, Value: 0},
+				{Timestamp: 7_001, Value: -123.456},
+				{Timestamp: 1_000_000_000, Value: math.MaxFloat64},
+				{Timestamp: 1_000_000_001, Value: math.SmallestNonzeroFloat64},
+				{Timestamp: 1_000_100_001, Value: 42},
+			},
+		},
+	}
+
+	for _, test := range tableTest {
+		t.Run(test.msg, func(t *testing.T) {
+			c, err := FromSamples(test.samples)
+			require.NoError(t, err)
+
+			assert.Equal(t, len(test.samples), c.NumSamples())
+			assert.Equal(t, len(test.samples), NumSamples(c.Bytes()))
+			got, err := c.Samples()
+			assert.NoError(t, err)
+			assert.Equal(t, test.samples, got)
+
+			if len(test.samples) > 0 {
+				assert.Equal(t, test.samples[0].Timestamp, c.MinTime())
+				assert.Equal(t, test.samples[len(test.samples)-1].Timestamp, c.MaxTime())
+			}
+		})
+	}
+}
+
+func TestXOR_Full(t *testing.T) {
+	c := NewXOR()
+	for i := 0; i < MaxSamples; i++ {
+		assert.NoError(t, c.Append(int64(i), float64(i)))
+	}
+
+	assert.ErrorIs(t, c.Append(MaxSamples, 0), ErrFull)
+}
+
+// TestXOR_PrometheusCompatibility makes sure chunks can be read by Prometheus
+// and the other way around.
+func TestXOR_PrometheusCompatibility(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	samples := make([]domain.Sample, 0, MaxSamples)
+	ts := int64(1_700_000_000_000)
+	v := 100.0
+	for i := 0; i < MaxSamples; i++ {
+		ts += 15_000 + r.Int63n(2_000) - 1_000
+		if r.Intn(3) == 0 {
+			v += r.NormFloat64() * 10
+		}
+		samples = append(samples, domain.Sample{Timestamp: ts, Value: v})
+	}
+
+	c, err := FromSamples(samples)
+	require.NoError(t, err)
+
+	promChunk := chunkenc.NewXORChunk()
+	app, err := promChunk.Appender()
+	require.NoError(t, err)
+	for _, s := range samples {
+		app.Append(s.Timestamp, s.Value)
+	}
+
+	// Encoded data is identical
+	assert.Equal(t, promChunk.Bytes(), c.Bytes())
+
+	// Prometheus decodes our chunk
+	promDecoded, err := chunkenc.FromData(chunkenc.EncXOR, c.Bytes())
+	require.NoError(t, err)
+
+	it := promDecoded.Iterator(nil)
+	got := make([]domain.Sample, 0, len(samples))
+	for it.Next() == chunkenc.ValFloat {
+		t, v := it.At()
+		got = append(got, domain.Sample{Timestamp: t, Value: v})
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, samples, got)
+
+	// We decode a Prometheus chunk
+	fromProm, err := FromBytes(promChunk.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, samples[0].Timestamp, fromProm.MinTime())
+	assert.Equal(t, samples[len(samples)-1].Timestamp, fromProm.MaxTime())
+
+	decoded, err := fromProm.Samples()
+	assert.NoError(t, err)
+	assert.Equal(t, samples, decoded)
+}
+
+func BenchmarkXOR_Append(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c := NewXOR()
+		for j := 0; j < MaxSamples; j++ {
+			_ = c.Append(int64(j*15_000), float64(j))
+		}
+	}
+}
+
+func BenchmarkXOR_Iterate(b *testing.B) {
+	c := NewXOR()
+	for j := 0; j < MaxSamples; j++ {
+		_ = c.Append(int64(j*15_000), float64(j))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := c.Iterator()
+		for it.Next() {
+		}
+	}
+}
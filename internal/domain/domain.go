@@ -1,12 +1,40 @@
 package domain
 
-import "github.com/prometheus/prometheus/prompb"
+import (
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
 
 type Label struct {
 	Name  string
 	Value string
 }
 
+// LabelsKey builds a key that identifies a set of labels regardless of
+// their order.
+func LabelsKey(labels []Label) string {
+	if !slices.IsSortedFunc(labels, compareLabelNames) {
+		labels = slices.Clone(labels)
+		slices.SortFunc(labels, compareLabelNames)
+	}
+
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0xff)
+	}
+
+	return sb.String()
+}
+
+func compareLabelNames(a, b Label) int {
+	return strings.Compare(a.Name, b.Name)
+}
+
 type Sample struct {
 	Value     float64
 	Timestamp int64
@@ -41,11 +69,52 @@ func (ts TimeSeries) ToProto() *prompb.TimeSeries {
 	}
 }
 
+// Chunk is a Gorilla XOR encoded chunk of samples, byte-compatible with
+// Prometheus XOR chunks.
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Data      []byte
+}
+
+// ChunkedSeries holds samples of a single series in encoded chunks.
+type ChunkedSeries struct {
+	Labels []Label
+	Chunks []Chunk // asc sorted by time
+}
+
+// ReadHints describe how the caller is going to use the data it reads, so
+// storage can return less of it. Mirrors prompb.ReadHints.
+type ReadHints struct {
+	StartMs  int64    // start of the data the caller needs
+	EndMs    int64    // end of the data the caller needs
+	StepMs   int64    // query step, 0 for instant queries
+	Func     string   // function or aggregation applied to the selector
+	RangeMs  int64    // range of the selector, 0 for instant selectors
+	Grouping []string // labels of the parent aggregation
+	By       bool     // whether Grouping is "by" or "without"
+}
+
+// Clip narrows the time range down to the one the caller needs.
+func (h ReadHints) Clip(fromMs, toMs int64) (int64, int64) {
+	if h.StartMs > fromMs {
+		fromMs = h.StartMs
+	}
+	if h.EndMs != 0 && h.EndMs < toMs {
+		toMs = h.EndMs
+	}
+
+	return fromMs, toMs
+}
+
 type LabelMatcherType int32
 
+// Label matcher types, numerically equal to prompb.LabelMatcher_Type values.
 const (
 	EQ  = 0
 	NEQ = 1
+	RE  = 2
+	NRE = 3
 )
 
 type LabelMatcher struct {
@@ -53,3 +122,48 @@ type LabelMatcher struct {
 	Name  string
 	Value string
 }
+
+// Tombstone marks samples of the series selected by the matchers within
+// the time range (inclusive) as deleted.
+type Tombstone struct {
+	Matchers  []LabelMatcher
+	MinTimeMs int64
+	MaxTimeMs int64
+}
+
+// HeadStats describes the in-memory head, following the Prometheus TSDB
+// status.
+type HeadStats struct {
+	NumSeries int
+	NumChunks int
+	// MinTimeMs and MaxTimeMs are the time range of the head samples, both
+	// are zero if the head is empty.
+	MinTimeMs   int64
+	MaxTimeMs   int64
+	Cardinality Cardinality
+}
+
+// Cardinality holds top lists of the head series, every one sorted by value
+// in descending order.
+type Cardinality struct {
+	// SeriesCountByMetricName holds the metric names with the most series.
+	SeriesCountByMetricName []Stat
+	// LabelValueCountByLabelName holds the label names with the most
+	// distinct values.
+	LabelValueCountByLabelName []Stat
+	// SeriesCountByLabelValuePair holds the name=value label pairs with the
+	// most series.
+	SeriesCountByLabelValuePair []Stat
+	// MemoryInBytesByLabelName estimates the memory taken by values of the
+	// label names, the length of a value times the number of its series.
+	MemoryInBytesByLabelName []Stat
+	// MemoryInBytesByMetricName estimates the memory taken by series of the
+	// metric names, their labels and chunks.
+	MemoryInBytesByMetricName []Stat
+}
+
+// Stat is a named value of the head stats.
+type Stat struct {
+	Name  string
+	Value int
+}
@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AllSeries selects every series, all of them have a metric name.
+var AllSeries = []LabelMatcher{{Type: RE, Name: "__name__", Value: ".*"}}
+
+// Matcher is a compiled form of LabelMatcher that can be evaluated
+// against label values.
+type Matcher struct {
+	LabelMatcher
+
+	re *regexp.Regexp
+	// setMatches is a list of values the regexp matches when it's a plain
+	// alternation of literals (e.g. "a|b|c"), so they can be looked up directly.
+	setMatches []string
+}
+
+// NewMatcher compiles the given label matcher. Regular expressions are
+// fully anchored the same way Prometheus does it.
+func NewMatcher(m LabelMatcher) (*Matcher, error) {
+	matcher := &Matcher{LabelMatcher: m}
+
+	switch m.Type {
+	case EQ, NEQ:
+	case RE, NRE:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q for label %q: %w", m.Value, m.Name, err)
+		}
+		matcher.re = re
+		matcher.setMatches = findSetMatches(m.Value)
+	default:
+		return nil, fmt.Errorf("unknown matcher type %d for label %q", m.Type, m.Name)
+	}
+
+	return matcher, nil
+}
+
+// NewMatchers compiles a list of label matchers.
+func NewMatchers(ms []LabelMatcher) ([]*Matcher, error) {
+	result := make([]*Matcher, 0, len(ms))
+	for _, m := range ms {
+		compiled, err := NewMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, compiled)
+	}
+
+	return result, nil
+}
+
+// Matches reports whether the matcher accepts the given label value.
+// A missing label is treated as an empty value.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case EQ:
+		return v == m.Value
+	case NEQ:
+		return v != m.Value
+	case RE:
+		return m.re.MatchString(v)
+	case NRE:
+		return !m.re.MatchString(v)
+	}
+
+	return false
+}
+
+// MatchLabels reports whether all the matchers accept the given labels.
+func MatchLabels(matchers []*Matcher, labels []Label) bool {
+	for _, m := range matchers {
+		var value string
+		for _, l := range labels {
+			if l.Name == m.Name {
+				value = l.Value
+
+				break
+			}
+		}
+
+		if !m.Matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Inverse returns a matcher that accepts exactly the values this one rejects.
+func (m *Matcher) Inverse() *Matcher {
+	inverse := *m
+	switch m.Type {
+	case EQ:
+		inverse.Type = NEQ
+	case NEQ:
+		inverse.Type = EQ
+	case RE:
+		inverse.Type = NRE
+	case NRE:
+		inverse.Type = RE
+	}
+
+	return &inverse
+}
+
+// SetMatches returns the finite list of values a positive regexp matcher
+// accepts, or nil if there's no such list.
+func (m *Matcher) SetMatches() []string {
+	if m.Type != RE {
+		return nil
+	}
+
+	return m.setMatches
+}
+
+// findSetMatches returns the alternatives of a regexp that consists only of
+// literals separated by "|", e.g. "foo|bar|baz".
+func findSetMatches(pattern string) []string {
+	if pattern == "" {
+		return nil
+	}
+
+	alternatives := strings.Split(pattern, "|")
+	for _, a := range alternatives {
+		if regexp.QuoteMeta(a) != a {
+			// Contains metacharacters, can't be resolved as a set
+			return nil
+		}
+	}
+
+	return alternatives
+}
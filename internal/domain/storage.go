@@ -1,7 +1,80 @@
 package domain
 
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTooManySeries is returned when writing series would exceed a limit
+	// on the number of series.
+	ErrTooManySeries = errors.New("too many series")
+
+	// ErrInvalidSeries is returned for series exceeding a limit on their
+	// labels, they are never accepted.
+	ErrInvalidSeries = errors.New("invalid series")
+)
+
+// DuplicatePolicy defines which sample is kept when a series receives
+// several samples with the same timestamp.
+type DuplicatePolicy string
+
+const (
+	// LastWriteWins overwrites the stored sample with the new one.
+	LastWriteWins DuplicatePolicy = "last"
+
+	// FirstWriteWins keeps the stored sample and drops the new one.
+	FirstWriteWins DuplicatePolicy = "first"
+)
+
+// ParseDuplicatePolicy validates a duplicate policy name.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(s); policy {
+	case LastWriteWins, FirstWriteWins:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown duplicate policy %q, expected one of: %s, %s",
+		s, LastWriteWins, FirstWriteWins)
+}
+
 type Storage interface {
 	Write(labels []Label, samples []Sample)
-	WriteMultiple(series []TimeSeries)
+	// WriteMultiple writes the series and returns the number of stored
+	// samples, out-of-order samples and duplicates may be dropped.
+	WriteMultiple(series []TimeSeries) int
+	// ApplyLimits returns the series that can be written without exceeding
+	// the cardinality limits, the rest are dropped. The error describes the
+	// first dropped series, wraps ErrTooManySeries or ErrInvalidSeries and
+	// names its metric.
+	ApplyLimits(series []TimeSeries) ([]TimeSeries, error)
 	Read(fromMs, toMs int64, labelMatchers []LabelMatcher) []TimeSeries
+	// ReadWithHints reads like Read, but may return less data according to
+	// the hints: a narrower time range, downsampled or aggregated series.
+	ReadWithHints(fromMs, toMs int64, labelMatchers []LabelMatcher, hints ReadHints) []TimeSeries
+	// ReadChunks calls fn for every matching series, sorted by labels, with
+	// its encoded chunks within the time range. It stops on the first error
+	// returned by fn.
+	ReadChunks(fromMs, toMs int64, labelMatchers []LabelMatcher, fn func(ChunkedSeries) error) error
+	// LabelNames returns sorted label names of the series that match the
+	// matchers and have samples within the time range. No matchers select
+	// every series.
+	LabelNames(fromMs, toMs int64, labelMatchers []LabelMatcher) []string
+	// LabelValues returns sorted values of the label among the series that
+	// match the matchers and have samples within the time range. No matchers
+	// select every series.
+	LabelValues(name string, fromMs, toMs int64, labelMatchers []LabelMatcher) []string
+	// Series returns label sets, sorted by name, of the series that match the
+	// matchers and have samples within the time range, sorted by labels.
+	Series(fromMs, toMs int64, labelMatchers []LabelMatcher) [][]Label
+	// Delete hides samples of the series selected by the tombstone within
+	// its time range and returns the number of affected series.
+	Delete(tombstone Tombstone) (int, error)
+	// CleanTombstones physically removes deleted samples and returns the
+	// number of series that became empty.
+	CleanTombstones() int
+	// HeadStats returns stats of the in-memory head series that match the
+	// matchers, all of them without matchers, with up to limit entries in
+	// every top list.
+	HeadStats(limit int, labelMatchers []LabelMatcher) (HeadStats, error)
 }
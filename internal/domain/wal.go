@@ -1,8 +1,10 @@
 package domain
 
+// WalEntity is a single WAL entry: either written time series or deletions.
 type WalEntity struct {
 	Timestamp  int64
 	TimeSeries []TimeSeries
+	Tombstones []Tombstone
 }
 
 type Wal interface {
@@ -0,0 +1,105 @@
+package postings
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Postings is a mutable posting list of a label value. It's kept either as
+// a sorted list or compressed into roaring bitmaps, which take a fraction
+// of the memory for long lists of dense ids at the cost of decoding them on
+// every read.
+type Postings struct {
+	list       List
+	compressed bool
+	// Roaring bitmaps hold 32-bit ids, the ids are split by their upper
+	// 32 bits into bitmaps sorted by them
+	bitmaps []highBitmap
+}
+
+type highBitmap struct {
+	high   uint32
+	bitmap *roaring.Bitmap
+}
+
+// New creates empty postings, compressed ones if compress is set.
+func New(compress bool) *Postings {
+	return &Postings{compressed: compress}
+}
+
+// Add adds the series id to the postings.
+func (p *Postings) Add(id uint64) {
+	if !p.compressed {
+		p.list = p.list.Insert(id)
+
+		return
+	}
+
+	high := uint32(id >> 32)
+	i, ok := p.search(high)
+	if !ok {
+		p.bitmaps = slices.Insert(p.bitmaps, i, highBitmap{high: high, bitmap: roaring.New()})
+	}
+	p.bitmaps[i].bitmap.Add(uint32(id))
+}
+
+// Remove removes the series id from the postings.
+func (p *Postings) Remove(id uint64) {
+	if !p.compressed {
+		p.list = p.list.Remove(id)
+
+		return
+	}
+
+	i, ok := p.search(uint32(id >> 32))
+	if !ok {
+		return
+	}
+
+	p.bitmaps[i].bitmap.Remove(uint32(id))
+	if p.bitmaps[i].bitmap.IsEmpty() {
+		p.bitmaps = slices.Delete(p.bitmaps, i, i+1)
+	}
+}
+
+// Len returns the number of series ids.
+func (p *Postings) Len() int {
+	if !p.compressed {
+		return len(p.list)
+	}
+
+	var n uint64
+	for _, b := range p.bitmaps {
+		n += b.bitmap.GetCardinality()
+	}
+
+	return int(n)
+}
+
+// List returns the sorted series ids. The list of uncompressed postings is
+// shared with them and must not be modified or used after they change.
+func (p *Postings) List() List {
+	if !p.compressed {
+		return p.list
+	}
+
+	result := make(List, 0, p.Len())
+	for _, b := range p.bitmaps {
+		it := b.bitmap.Iterator()
+		for it.HasNext() {
+			result = append(result, uint64(b.high)<<32|uint64(it.Next()))
+		}
+	}
+
+	return result
+}
+
+// search returns the position of the bitmap of the upper 32 bits of ids
+// and whether it exists.
+func (p *Postings) search(high uint32) (int, bool) {
+	return slices.BinarySearchFunc(p.bitmaps, high, func(b highBitmap, high uint32) int {
+		return cmp.Compare(b.high, high)
+	})
+}
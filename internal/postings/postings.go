@@ -0,0 +1,183 @@
+// Package postings implements posting lists, sorted lists of series ids
+// that have a label set to a value, and set operations on them.
+package postings
+
+import (
+	"slices"
+	"sort"
+)
+
+// List is a sorted list of unique series ids. Set operations never modify
+// their arguments, but the result may share memory with them.
+type List []uint64
+
+// Intersect returns ids that are in all the lists. Lists are intersected
+// from the shortest one, so the result shrinks as early as possible.
+func Intersect(lists ...List) List {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+
+	lists = slices.Clone(lists)
+	slices.SortFunc(lists, func(a, b List) int {
+		return len(a) - len(b)
+	})
+
+	result := lists[0]
+	for _, l := range lists[1:] {
+		if len(result) == 0 {
+			break
+		}
+		result = intersect(result, l)
+	}
+
+	return result
+}
+
+// intersect gallops through the longer list looking for ids of the
+// shorter one, which is much faster than a linear merge when the lengths
+// differ a lot.
+func intersect(short, long List) List {
+	if len(short) > len(long) {
+		short, long = long, short
+	}
+
+	result := make(List, 0, len(short))
+
+	var j int
+	for _, id := range short {
+		j = seek(long, j, id)
+		if j == len(long) {
+			break
+		}
+		if long[j] == id {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+// Union returns ids that are in any of the lists.
+func Union(lists ...List) List {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+
+	// Merge pairs of lists until a single one is left, so every id is
+	// copied a logarithmic number of times
+	for len(lists) > 1 {
+		merged := make([]List, 0, (len(lists)+1)/2)
+		for i := 0; i < len(lists); i += 2 {
+			if i+1 == len(lists) {
+				merged = append(merged, lists[i])
+
+				break
+			}
+			merged = append(merged, union(lists[i], lists[i+1]))
+		}
+		lists = merged
+	}
+
+	return lists[0]
+}
+
+func union(a, b List) List {
+	result := make(List, 0, len(a)+len(b))
+
+	var i, j int
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+
+	return append(result, b[j:]...)
+}
+
+// Subtract returns ids of a that are not in any of the other lists.
+func Subtract(a List, lists ...List) List {
+	for _, b := range lists {
+		if len(a) == 0 {
+			break
+		}
+		if len(b) == 0 {
+			continue
+		}
+
+		result := make(List, 0, len(a))
+
+		var j int
+		for _, id := range a {
+			j = seek(b, j, id)
+			if j == len(b) || b[j] != id {
+				result = append(result, id)
+			}
+		}
+		a = result
+	}
+
+	return a
+}
+
+// seek returns the index of the first id in l[from:] that is not less than
+// id. It probes exponentially growing steps before a binary search, so it
+// only looks at a logarithmic number of ids of the distance it advances.
+func seek(l List, from int, id uint64) int {
+	if from >= len(l) || l[from] >= id {
+		return from
+	}
+
+	// l[lo] < id is an invariant
+	lo, step := from, 1
+	for lo+step < len(l) && l[lo+step] < id {
+		lo += step
+		step *= 2
+	}
+	hi := min(lo+step, len(l))
+
+	return lo + 1 + sort.Search(hi-lo-1, func(i int) bool {
+		return l[lo+1+i] >= id
+	})
+}
+
+// Insert adds the id to the list keeping it sorted.
+func (l List) Insert(id uint64) List {
+	// Ids are usually added in increasing order
+	if len(l) == 0 || l[len(l)-1] < id {
+		return append(l, id)
+	}
+
+	i, ok := slices.BinarySearch(l, id)
+	if ok {
+		return l
+	}
+
+	return slices.Insert(l, i, id)
+}
+
+// Remove deletes the id from the list.
+func (l List) Remove(id uint64) List {
+	i, ok := slices.BinarySearch(l, id)
+	if !ok {
+		return l
+	}
+
+	return slices.Delete(l, i, i+1)
+}
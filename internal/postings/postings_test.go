@@ -0,0 +1,195 @@
+package postings
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntersect(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lists    []List
+		expected List
+	}{
+		{
+			name: "no lists",
+		},
+		{
+			name:     "empty lists",
+			lists:    []List{{}, {}},
+			expected: List{},
+		},
+		{
+			name:     "equal lists",
+			lists:    []List{{1, 2, 3}, {1, 2, 3}},
+			expected: List{1, 2, 3},
+		},
+		{
+			name:     "longer first",
+			lists:    []List{{1, 2, 3, 4}, {1, 2, 3}},
+			expected: List{1, 2, 3},
+		},
+		{
+			name:     "shorter first",
+			lists:    []List{{2, 4}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+			expected: List{2, 4},
+		},
+		{
+			name:     "no intersection",
+			lists:    []List{{5, 6, 7, 8}, {1, 2, 3}},
+			expected: List{},
+		},
+		{
+			name:     "several lists",
+			lists:    []List{{1, 3, 5, 7, 9}, {3, 4, 5, 6, 7}, {1, 5, 7}},
+			expected: List{5, 7},
+		},
+		{
+			name:     "empty list among others",
+			lists:    []List{{1, 2, 3}, {}, {1, 2}},
+			expected: List{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Intersect(tc.lists...))
+		})
+	}
+}
+
+func TestUnion(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lists    []List
+		expected List
+	}{
+		{
+			name: "no lists",
+		},
+		{
+			name:     "single list",
+			lists:    []List{{1, 2}},
+			expected: List{1, 2},
+		},
+		{
+			name:     "overlapping lists",
+			lists:    []List{{1, 3, 5}, {2, 3, 4}},
+			expected: List{1, 2, 3, 4, 5},
+		},
+		{
+			name:     "odd number of lists",
+			lists:    []List{{1, 10}, {}, {5}, {1, 5, 7}, {2}},
+			expected: List{1, 2, 5, 7, 10},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Union(tc.lists...))
+		})
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	testCases := []struct {
+		name     string
+		list     List
+		lists    []List
+		expected List
+	}{
+		{
+			name:     "nothing to subtract",
+			list:     List{1, 2, 3},
+			expected: List{1, 2, 3},
+		},
+		{
+			name:     "single list",
+			list:     List{1, 2, 3, 4, 5},
+			lists:    []List{{2, 4, 6}},
+			expected: List{1, 3, 5},
+		},
+		{
+			name:     "several lists",
+			list:     List{1, 2, 3, 4, 5},
+			lists:    []List{{1}, {}, {0, 5, 9}},
+			expected: List{2, 3, 4},
+		},
+		{
+			name:     "everything subtracted",
+			list:     List{1, 2},
+			lists:    []List{{1, 2, 3}},
+			expected: List{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Subtract(tc.list, tc.lists...))
+		})
+	}
+}
+
+func TestSeek(t *testing.T) {
+	l := make(List, 0, 1000)
+	for i := uint64(0); i < 1000; i++ {
+		l = append(l, 3*i+1)
+	}
+
+	for range 1000 {
+		from := rand.IntN(len(l) + 1)
+		id := rand.Uint64N(3*uint64(len(l)) + 3)
+
+		expected := from
+		for expected < len(l) && l[expected] < id {
+			expected++
+		}
+
+		assert.Equal(t, expected, seek(l, from, id), "seek from %d to %d", from, id)
+	}
+}
+
+func TestPostings(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		p := New(compress)
+		for _, id := range []uint64{5, 1, 3, 1, 9, 7} {
+			p.Add(id)
+		}
+		p.Remove(3)
+		p.Remove(4)
+
+		assert.Equal(t, 4, p.Len())
+		assert.Equal(t, List{1, 5, 7, 9}, p.List())
+
+		// Ids beyond 32 bits
+		p.Add(math.MaxUint32 + 1)
+		p.Add(1<<33 + 5)
+		p.Add(math.MaxUint32)
+		assert.Equal(t, 7, p.Len())
+		assert.Equal(t, List{1, 5, 7, 9, math.MaxUint32, math.MaxUint32 + 1, 1<<33 + 5}, p.List())
+
+		p.Remove(math.MaxUint32 + 1)
+		p.Remove(1<<33 + 6)
+		assert.Equal(t, List{1, 5, 7, 9, math.MaxUint32, 1<<33 + 5}, p.List())
+	}
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	long := make(List, 0, 1_000_000)
+	for i := uint64(0); i < 1_000_000; i++ {
+		long = append(long, i)
+	}
+	short := slices.Clone(long[:1000])
+	for i := range short {
+		short[i] *= 1000
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		Intersect(long, short)
+	}
+}
@@ -0,0 +1,68 @@
+package query
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// Engine evaluates PromQL queries over the storage.
+type Engine struct {
+	engine    *promql.Engine
+	queryable *Queryable
+}
+
+type Opts struct {
+	// Timeout is the maximum query evaluation time, defaults to 2m.
+	Timeout time.Duration
+	// MaxSamples is the maximum number of samples a query can load into
+	// memory, defaults to 50M.
+	MaxSamples int
+	// LookbackDelta is how far back instant selectors look for a sample,
+	// defaults to 5m.
+	LookbackDelta time.Duration
+}
+
+func NewEngine(log *slog.Logger, s domain.Storage, opts Opts) *Engine {
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Minute
+	}
+	if opts.MaxSamples == 0 {
+		opts.MaxSamples = 50_000_000
+	}
+	if opts.LookbackDelta == 0 {
+		opts.LookbackDelta = 5 * time.Minute
+	}
+
+	return &Engine{
+		engine: promql.NewEngine(promql.EngineOpts{
+			Logger:               log,
+			MaxSamples:           opts.MaxSamples,
+			Timeout:              opts.Timeout,
+			LookbackDelta:        opts.LookbackDelta,
+			EnableAtModifier:     true,
+			EnableNegativeOffset: true,
+		}),
+		queryable: NewQueryable(s),
+	}
+}
+
+// NewInstantQuery parses a query evaluated at the given time.
+// The returned query must be closed once its result isn't used anymore.
+func (e *Engine) NewInstantQuery(ctx context.Context, qs string, ts time.Time) (promql.Query, error) {
+	return e.engine.NewInstantQuery(ctx, e.queryable, nil, qs, ts)
+}
+
+// NewRangeQuery parses a query evaluated at every step within the range.
+// The returned query must be closed once its result isn't used anymore.
+func (e *Engine) NewRangeQuery(
+	ctx context.Context,
+	qs string,
+	start,
+	end time.Time,
+	step time.Duration) (promql.Query, error) {
+	return e.engine.NewRangeQuery(ctx, e.queryable, nil, qs, start, end, step)
+}
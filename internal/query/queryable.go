@@ -0,0 +1,106 @@
+// Package query evaluates PromQL queries over the storage.
+package query
+
+import (
+	"context"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// Queryable adapts domain.Storage to the Prometheus storage.Queryable, so the
+// promql engine can read from it.
+type Queryable struct {
+	storage domain.Storage
+}
+
+// NewQueryable returns a queryable over the given storage.
+func NewQueryable(s domain.Storage) *Queryable {
+	return &Queryable{storage: s}
+}
+
+// Querier returns a querier for the given time range.
+func (q *Queryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &querier{
+		storage: q.storage,
+		mint:    mint,
+		maxt:    maxt,
+	}, nil
+}
+
+type querier struct {
+	storage    domain.Storage
+	mint, maxt int64
+}
+
+// Select returns series matching the matchers, narrowed down to the time
+// range of the hints if there are any.
+func (q *querier) Select(
+	_ context.Context,
+	sortSeries bool,
+	hints *storage.SelectHints,
+	matchers ...*labels.Matcher) storage.SeriesSet {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = max(mint, hints.Start), min(maxt, hints.End)
+	}
+
+	result := q.storage.Read(mint, maxt, ToDomainMatchers(matchers))
+
+	set := &seriesSet{
+		series: make([]*series, 0, len(result)),
+		cursor: -1,
+	}
+	for _, ts := range result {
+		set.series = append(set.series, newSeries(ts))
+	}
+
+	if sortSeries {
+		slices.SortFunc(set.series, func(a, b *series) int {
+			return labels.Compare(a.labels, b.labels)
+		})
+	}
+
+	return set
+}
+
+// LabelValues returns sorted values of the label among the series that
+// match the matchers.
+func (q *querier) LabelValues(
+	_ context.Context,
+	name string,
+	_ *storage.LabelHints,
+	matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return q.storage.LabelValues(name, q.mint, q.maxt, ToDomainMatchers(matchers)), nil, nil
+}
+
+// LabelNames returns sorted names of the labels of the series that match
+// the matchers.
+func (q *querier) LabelNames(
+	_ context.Context,
+	_ *storage.LabelHints,
+	matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return q.storage.LabelNames(q.mint, q.maxt, ToDomainMatchers(matchers)), nil, nil
+}
+
+func (q *querier) Close() error {
+	return nil
+}
+
+// ToDomainMatchers converts Prometheus matchers, their types are numerically
+// equal to the domain ones.
+func ToDomainMatchers(matchers []*labels.Matcher) []domain.LabelMatcher {
+	result := make([]domain.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		result = append(result, domain.LabelMatcher{
+			Type:  domain.LabelMatcherType(m.Type),
+			Name:  m.Name,
+			Value: m.Value,
+		})
+	}
+
+	return result
+}
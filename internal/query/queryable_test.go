@@ -0,0 +1,192 @@
+package query
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/storage"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	promstorage "github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hintsQueryable reads with the select hints, like a Prometheus server does
+// over remote read.
+type hintsQueryable struct {
+	storage domain.Storage
+}
+
+func (q hintsQueryable) Querier(mint, maxt int64) (promstorage.Querier, error) {
+	return &hintsQuerier{querier: querier{storage: q.storage, mint: mint, maxt: maxt}}, nil
+}
+
+type hintsQuerier struct {
+	querier
+}
+
+func (q *hintsQuerier) Select(
+	_ context.Context,
+	_ bool,
+	hints *promstorage.SelectHints,
+	matchers ...*labels.Matcher) promstorage.SeriesSet {
+	result := q.storage.ReadWithHints(q.mint, q.maxt, ToDomainMatchers(matchers), domain.ReadHints{
+		StartMs:  hints.Start,
+		EndMs:    hints.End,
+		StepMs:   hints.Step,
+		Func:     hints.Func,
+		RangeMs:  hints.Range,
+		Grouping: hints.Grouping,
+		By:       hints.By,
+	})
+
+	set := &seriesSet{cursor: -1}
+	for _, ts := range result {
+		set.series = append(set.series, newSeries(ts))
+	}
+
+	return set
+}
+
+// TestReadWithHints_Engine makes sure downsampled reads give the same query
+// results as full ones.
+func TestReadWithHints_Engine(t *testing.T) {
+	// Samples at irregular times, so results depend on the steps
+	var samples []domain.Sample
+	for i := int64(0); i < 200; i++ {
+		samples = append(samples, domain.Sample{Timestamp: i * 7_000, Value: float64(i * i % 13)})
+	}
+
+	// A series that stops before the end of the queries
+	var stopped []domain.Sample
+	for i := int64(0); i < 60; i++ {
+		stopped = append(stopped, domain.Sample{Timestamp: i * 10_000, Value: float64(i)})
+	}
+
+	write := func(s *storage.InMemory) {
+		for _, job := range []string{"a", "b"} {
+			s.Write([]domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}}, samples)
+		}
+		s.Write([]domain.Label{{Name: "__name__", Value: "stopped"}}, stopped)
+	}
+
+	full := storage.NewInMemory(storage.Opts{})
+	write(full)
+	downsampled := storage.NewInMemory(storage.Opts{DownsampleReads: true})
+	write(downsampled)
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		Logger:               slog.New(slog.DiscardHandler),
+		MaxSamples:           1_000_000,
+		Timeout:              time.Minute,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+	})
+
+	testCases := []struct {
+		name  string
+		query string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+	}{
+		{
+			name:  "instant selector",
+			query: "up",
+			start: time.UnixMilli(600_000),
+			end:   time.UnixMilli(1_200_000),
+			step:  time.Minute,
+		},
+		{
+			name:  "unaligned instant selector",
+			query: "up",
+			start: time.UnixMilli(601_234),
+			end:   time.UnixMilli(1_201_234),
+			step:  time.Minute,
+		},
+		{
+			name:  "aggregation of a series that stops",
+			query: "sum(stopped)",
+			start: time.UnixMilli(0),
+			end:   time.UnixMilli(1_200_000),
+			step:  time.Minute,
+		},
+		{
+			name:  "subquery",
+			query: "max_over_time(up[2m:10s])",
+			start: time.UnixMilli(903_456),
+		},
+		{
+			name:  "subquery in a range query",
+			query: "max_over_time(up[2m:10s])",
+			start: time.UnixMilli(601_234),
+			end:   time.UnixMilli(1_201_234),
+			step:  time.Minute,
+		},
+		{
+			name:  "aggregation in a subquery",
+			query: "max_over_time(sum(up)[2m:10s])",
+			start: time.UnixMilli(903_456),
+		},
+		{
+			name:  "over time in a subquery",
+			query: "max_over_time(sum_over_time(up[30s])[3m:30s])",
+			start: time.UnixMilli(903_456),
+		},
+		{
+			name:  "offset",
+			query: "sum(up offset 1m) by (job)",
+			start: time.UnixMilli(601_234),
+			end:   time.UnixMilli(1_201_234),
+			step:  time.Minute,
+		},
+		{
+			name:  "subquery offset",
+			query: "max_over_time(up[2m:10s] offset 33s)",
+			start: time.UnixMilli(903_456),
+		},
+		{
+			name:  "at modifier",
+			query: "sum(up @ 700.5)",
+			start: time.UnixMilli(600_000),
+			end:   time.UnixMilli(1_200_000),
+			step:  time.Minute,
+		},
+		{
+			name:  "at modifier in a subquery",
+			query: "max_over_time(up[2m:10s] @ 700.5)",
+			start: time.UnixMilli(903_456),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run := func(s domain.Storage) string {
+				var (
+					q   promql.Query
+					err error
+				)
+				if tc.step > 0 {
+					q, err = engine.NewRangeQuery(context.Background(), hintsQueryable{s}, nil, tc.query, tc.start, tc.end, tc.step)
+				} else {
+					q, err = engine.NewInstantQuery(context.Background(), hintsQueryable{s}, nil, tc.query, tc.start)
+				}
+				require.NoError(t, err)
+				defer q.Close()
+
+				result := q.Exec(context.Background())
+				require.NoError(t, result.Err)
+
+				return result.String()
+			}
+
+			expected := run(full)
+			assert.NotEmpty(t, expected)
+			assert.Equal(t, expected, run(downsampled))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package query
+
+import (
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// seriesSet iterates over series read from the storage.
+type seriesSet struct {
+	series []*series
+	cursor int
+}
+
+func (s *seriesSet) Next() bool {
+	s.cursor++
+
+	return s.cursor < len(s.series)
+}
+
+func (s *seriesSet) At() storage.Series {
+	return s.series[s.cursor]
+}
+
+func (s *seriesSet) Err() error {
+	return nil
+}
+
+func (s *seriesSet) Warnings() annotations.Annotations {
+	return nil
+}
+
+// series is a storage.Series over decoded samples.
+type series struct {
+	labels  labels.Labels
+	samples []domain.Sample
+}
+
+func newSeries(ts domain.TimeSeries) *series {
+	b := labels.NewScratchBuilder(len(ts.Labels))
+	for _, l := range ts.Labels {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+
+	return &series{
+		labels:  b.Labels(),
+		samples: ts.Samples,
+	}
+}
+
+func (s *series) Labels() labels.Labels {
+	return s.labels
+}
+
+func (s *series) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	return storage.NewListSeriesIterator(floatSamples(s.samples))
+}
+
+// floatSamples exposes float samples as storage.Samples.
+type floatSamples []domain.Sample
+
+func (s floatSamples) Get(i int) chunks.Sample {
+	// Pointing into the slice avoids an allocation on every call
+	return (*floatSample)(&s[i])
+}
+
+func (s floatSamples) Len() int {
+	return len(s)
+}
+
+// floatSample is a chunks.Sample of a float value.
+type floatSample domain.Sample
+
+func (s *floatSample) T() int64 {
+	return s.Timestamp
+}
+
+func (s *floatSample) F() float64 {
+	return s.Value
+}
+
+func (s *floatSample) H() *histogram.Histogram {
+	return nil
+}
+
+func (s *floatSample) FH() *histogram.FloatHistogram {
+	return nil
+}
+
+func (s *floatSample) Type() chunkenc.ValueType {
+	return chunkenc.ValFloat
+}
+
+func (s *floatSample) Copy() chunks.Sample {
+	c := *s
+
+	return &c
+}
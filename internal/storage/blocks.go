@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/block"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/oklog/ulid/v2"
+)
+
+// defaultBlockDuration is the time range of a block, the same as in Prometheus.
+const defaultBlockDuration = 2 * time.Hour
+
+// LoadBlocks opens the blocks persisted in the blocks directory. The head
+// doesn't accept samples older than the end of the latest block anymore.
+func (s *InMemory) LoadBlocks() error {
+	if s.blocksPath == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.blocksPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create blocks directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(s.blocksPath)
+	if err != nil {
+		return fmt.Errorf("failed to list blocks: %w", err)
+	}
+
+	var blocks []*block.Block
+	for _, e := range entries {
+		path := filepath.Join(s.blocksPath, e.Name())
+
+		switch {
+		case !e.IsDir():
+			continue
+		case block.IsTmpDir(e.Name()):
+			// Interrupted while being written, the head still has the data
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to remove incomplete block %s: %w", e.Name(), err)
+			}
+
+			continue
+		case !block.IsBlockDir(e.Name()):
+			continue
+		}
+
+		b, err := block.Open(s.log, path)
+		if err != nil {
+			return fmt.Errorf("failed to open block %s: %w", e.Name(), err)
+		}
+		blocks = append(blocks, b)
+	}
+
+	blocks, err = s.removeCompactedBlocks(blocks)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(blocks, compareBlocks)
+
+	// Appends check the minimal valid time under their stripe lock
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.blocks = blocks
+	if len(blocks) > 0 {
+		maxt := blocks[len(blocks)-1].Meta().MaxTime
+		s.minValidTimeMs = max(s.minValidTimeMs, maxt)
+		s.headMinTimeMs = max(s.headMinTimeMs, maxt)
+	}
+
+	return nil
+}
+
+// removeCompactedBlocks removes blocks that were compacted into another one,
+// but weren't removed because of a crash.
+func (s *InMemory) removeCompactedBlocks(blocks []*block.Block) ([]*block.Block, error) {
+	compacted := make(map[ulid.ULID]struct{})
+	for _, b := range blocks {
+		for _, parent := range b.Meta().Compaction.Parents {
+			compacted[parent.ULID] = struct{}{}
+		}
+	}
+
+	var errs []error
+	blocks = slices.DeleteFunc(blocks, func(b *block.Block) bool {
+		if _, ok := compacted[b.Meta().ULID]; !ok {
+			return false
+		}
+
+		if err := errors.Join(b.Close(), os.RemoveAll(b.Dir())); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove compacted block %s: %w", b.Meta().ULID, err))
+		}
+
+		return true
+	})
+
+	return blocks, errors.Join(errs...)
+}
+
+// CutBlocks persists the oldest data of the head as blocks aligned to the
+// block duration, while the head spans more than one and a half of it, so
+// the most recent data always stays in memory.
+func (s *InMemory) CutBlocks() error {
+	if s.blocksPath == "" {
+		return nil
+	}
+
+	for {
+		mint, maxt, ok := s.headTimeRange()
+		if !ok || maxt-mint < s.blockDurationMs*3/2 {
+			return nil
+		}
+
+		start := block.RangeStart(mint, s.blockDurationMs)
+		if err := s.cutBlock(start, start+s.blockDurationMs); err != nil {
+			return err
+		}
+	}
+}
+
+// cutBlock writes the head data within [mint, maxt) to a block and
+// truncates the head.
+func (s *InMemory) cutBlock(mint, maxt int64) error {
+	// Deletions between copying the chunks and truncating the head would be
+	// lost, the block doesn't have their tombstones
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// The block is about to cover the range, stop accepting samples within it
+	s.lockAll()
+	s.minValidTimeMs = max(s.minValidTimeMs, maxt)
+	s.unlockAll()
+
+	var series []domain.ChunkedSeries
+	s.mu.RLock()
+	for id := range s.headSeries() {
+		s.withSeries(id, func(ms *memSeries) {
+			chunks := ms.chunksInRange(max(mint, s.headMinTimeMs), maxt-1)
+			if len(chunks) > 0 {
+				series = append(series, domain.ChunkedSeries{Labels: s.sortedLabels(id), Chunks: chunks})
+			}
+		})
+	}
+	s.mu.RUnlock()
+
+	var b *block.Block
+	if len(series) > 0 {
+		meta, err := block.Write(s.log, s.blocksPath, mint, maxt, series)
+		if err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
+
+		b, err = block.Open(s.log, filepath.Join(s.blocksPath, meta.ULID.String()))
+		if err != nil {
+			return fmt.Errorf("failed to open block: %w", err)
+		}
+
+		s.log.Info("block written",
+			slog.String("ulid", meta.ULID.String()),
+			slog.Time("min_time", time.UnixMilli(mint)),
+			slog.Time("max_time", time.UnixMilli(maxt)),
+			slog.Uint64("series", meta.Stats.NumSeries),
+			slog.Uint64("samples", meta.Stats.NumSamples))
+	}
+
+	s.lockAll()
+	if b != nil {
+		s.blocks = append(s.blocks, b)
+	}
+	s.headMinTimeMs = max(s.headMinTimeMs, maxt)
+	for id, ms := range s.headSeries() {
+		if ms.truncateBefore(maxt) {
+			s.deleteSeries(id)
+		}
+	}
+	s.unlockAll()
+
+	if s.onBlockCut != nil {
+		s.onBlockCut(maxt)
+	}
+
+	return nil
+}
+
+// headTimeRange returns the time range of the samples that are only in the
+// head, if there are any.
+func (s *InMemory) headTimeRange() (int64, int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
+	for id := range s.headSeries() {
+		s.withSeries(id, func(ms *memSeries) {
+			chunks := ms.allChunks()
+			if len(chunks) == 0 {
+				return
+			}
+
+			mint = min(mint, chunks[0].MinTime())
+			maxt = max(maxt, chunks[len(chunks)-1].MaxTime())
+		})
+	}
+
+	mint = max(mint, s.headMinTimeMs)
+
+	return mint, maxt, mint <= maxt
+}
+
+// readBlocks reads series from the blocks overlapping with the time range.
+// Must be called under the read lock.
+func (s *InMemory) readBlocks(fromMs, toMs int64, matchers []*domain.Matcher, fn func(domain.ChunkedSeries) error) error {
+	for _, b := range s.blocks {
+		if err := b.ReadChunks(fromMs, toMs, matchers, fn); err != nil {
+			return fmt.Errorf("failed to read block %s: %w", b.Meta().ULID, err)
+		}
+	}
+
+	return nil
+}
+
+// blockSeries returns label sets of the series that have samples within the
+// time range in any block, no matchers select every series.
+// Must be called under the read lock.
+func (s *InMemory) blockSeries(fromMs, toMs int64, labelMatchers []domain.LabelMatcher) [][]domain.Label {
+	if len(labelMatchers) == 0 {
+		labelMatchers = domain.AllSeries
+	}
+
+	matchers, err := domain.NewMatchers(labelMatchers)
+	if err != nil {
+		return nil
+	}
+
+	var result [][]domain.Label
+	for _, b := range s.blocks {
+		series, err := b.Series(fromMs, toMs, matchers)
+		if err != nil {
+			s.log.Error("failed to read block series",
+				slog.String("ulid", b.Meta().ULID.String()),
+				slog.Any("error", err))
+
+			continue
+		}
+		result = append(result, series...)
+	}
+
+	return result
+}
+
+// deleteBlocksBefore removes blocks that only hold samples older than mintMs.
+// Must be called under the write lock.
+func (s *InMemory) deleteBlocksBefore(mintMs int64) {
+	s.blocks = slices.DeleteFunc(s.blocks, func(b *block.Block) bool {
+		if b.Meta().MaxTime > mintMs {
+			return false
+		}
+
+		err := errors.Join(b.Close(), os.RemoveAll(b.Dir()))
+		if err != nil {
+			s.log.Error("failed to remove block",
+				slog.String("ulid", b.Meta().ULID.String()),
+				slog.Any("error", err))
+		}
+
+		return true
+	})
+}
+
+// Close releases the blocks, it waits for a running compaction.
+func (s *InMemory) Close() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, b := range s.blocks {
+		errs = append(errs, b.Close())
+	}
+	s.blocks = nil
+
+	return errors.Join(errs...)
+}
+
+func compareBlocks(a, b *block.Block) int {
+	return cmp.Compare(a.Meta().MinTime, b.Meta().MinTime)
+}
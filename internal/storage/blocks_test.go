@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_CutBlocks(t *testing.T) {
+	dir := t.TempDir()
+
+	var cuts []int64
+	opts := Opts{
+		BlocksPath:    dir,
+		BlockDuration: time.Second,
+		OnBlockCut: func(maxtMs int64) {
+			cuts = append(cuts, maxtMs)
+		},
+	}
+
+	s := NewInMemory(opts)
+	require.NoError(t, s.LoadBlocks())
+
+	api := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}
+	db := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "db"},
+	}
+	up := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	// A sample every 10ms over 3.5 blocks
+	samples := make([]domain.Sample, 0, 350)
+	for i := 0; i < 350; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i * 10), Value: float64(i)})
+	}
+	s.Write(api, samples)
+	s.Write(db, samples[:50])
+
+	require.NoError(t, s.CutBlocks())
+
+	// The head keeps at least one and a half blocks
+	assert.Equal(t, []int64{1000, 2000}, cuts)
+	require.Len(t, s.blocks, 2)
+	assert.Equal(t, int64(0), s.blocks[0].Meta().MinTime)
+	assert.EqualValues(t, 2, s.blocks[0].Meta().Stats.NumSeries)
+	assert.EqualValues(t, 1, s.blocks[1].Meta().Stats.NumSeries)
+
+	// Series that are only in blocks are dropped from the head
+	assert.Equal(t, 1, s.numSeries())
+
+	assertData := func(s *InMemory) {
+		t.Helper()
+
+		got := s.Read(math.MinInt64, math.MaxInt64, up)
+		if assert.Len(t, got, 2) {
+			expected := map[string][]domain.Sample{"api": samples, "db": samples[:50]}
+			for _, ts := range got {
+				for _, l := range ts.Labels {
+					if l.Name == "job" {
+						assert.Equal(t, expected[l.Value], ts.Samples, l.Value)
+					}
+				}
+			}
+		}
+
+		var chunked []domain.Sample
+		require.NoError(t, s.ReadChunks(995, 2005, up, func(cs domain.ChunkedSeries) error {
+			if cs.Labels[1].Value == "api" {
+				samples, err := chunk.Decode(cs.Chunks)
+				require.NoError(t, err)
+				chunked = append(chunked, samples...)
+			}
+
+			return nil
+		}))
+		assert.Equal(t, samples[100:201], chunked)
+
+		assert.Equal(t, [][]domain.Label{api, db}, s.Series(math.MinInt64, math.MaxInt64, up))
+		assert.Equal(t, []string{"api", "db"}, s.LabelValues("job", math.MinInt64, math.MaxInt64, nil))
+		assert.Equal(t, []string{"__name__", "job"}, s.LabelNames(0, 100, nil))
+	}
+	assertData(s)
+
+	// Samples already persisted in blocks are rejected
+	s.Write(db, []domain.Sample{{Timestamp: 1500, Value: 1}})
+	assert.EqualValues(t, 1, s.RejectedSamples(db))
+	require.NoError(t, s.Close())
+
+	// Blocks are loaded on start, the WAL fills in the head
+	s = NewInMemory(opts)
+	require.NoError(t, s.LoadBlocks())
+	s.Write(api, samples)
+	s.Write(db, samples[:50])
+	assertData(s)
+
+	// Deletions apply to blocks too
+	n, err := s.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		MinTimeMs: math.MinInt64,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, [][]domain.Label{api}, s.Series(math.MinInt64, math.MaxInt64, up))
+
+	// Retention drops whole blocks only, reads skip their older samples
+	s.DeleteBefore(1500)
+	require.Len(t, s.blocks, 1)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	got := s.Read(math.MinInt64, math.MaxInt64, up)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, samples[150:], got[0].Samples)
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestInMemory_CutBlocks_Disabled(t *testing.T) {
+	s := NewInMemory(Opts{BlockDuration: time.Second})
+	require.NoError(t, s.LoadBlocks())
+
+	samples := make([]domain.Sample, 0, 2*chunk.MaxSamples)
+	for i := 0; i < 2*chunk.MaxSamples; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i * 100), Value: float64(i)})
+	}
+	s.Write([]domain.Label{{Name: "__name__", Value: "up"}}, samples)
+
+	require.NoError(t, s.CutBlocks())
+	assert.Empty(t, s.blocks)
+	assert.Equal(t, 1, s.numSeries())
+}
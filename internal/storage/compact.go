@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/block"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// compactionMetrics are the metrics of block compactions.
+type compactionMetrics struct {
+	ran      prometheus.Counter
+	failed   prometheus.Counter
+	duration prometheus.Histogram
+}
+
+// newCompactionMetrics creates the compaction metrics, they are only
+// registered if reg is not nil.
+func newCompactionMetrics(reg prometheus.Registerer) *compactionMetrics {
+	factory := promauto.With(reg)
+
+	return &compactionMetrics{
+		ran: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_compactions_total",
+			Help: "Total number of compactions that were executed.",
+		}),
+		failed: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_compactions_failed_total",
+			Help: "Total number of compactions that failed.",
+		}),
+		duration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minitsdb_compaction_duration_seconds",
+			Help:    "Duration of compactions.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+	}
+}
+
+// compactionRanges returns the time ranges blocks are compacted into, every
+// range is a multiple of the previous one: 2h blocks are compacted into 6h
+// and then 24h ones by default. Like in Prometheus, ranges longer than a
+// tenth of the retention are skipped, so blocks don't outlive it for long.
+func compactionRanges(blockDuration, retention time.Duration) []int64 {
+	var ranges []int64
+	for _, d := range []time.Duration{3 * blockDuration, 12 * blockDuration} {
+		if retention > 0 && d > retention/10 {
+			break
+		}
+		ranges = append(ranges, d.Milliseconds())
+	}
+
+	return ranges
+}
+
+// Compact merges blocks into larger ones as planned by block.Plan, running
+// up to the configured number of compactions at once, until there is
+// nothing left to compact or ctx is canceled. Deletions and retention wait
+// for it to complete.
+func (s *InMemory) Compact(ctx context.Context) error {
+	if s.blocksPath == "" {
+		return nil
+	}
+
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	for ctx.Err() == nil {
+		s.mu.RLock()
+		metas := make([]block.Meta, 0, len(s.blocks))
+		byULID := make(map[ulid.ULID]*block.Block, len(s.blocks))
+		for _, b := range s.blocks {
+			meta := b.Meta()
+			metas = append(metas, meta)
+			byULID[meta.ULID] = b
+		}
+		s.mu.RUnlock()
+
+		plan := block.Plan(metas, s.compactionRangesMs)
+		if len(plan) == 0 {
+			return nil
+		}
+
+		var (
+			wg   sync.WaitGroup
+			sem  = make(chan struct{}, s.compactionConcurrency)
+			errs = make([]error, len(plan))
+		)
+		for i, group := range plan {
+			blocks := make([]*block.Block, 0, len(group))
+			for _, meta := range group {
+				blocks = append(blocks, byULID[meta.ULID])
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				errs[i] = s.compact(blocks)
+			}()
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compact merges the blocks into a new one and replaces them with it.
+// Must be called under the compaction lock.
+func (s *InMemory) compact(blocks []*block.Block) error {
+	start := time.Now()
+	s.compactionMetrics.ran.Inc()
+
+	meta, err := block.Compact(s.log, s.blocksPath, blocks)
+	if err != nil {
+		s.compactionMetrics.failed.Inc()
+
+		return fmt.Errorf("failed to compact blocks: %w", err)
+	}
+
+	b, err := block.Open(s.log, filepath.Join(s.blocksPath, meta.ULID.String()))
+	if err != nil {
+		s.compactionMetrics.failed.Inc()
+
+		return fmt.Errorf("failed to open compacted block: %w", err)
+	}
+
+	s.mu.Lock()
+	s.blocks = slices.DeleteFunc(s.blocks, func(b *block.Block) bool {
+		return slices.Contains(blocks, b)
+	})
+	s.blocks = append(s.blocks, b)
+	slices.SortFunc(s.blocks, compareBlocks)
+	s.mu.Unlock()
+
+	s.compactionMetrics.duration.Observe(time.Since(start).Seconds())
+	s.log.Info("blocks compacted",
+		slog.String("ulid", meta.ULID.String()),
+		slog.Int("level", meta.Compaction.Level),
+		slog.Int("parents", len(blocks)),
+		slog.Time("min_time", time.UnixMilli(meta.MinTime)),
+		slog.Time("max_time", time.UnixMilli(meta.MaxTime)),
+		slog.Duration("duration", time.Since(start)))
+
+	// The new block is in place, a failure only leaves garbage that's
+	// removed on start
+	for _, old := range blocks {
+		if err := errors.Join(old.Close(), os.RemoveAll(old.Dir())); err != nil {
+			s.log.Error("failed to remove compacted block",
+				slog.String("ulid", old.Meta().ULID.String()),
+				slog.Any("error", err))
+		}
+	}
+
+	return nil
+}
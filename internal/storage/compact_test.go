@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/block"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionRanges(t *testing.T) {
+	testCases := []struct {
+		name      string
+		retention time.Duration
+		expected  []int64
+	}{
+		{
+			name:     "no retention",
+			expected: []int64{(6 * time.Hour).Milliseconds(), (24 * time.Hour).Milliseconds()},
+		},
+		{
+			name:      "long retention",
+			retention: 15 * 24 * time.Hour,
+			expected:  []int64{(6 * time.Hour).Milliseconds(), (24 * time.Hour).Milliseconds()},
+		},
+		{
+			name:      "short retention",
+			retention: 3 * 24 * time.Hour,
+			expected:  []int64{(6 * time.Hour).Milliseconds()},
+		},
+		{
+			name:      "too short retention",
+			retention: 24 * time.Hour,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, compactionRanges(2*time.Hour, tc.retention))
+		})
+	}
+}
+
+func TestInMemory_Compact(t *testing.T) {
+	dir := t.TempDir()
+	reg := prometheus.NewRegistry()
+
+	opts := Opts{
+		BlocksPath:            dir,
+		BlockDuration:         time.Second,
+		CompactionConcurrency: 2,
+		Registerer:            reg,
+	}
+	s := NewInMemory(opts)
+	require.NoError(t, s.LoadBlocks())
+
+	api := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}
+	up := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	samples := make([]domain.Sample, 0, 135)
+	for i := 0; i < 135; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i * 100), Value: float64(i)})
+	}
+	s.Write(api, samples)
+
+	require.NoError(t, s.CutBlocks())
+	require.Len(t, s.blocks, 12)
+
+	// 1s blocks are compacted into 3s ones and then into a single 12s one
+	require.NoError(t, s.Compact(context.Background()))
+	require.Len(t, s.blocks, 1)
+
+	meta := s.blocks[0].Meta()
+	assert.Equal(t, int64(0), meta.MinTime)
+	assert.Equal(t, int64(12000), meta.MaxTime)
+	assert.Equal(t, 3, meta.Compaction.Level)
+	assert.Len(t, meta.Compaction.Sources, 12)
+	assert.Len(t, meta.Compaction.Parents, 4)
+
+	assert.Equal(t, 5.0, testutil.ToFloat64(s.compactionMetrics.ran))
+	assert.Zero(t, testutil.ToFloat64(s.compactionMetrics.failed))
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, "minitsdb_compaction_duration_seconds"))
+
+	// Compacted blocks are removed
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	got := s.Read(math.MinInt64, math.MaxInt64, up)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, samples, got[0].Samples)
+	}
+
+	// Nothing left to compact
+	require.NoError(t, s.Compact(context.Background()))
+	assert.Equal(t, meta, s.blocks[0].Meta())
+	require.NoError(t, s.Close())
+}
+
+func TestInMemory_LoadBlocks_Compacted(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+
+	s := NewInMemory(Opts{BlocksPath: dir, BlockDuration: time.Second})
+	require.NoError(t, s.LoadBlocks())
+	for i := int64(0); i < 8; i++ {
+		s.Write(up, []domain.Sample{{Timestamp: i * 500, Value: float64(i)}})
+	}
+	require.NoError(t, s.CutBlocks())
+	require.NoError(t, s.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	var parents []*block.Block
+	for _, e := range entries {
+		b, err := block.Open(log, filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+		parents = append(parents, b)
+	}
+
+	// Crashed before removing the parents
+	meta, err := block.Compact(log, dir, parents)
+	require.NoError(t, err)
+	for _, b := range parents {
+		require.NoError(t, b.Close())
+	}
+
+	s = NewInMemory(Opts{BlocksPath: dir, BlockDuration: time.Second})
+	require.NoError(t, s.LoadBlocks())
+	defer s.Close()
+
+	require.Len(t, s.blocks, 1)
+	assert.Equal(t, meta.ULID, s.blocks[0].Meta().ULID)
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	got := s.Read(math.MinInt64, math.MaxInt64, []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}})
+	if assert.Len(t, got, 1) {
+		assert.Len(t, got[0].Samples, 6)
+	}
+}
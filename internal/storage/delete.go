@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// Delete hides samples of the series selected by the tombstone within its
+// time range from reads right away. Samples written after the deletion are
+// not affected, even if they fall into the range. The space of the head is
+// reclaimed by CleanTombstones later, blocks persist the tombstones. It
+// returns the number of affected series in the head and every block.
+func (s *InMemory) Delete(tombstone domain.Tombstone) (int, error) {
+	return s.delete(tombstone, math.MaxInt64)
+}
+
+// ReplayDelete applies a tombstone replayed from the WAL as of the time of
+// the deletion. The head only holds the samples replayed before it. Blocks
+// created after the deletion are left alone: they only hold samples written
+// after it, as deleted ones are dropped when blocks are cut or compacted.
+func (s *InMemory) ReplayDelete(tombstone domain.Tombstone, deletedAt time.Time) (int, error) {
+	return s.delete(tombstone, deletedAt.UnixMilli())
+}
+
+// delete applies the tombstone to the head and the blocks created before
+// the given time.
+func (s *InMemory) delete(tombstone domain.Tombstone, blocksBeforeMs int64) (int, error) {
+	matchers, err := domain.NewMatchers(tombstone.Matchers)
+	if err != nil {
+		return 0, err
+	}
+
+	// Tombstones added to blocks being compacted would be lost
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var affected int
+	for _, id := range s.seriesIDsForMatchers(matchers) {
+		st := s.stripeByID(id)
+		st.mu.Lock()
+		added := st.series[id].addTombstone(tombstone.MinTimeMs, tombstone.MaxTimeMs)
+		st.mu.Unlock()
+
+		if !added {
+			continue
+		}
+
+		s.tombstoned[id] = struct{}{}
+		affected++
+	}
+
+	for _, b := range s.blocks {
+		if int64(b.Meta().ULID.Time()) >= blocksBeforeMs || !b.Overlaps(tombstone.MinTimeMs, tombstone.MaxTimeMs) {
+			continue
+		}
+
+		n, err := b.Delete(tombstone)
+		if err != nil {
+			return affected, fmt.Errorf("failed to delete from block %s: %w", b.Meta().ULID, err)
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// CleanTombstones physically removes deleted samples and drops series that
+// become empty from the index. It returns the number of removed series.
+func (s *InMemory) CleanTombstones() int {
+	s.lockAll()
+	defer s.unlockAll()
+
+	var removed int
+	for id := range s.tombstoned {
+		delete(s.tombstoned, id)
+
+		if !s.stripeByID(id).series[id].cleanTombstones() {
+			continue
+		}
+
+		s.deleteSeries(id)
+		removed++
+	}
+
+	return removed
+}
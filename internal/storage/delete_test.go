@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_Delete(t *testing.T) {
+	s := NewInMemory(Opts{})
+
+	api := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}
+	db := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "db"},
+	}
+
+	// Several chunks worth of samples
+	samples := make([]domain.Sample, 0, 3*chunk.MaxSamples)
+	for i := 0; i < 3*chunk.MaxSamples; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	s.Write(api, samples)
+	s.Write(db, samples[:10])
+
+	upMatcher := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+	dbMatcher := []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}}
+
+	// Delete the whole db series and a range of api spanning chunks
+	n, err := s.Delete(domain.Tombstone{
+		Matchers:  dbMatcher,
+		MinTimeMs: math.MinInt64,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	from, to := int64(chunk.MaxSamples-10), int64(2*chunk.MaxSamples+10)
+	n, err = s.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "api"}},
+		MinTimeMs: from,
+		MaxTimeMs: to,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Invalid matchers are rejected
+	_, err = s.Delete(domain.Tombstone{
+		Matchers: []domain.LabelMatcher{{Type: domain.RE, Name: "job", Value: "("}},
+	})
+	assert.Error(t, err)
+
+	visible := append(samples[:from:from], samples[to+1:]...)
+
+	assertVisible := func() {
+		t.Helper()
+
+		got := s.Read(math.MinInt64, math.MaxInt64, upMatcher)
+		if assert.Len(t, got, 1) {
+			assert.ElementsMatch(t, api, got[0].Labels)
+			assert.Equal(t, visible, got[0].Samples)
+		}
+
+		var chunked []domain.Sample
+		require.NoError(t, s.ReadChunks(math.MinInt64, math.MaxInt64, upMatcher, func(cs domain.ChunkedSeries) error {
+			assert.Equal(t, api, cs.Labels)
+			for _, c := range cs.Chunks {
+				decoded, err := chunk.FromBytes(c.Data)
+				require.NoError(t, err)
+				samples, err := decoded.Samples()
+				require.NoError(t, err)
+				chunked = append(chunked, samples...)
+			}
+
+			return nil
+		}))
+		assert.Equal(t, visible, chunked)
+
+		assert.Equal(t, []string{"api"}, s.LabelValues("job", math.MinInt64, math.MaxInt64, nil))
+		assert.Equal(t, [][]domain.Label{api}, s.Series(math.MinInt64, math.MaxInt64, upMatcher))
+		assert.Empty(t, s.Series(from, to, upMatcher))
+	}
+
+	// Deleted data is hidden right away
+	assertVisible()
+	assert.Equal(t, 2, s.numSeries())
+
+	// And reclaimed later
+	assert.Equal(t, 1, s.CleanTombstones())
+	assertVisible()
+	assert.Equal(t, 1, s.numSeries())
+	assert.Len(t, s.labelsByID, 1)
+	assert.Equal(t, 1, numHashes(s))
+	assert.NotContains(t, s.invertedIndex["job"], labelValue("db"))
+	assert.Empty(t, s.tombstoned)
+	for _, ms := range s.headSeries() {
+		assert.Empty(t, ms.tombstones)
+	}
+}
+
+func TestInMemory_Delete_LaterWrites(t *testing.T) {
+	s := NewInMemory(Opts{OutOfOrderWindow: time.Second})
+
+	labels := []domain.Label{{Name: "__name__", Value: "up"}}
+	matchers := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	s.Write(labels, []domain.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 20, Value: 2}})
+
+	n, err := s.Delete(domain.Tombstone{
+		Matchers:  matchers,
+		MinTimeMs: math.MinInt64,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, s.Read(0, 100, matchers))
+
+	// Nothing left to delete
+	n, err = s.Delete(domain.Tombstone{Matchers: matchers, MinTimeMs: 0, MaxTimeMs: 100})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Samples newer than the deleted ones are not affected
+	s.Write(labels, []domain.Sample{{Timestamp: 30, Value: 3}})
+
+	got := s.Read(0, 100, matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, []domain.Sample{{Timestamp: 30, Value: 3}}, got[0].Samples)
+	}
+
+	// So are out-of-order samples within the deleted range
+	s.Write(labels, []domain.Sample{{Timestamp: 15, Value: 4}})
+
+	expected := []domain.Sample{{Timestamp: 15, Value: 4}, {Timestamp: 30, Value: 3}}
+	got = s.Read(0, 100, matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, expected, got[0].Samples)
+	}
+
+	assert.Equal(t, 0, s.CleanTombstones())
+
+	got = s.Read(0, 100, matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, expected, got[0].Samples)
+	}
+}
+
+func TestInMemory_ReplayDelete(t *testing.T) {
+	s := NewInMemory(Opts{BlocksPath: t.TempDir(), BlockDuration: time.Second})
+	require.NoError(t, s.LoadBlocks())
+
+	labels := []domain.Label{{Name: "__name__", Value: "up"}}
+	matchers := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	samples := make([]domain.Sample, 0, 300)
+	for i := 0; i < 300; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i * 10), Value: float64(i)})
+	}
+
+	// The first block exists when the deletion happens, the second one is
+	// cut after it
+	s.Write(labels, samples[:200])
+	require.NoError(t, s.CutBlocks())
+	require.Len(t, s.blocks, 1)
+
+	time.Sleep(2 * time.Millisecond)
+	deletedAt := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	s.Write(labels, samples[200:])
+	require.NoError(t, s.CutBlocks())
+	require.Len(t, s.blocks, 2)
+
+	n, err := s.ReplayDelete(domain.Tombstone{
+		Matchers:  matchers,
+		MinTimeMs: 0,
+		MaxTimeMs: 1500,
+	}, deletedAt)
+	require.NoError(t, err)
+	assert.Positive(t, n)
+
+	got := s.Read(math.MinInt64, math.MaxInt64, matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, samples[100:], got[0].Samples)
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/value"
+)
+
+// defaultLookbackDelta is the Prometheus default lookback delta.
+const defaultLookbackDelta = 5 * time.Minute
+
+// aggregators reduce the values of a step to a single one.
+var aggregators = map[string]func([]float64) float64{
+	"sum": func(vs []float64) float64 {
+		var sum float64
+		for _, v := range vs {
+			sum += v
+		}
+
+		return sum
+	},
+	"min": func(vs []float64) float64 {
+		// NaN only wins when there are no other values, like in Prometheus
+		result := vs[0]
+		for _, v := range vs[1:] {
+			if v < result || math.IsNaN(result) {
+				result = v
+			}
+		}
+
+		return result
+	},
+	"max": func(vs []float64) float64 {
+		result := vs[0]
+		for _, v := range vs[1:] {
+			if v > result || math.IsNaN(result) {
+				result = v
+			}
+		}
+
+		return result
+	},
+	"avg": func(vs []float64) float64 {
+		var sum float64
+		for _, v := range vs {
+			sum += v
+		}
+
+		return sum / float64(len(vs))
+	},
+	"last": func(vs []float64) float64 {
+		return vs[len(vs)-1]
+	},
+}
+
+// overTimeAggregators are the *_over_time functions that give the same
+// result when applied to a single pre-aggregated sample.
+var overTimeAggregators = map[string]string{
+	"sum_over_time":  "sum",
+	"min_over_time":  "min",
+	"max_over_time":  "max",
+	"avg_over_time":  "avg",
+	"last_over_time": "last",
+}
+
+// ReadWithHints reads time series within the range narrowed down by the
+// hints. With downsampling enabled, the series are also reduced to what the
+// caller needs to evaluate the query:
+//   - instant selectors keep only the latest sample before every step;
+//   - supported *_over_time functions get one sample per step, when steps
+//     don't overlap;
+//   - sum, min, max and avg aggregations get one series per group.
+//
+// The caller is expected to evaluate exactly the query the hints were made
+// for, over the returned data only.
+func (s *InMemory) ReadWithHints(
+	fromMs,
+	toMs int64,
+	labelMatchers []domain.LabelMatcher,
+	hints domain.ReadHints) []domain.TimeSeries {
+	fromMs, toMs = hints.Clip(fromMs, toMs)
+
+	series := s.Read(fromMs, toMs, labelMatchers)
+	if !s.downsampleReads {
+		return series
+	}
+
+	return applyHints(series, hints, s.lookbackDeltaMs)
+}
+
+// evalSteps describes the timestamps a query is evaluated at and the window
+// of data every evaluation looks at: (t-window, t].
+type evalSteps struct {
+	start, end, step int64
+	window           int64
+}
+
+// newEvalSteps restores evaluation timestamps from the hints, Prometheus
+// extends the start of the selected data by the window minus one. Steps of
+// range queries start at the query start, while subqueries are evaluated at
+// absolute multiples of their step, and the hints don't tell them apart.
+// Steps are only restored when both agree: when the first step is a multiple
+// of the step, or there's a single one, like with the @ modifier. Offsets
+// shift the data along with the steps. A selector offset inside a subquery
+// that isn't a multiple of its step still can't be told from an aligned
+// range query.
+func newEvalSteps(hints domain.ReadHints, lookbackDeltaMs int64) (evalSteps, bool) {
+	window := hints.RangeMs
+	if window == 0 {
+		window = lookbackDeltaMs
+	}
+
+	steps := evalSteps{
+		start:  hints.StartMs + window - 1,
+		end:    hints.EndMs,
+		step:   hints.StepMs,
+		window: window,
+	}
+	if steps.step == 0 {
+		// Instant query
+		steps.start = steps.end
+		steps.step = 1
+	}
+
+	if hints.EndMs == 0 || steps.start > steps.end {
+		return steps, false
+	}
+
+	return steps, steps.start == steps.end || steps.start%steps.step == 0
+}
+
+// each calls fn for every evaluation timestamp.
+func (e evalSteps) each(fn func(t int64)) {
+	for t := e.start; t <= e.end; t += e.step {
+		fn(t)
+	}
+}
+
+// applyHints downsamples or aggregates series when it doesn't change the
+// query result, otherwise series are returned as is.
+func applyHints(series []domain.TimeSeries, hints domain.ReadHints, lookbackDeltaMs int64) []domain.TimeSeries {
+	steps, ok := newEvalSteps(hints, lookbackDeltaMs)
+	if !ok {
+		return series
+	}
+
+	if hints.RangeMs == 0 {
+		if aggregate, ok := aggregators[hints.Func]; ok && hints.Func != "last" {
+			return aggregateSeries(series, steps, hints, aggregate)
+		}
+
+		for i := range series {
+			series[i].Samples = latestPerStep(series[i].Samples, steps)
+		}
+
+		return series
+	}
+
+	name, ok := overTimeAggregators[hints.Func]
+	if !ok || steps.step < steps.window {
+		// Windows of different steps overlap, can't pre-aggregate
+		return series
+	}
+
+	for i := range series {
+		series[i].Samples = aggregatePerStep(series[i].Samples, steps, aggregators[name])
+	}
+
+	return series
+}
+
+// latestPerStep keeps only the samples that are the latest ones within the
+// window of some step, which is all an instant selector ever looks at.
+func latestPerStep(samples []domain.Sample, steps evalSteps) []domain.Sample {
+	result := make([]domain.Sample, 0)
+
+	steps.each(func(t int64) {
+		// Index of the first sample after t
+		i, _ := slices.BinarySearchFunc(samples, t+1, compareSampleTime)
+		if i == 0 || samples[i-1].Timestamp <= t-steps.window {
+			return
+		}
+
+		latest := samples[i-1]
+		if len(result) == 0 || result[len(result)-1].Timestamp != latest.Timestamp {
+			result = append(result, latest)
+		}
+	})
+
+	return result
+}
+
+// aggregatePerStep reduces samples within the window of every step to a
+// single sample at the step timestamp. Stale markers are skipped.
+func aggregatePerStep(samples []domain.Sample, steps evalSteps, aggregate func([]float64) float64) []domain.Sample {
+	result := make([]domain.Sample, 0)
+
+	var values []float64
+	steps.each(func(t int64) {
+		from, _ := slices.BinarySearchFunc(samples, t-steps.window+1, compareSampleTime)
+		to, _ := slices.BinarySearchFunc(samples, t+1, compareSampleTime)
+
+		values = values[:0]
+		for _, s := range samples[from:to] {
+			if !value.IsStaleNaN(s.Value) {
+				values = append(values, s.Value)
+			}
+		}
+
+		if len(values) > 0 {
+			result = append(result, domain.Sample{Timestamp: t, Value: aggregate(values)})
+		}
+	})
+
+	return result
+}
+
+// aggregateSeries groups series by the hints grouping and aggregates the
+// latest values of every group at every step into a single series. A stale
+// marker ends the series of a group at the first step it has no values.
+func aggregateSeries(
+	series []domain.TimeSeries,
+	steps evalSteps,
+	hints domain.ReadHints,
+	aggregate func([]float64) float64) []domain.TimeSeries {
+	type group struct {
+		labels  []domain.Label
+		members [][]domain.Sample
+	}
+
+	var (
+		groups []*group
+		byKey  = make(map[string]*group)
+	)
+	for _, ts := range series {
+		labels := groupLabels(ts.Labels, hints.Grouping, hints.By)
+		key := domain.LabelsKey(labels)
+
+		g, ok := byKey[key]
+		if !ok {
+			g = &group{labels: labels}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.members = append(g.members, ts.Samples)
+	}
+
+	result := make([]domain.TimeSeries, 0, len(groups))
+	for _, g := range groups {
+		ts := domain.TimeSeries{
+			Labels:  g.labels,
+			Samples: make([]domain.Sample, 0),
+		}
+
+		var values []float64
+		steps.each(func(t int64) {
+			values = values[:0]
+			for _, samples := range g.members {
+				i, _ := slices.BinarySearchFunc(samples, t+1, compareSampleTime)
+				if i == 0 || samples[i-1].Timestamp <= t-steps.window || value.IsStaleNaN(samples[i-1].Value) {
+					// No value at this step
+					continue
+				}
+				values = append(values, samples[i-1].Value)
+			}
+
+			switch {
+			case len(values) > 0:
+				ts.Samples = append(ts.Samples, domain.Sample{Timestamp: t, Value: aggregate(values)})
+			case len(ts.Samples) > 0 && ts.Samples[len(ts.Samples)-1].Timestamp == t-steps.step:
+				// The group has no values anymore, otherwise the engine looks
+				// back to the previous aggregate at the following steps
+				ts.Samples = append(ts.Samples, domain.Sample{Timestamp: t, Value: math.Float64frombits(value.StaleNaN)})
+			}
+		})
+
+		result = append(result, ts)
+	}
+
+	return result
+}
+
+// groupLabels returns the labels that identify the group of the series,
+// sorted by name. Like in Prometheus, "without" always drops the metric name.
+func groupLabels(labels []domain.Label, grouping []string, by bool) []domain.Label {
+	result := make([]domain.Label, 0, len(labels))
+	for _, l := range labels {
+		grouped := slices.Contains(grouping, l.Name)
+		if by && grouped || !by && !grouped && l.Name != "__name__" {
+			result = append(result, l)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b domain.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return result
+}
+
+func compareSampleTime(s domain.Sample, t int64) int {
+	return cmp.Compare(s.Timestamp, t)
+}
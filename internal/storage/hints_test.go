@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemory_ReadWithHints(t *testing.T) {
+	upA := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "instance", Value: "1"}}
+	upB := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "instance", Value: "2"}}
+	upC := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "c"}, {Name: "instance", Value: "1"}}
+
+	// A sample every 10 seconds for 10 minutes
+	var samples []domain.Sample
+	for ts := int64(0); ts < 600_000; ts += 10_000 {
+		samples = append(samples, domain.Sample{Timestamp: ts, Value: float64(ts / 10_000)})
+	}
+
+	matchers := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	testCases := []struct {
+		name       string
+		downsample bool
+		matchers   []domain.LabelMatcher
+		hints      domain.ReadHints
+		expected   []domain.TimeSeries
+	}{
+		{
+			name:       "clip range",
+			downsample: false,
+			matchers:   []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "2"}},
+			hints:      domain.ReadHints{StartMs: 100_000, EndMs: 120_000, StepMs: 60_000, Func: "sum"},
+			expected: []domain.TimeSeries{
+				{Labels: upB, Samples: samples[10:13]},
+			},
+		},
+		{
+			name:       "instant selector",
+			downsample: true,
+			matchers:   []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "2"}},
+			// Evaluated at 300s, 360s, 420s with the default 5m lookback
+			hints: domain.ReadHints{StartMs: 1, EndMs: 420_000, StepMs: 60_000},
+			expected: []domain.TimeSeries{
+				{Labels: upB, Samples: []domain.Sample{samples[30], samples[36], samples[42]}},
+			},
+		},
+		{
+			name:       "over time with overlapping steps",
+			downsample: true,
+			matchers:   []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "2"}},
+			hints:      domain.ReadHints{StartMs: 0, EndMs: 120_000, StepMs: 30_000, RangeMs: 60_000, Func: "max_over_time"},
+			expected: []domain.TimeSeries{
+				{Labels: upB, Samples: samples[:13]},
+			},
+		},
+		{
+			name:       "over time",
+			downsample: true,
+			matchers:   []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "2"}},
+			// Evaluated at 60s and 120s
+			hints: domain.ReadHints{StartMs: 1, EndMs: 120_000, StepMs: 60_000, RangeMs: 60_000, Func: "sum_over_time"},
+			expected: []domain.TimeSeries{
+				{Labels: upB, Samples: []domain.Sample{
+					{Timestamp: 60_000, Value: 1 + 2 + 3 + 4 + 5 + 6},
+					{Timestamp: 120_000, Value: 7 + 8 + 9 + 10 + 11 + 12},
+				}},
+			},
+		},
+		{
+			name:       "over time with unaligned steps",
+			downsample: true,
+			matchers:   []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "2"}},
+			// Steps at 59.999s and 119.999s may belong to a subquery evaluated
+			// at multiples of the step instead
+			hints: domain.ReadHints{StartMs: 0, EndMs: 120_000, StepMs: 60_000, RangeMs: 60_000, Func: "sum_over_time"},
+			expected: []domain.TimeSeries{
+				{Labels: upB, Samples: samples[:13]},
+			},
+		},
+		{
+			name:       "aggregation by",
+			downsample: true,
+			matchers:   matchers,
+			// Instant query at 300s
+			hints: domain.ReadHints{StartMs: 1, EndMs: 300_000, Func: "sum", Grouping: []string{"job"}, By: true},
+			expected: []domain.TimeSeries{
+				{Labels: []domain.Label{{Name: "job", Value: "a"}}, Samples: []domain.Sample{{Timestamp: 300_000, Value: 60}}},
+				{Labels: []domain.Label{{Name: "job", Value: "c"}}, Samples: []domain.Sample{{Timestamp: 300_000, Value: 30}}},
+			},
+		},
+		{
+			name:       "aggregation without",
+			downsample: true,
+			matchers:   matchers,
+			hints:      domain.ReadHints{StartMs: 1, EndMs: 300_000, Func: "max", Grouping: []string{"job"}},
+			expected: []domain.TimeSeries{
+				{Labels: []domain.Label{{Name: "instance", Value: "1"}}, Samples: []domain.Sample{{Timestamp: 300_000, Value: 30}}},
+				{Labels: []domain.Label{{Name: "instance", Value: "2"}}, Samples: []domain.Sample{{Timestamp: 300_000, Value: 30}}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewInMemory(Opts{DownsampleReads: tc.downsample})
+			s.Write(upA, samples)
+			s.Write(upB, samples)
+			s.Write(upC, samples)
+
+			got := s.ReadWithHints(0, 600_000, tc.matchers, tc.hints)
+
+			// Labels come in no particular order
+			for _, series := range [][]domain.TimeSeries{got, tc.expected} {
+				for _, ts := range series {
+					slices.SortFunc(ts.Labels, func(a, b domain.Label) int {
+						return cmp.Compare(a.Name, b.Name)
+					})
+				}
+			}
+			assert.ElementsMatch(t, tc.expected, got)
+		})
+	}
+}
+
+func TestAggregators_NaN(t *testing.T) {
+	assert.Equal(t, 1.0, aggregators["min"]([]float64{math.NaN(), 1, 2}))
+	assert.Equal(t, 2.0, aggregators["max"]([]float64{math.NaN(), 1, 2}))
+	assert.True(t, math.IsNaN(aggregators["max"]([]float64{math.NaN()})))
+
+	// Stale markers mean there's no value
+	stale := math.Float64frombits(value.StaleNaN)
+	got := aggregatePerStep(
+		[]domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: stale}, {Timestamp: 11, Value: stale}},
+		evalSteps{start: 10, end: 20, step: 10, window: 10},
+		aggregators["sum"])
+	assert.Equal(t, []domain.Sample{{Timestamp: 10, Value: 1}}, got)
+}
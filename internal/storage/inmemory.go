@@ -1,81 +1,237 @@
 package storage
 
 import (
+	"cmp"
 	"hash/fnv"
+	"log/slog"
+	"math"
+	"slices"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/dstdfx/mini-tsdb/internal/block"
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
 	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/postings"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type (
-	seriesID   uint64 // Unique identifier for a series
-	lableName  string // Represents the name of a label
-	labelValue string // Represents the value of a label
-	labelsHash uint64 // Hash value for a set of labels
+	seriesID   = uint64 // Unique identifier for a series, kept in postings.List
+	lableName  string   // Represents the name of a label
+	labelValue string   // Represents the value of a label
+	labelsHash uint64   // Hash value for a set of labels
 )
 
 type InMemory struct {
+	// mu guards the index and the state below, it's taken before stripe
+	// locks. Appends to existing series only lock their stripe.
 	mu            sync.RWMutex
-	lastSeriesID  seriesID                                // id of the last used series identifier
-	series        map[seriesID][]domain.Sample            // used to map series identifier to a slice of samples
-	invertedIndex map[lableName]map[labelValue][]seriesID // used to map series with specific labels and names
-	labelsByID    map[seriesID]map[lableName]labelValue   // series id to the labels and values
-	seriesHash    map[labelsHash]seriesID                 // to check if we already had a sequence of labels before
+	lastSeriesID  seriesID                                        // id of the last used series identifier
+	stripes       []stripe                                        // head series split by labels hash
+	invertedIndex map[lableName]map[labelValue]*postings.Postings // used to map series with specific labels and names
+	allPostings   *postings.Postings                              // ids of all the series
+	labelsByID    map[seriesID]map[lableName]labelValue           // series id to the labels and values
+	tombstoned    map[seriesID]struct{}                           // series with deleted samples that are not reclaimed yet
+
+	retention time.Duration
+	timeFn    func() time.Time
+	appendOpts
+
+	downsampleReads bool
+	lookbackDeltaMs int64
+
+	log             *slog.Logger
+	blocksPath      string
+	blockDurationMs int64
+	blocks          []*block.Block // persisted blocks sorted by time
+	headMinTimeMs   int64          // older head data is already in blocks
+	retentionMinMs  int64          // older samples are out of retention, reads skip them
+	onBlockCut      func(maxtMs int64)
+
+	compressPostings bool
+
+	limits           Limits
+	discardedSamples *prometheus.CounterVec
+
+	headMetrics *headMetrics
+
+	compactMu             sync.Mutex // serializes cuts and compactions with deletions and removal of the blocks they read
+	compactionRangesMs    []int64
+	compactionConcurrency int
+	compactionMetrics     *compactionMetrics
 }
 
-func NewInMemory() *InMemory {
-	return &InMemory{
-		series:        make(map[seriesID][]domain.Sample),
-		invertedIndex: make(map[lableName]map[labelValue][]seriesID),
+type Opts struct {
+	// Retention is how long samples are kept, 0 keeps them forever.
+	Retention time.Duration
+	TimeNow   func() time.Time
+
+	// OutOfOrderWindow is how far behind the latest sample of a series a new
+	// sample may be to still get inserted in order. Older samples are
+	// rejected and counted per series. 0 rejects all out-of-order samples.
+	OutOfOrderWindow time.Duration
+	// DuplicatePolicy decides which sample is kept on equal timestamps,
+	// defaults to domain.LastWriteWins.
+	DuplicatePolicy domain.DuplicatePolicy
+
+	// DownsampleReads lets ReadWithHints downsample and aggregate series
+	// according to the read hints, instead of only narrowing the time range.
+	DownsampleReads bool
+	// LookbackDelta must match the lookback delta of the querier,
+	// defaults to the Prometheus default of 5m.
+	LookbackDelta time.Duration
+
+	Log *slog.Logger
+	// BlocksPath is the directory the head is persisted to as blocks in the
+	// Prometheus TSDB format, empty keeps everything in memory.
+	BlocksPath string
+	// BlockDuration is the time range of a block, defaults to 2h.
+	BlockDuration time.Duration
+	// OnBlockCut is called once all the samples before maxtMs are persisted
+	// in blocks.
+	OnBlockCut func(maxtMs int64)
+	// CompactionConcurrency is how many compactions may run at once,
+	// defaults to 1.
+	CompactionConcurrency int
+	// Registerer registers the storage metrics if set.
+	Registerer prometheus.Registerer
+	// CompressPostings keeps posting lists of the index as roaring bitmaps,
+	// trading query speed for memory.
+	CompressPostings bool
+	// Stripes is the number of stripes the head series are split into, so
+	// concurrent appends to different series don't wait for each other.
+	// Defaults to 64.
+	Stripes int
+	// Limits are applied by ApplyLimits before series are written.
+	Limits Limits
+}
+
+func NewInMemory(opts Opts) *InMemory {
+	if opts.TimeNow == nil {
+		opts.TimeNow = time.Now
+	}
+	if opts.DuplicatePolicy == "" {
+		opts.DuplicatePolicy = domain.LastWriteWins
+	}
+	if opts.LookbackDelta == 0 {
+		opts.LookbackDelta = defaultLookbackDelta
+	}
+	if opts.Log == nil {
+		opts.Log = slog.New(slog.DiscardHandler)
+	}
+	if opts.BlockDuration == 0 {
+		opts.BlockDuration = defaultBlockDuration
+	}
+	if opts.CompactionConcurrency <= 0 {
+		opts.CompactionConcurrency = 1
+	}
+	if opts.Stripes <= 0 {
+		opts.Stripes = defaultStripes
+	}
+
+	s := &InMemory{
+		stripes:       newStripes(opts.Stripes),
+		invertedIndex: make(map[lableName]map[labelValue]*postings.Postings),
+		allPostings:   postings.New(opts.CompressPostings),
 		labelsByID:    make(map[seriesID]map[lableName]labelValue),
-		seriesHash:    make(map[labelsHash]seriesID),
+		tombstoned:    make(map[seriesID]struct{}),
+		retention:     opts.Retention,
+		timeFn:        opts.TimeNow,
+		appendOpts: appendOpts{
+			oooWindowMs:     opts.OutOfOrderWindow.Milliseconds(),
+			duplicatePolicy: opts.DuplicatePolicy,
+			minValidTimeMs:  math.MinInt64,
+		},
+		downsampleReads: opts.DownsampleReads,
+		lookbackDeltaMs: opts.LookbackDelta.Milliseconds(),
+		log:             opts.Log,
+		blocksPath:      opts.BlocksPath,
+		blockDurationMs: opts.BlockDuration.Milliseconds(),
+		headMinTimeMs:   math.MinInt64,
+		retentionMinMs:  math.MinInt64,
+		onBlockCut:      opts.OnBlockCut,
+
+		compressPostings: opts.CompressPostings,
+
+		limits:           opts.Limits,
+		discardedSamples: newDiscardedSamples(opts.Registerer),
+
+		compactionRangesMs:    compactionRanges(opts.BlockDuration, opts.Retention),
+		compactionConcurrency: opts.CompactionConcurrency,
+		compactionMetrics:     newCompactionMetrics(opts.Registerer),
 	}
+	s.headMetrics = newHeadMetrics(opts.Registerer, s)
+
+	return s
 }
 
 // Write method writes a single time series to in-memory storage.
 func (s *InMemory) Write(labels []domain.Label, samples []domain.Sample) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	s.write(labels, samples)
 }
 
-func (s *InMemory) write(labels []domain.Label, samples []domain.Sample) {
+// write appends samples to the series, only its stripe is locked unless the
+// series is new and has to be indexed. It returns the number of stored samples.
+func (s *InMemory) write(labels []domain.Label, samples []domain.Sample) int {
 	currentHash := s.buildLabelsHash(labels)
+	st := s.stripeByHash(currentHash)
 
 	// Check if we already had this sequence of labels
-	existingSeriesID, isKnownHash := s.seriesHash[currentHash]
-	if !isKnownHash {
-		// New sequence, get next series id
-		s.lastSeriesID++
-		existingSeriesID = s.lastSeriesID
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
-		// Map hash to the series id
-		s.seriesHash[currentHash] = existingSeriesID
+	existingSeriesID, isKnownHash := st.hashes[currentHash]
+	if !isKnownHash {
+		// Slow path: index a new labels sequence, the index lock goes first
+		st.mu.Unlock()
+		s.mu.Lock()
+		st.mu.Lock()
+
+		existingSeriesID, isKnownHash = st.hashes[currentHash]
+		if !isKnownHash {
+			existingSeriesID = s.addSeries(currentHash, labels, &memSeries{})
+			s.headMetrics.seriesCreated.Inc()
+		}
+		s.mu.Unlock()
 	}
 
 	// Update the samples
-	s.series[existingSeriesID] = append(s.series[existingSeriesID], samples...)
+	ms := st.series[existingSeriesID]
+	rejected := ms.rejected
+	appended := ms.append(samples, s.appendOpts)
 
-	if isKnownHash {
-		// Fast path: no need to update inverted index for existing labels sequence
-		return
-	}
+	s.headMetrics.samplesAppended.Add(float64(appended))
+	s.headMetrics.outOfOrderSamples.Add(float64(ms.rejected - rejected))
+
+	return appended
+}
+
+// addSeries stores a new series with the given labels hash and builds the
+// inverted index and labels map for it.
+// Must be called under the write locks of the index and the series stripe.
+func (s *InMemory) addSeries(hash labelsHash, labels []domain.Label, ms *memSeries) seriesID {
+	// New sequence, get next series id
+	existingSeriesID := s.nextID(hash)
+
+	// Map hash to the series id
+	st := s.stripeByID(existingSeriesID)
+	st.hashes[hash] = existingSeriesID
+	st.series[existingSeriesID] = ms
+	s.allPostings.Add(existingSeriesID)
 
-	// Slow path: build the inverted index and labels map for a new labels sequence
 	for _, l := range labels {
 		// Make sure the index is initialized
 		if s.invertedIndex[lableName(l.Name)] == nil {
-			s.invertedIndex[lableName(l.Name)] = make(map[labelValue][]seriesID, len(labels))
+			s.invertedIndex[lableName(l.Name)] = make(map[labelValue]*postings.Postings, len(labels))
 		}
 		if s.invertedIndex[lableName(l.Name)][labelValue(l.Value)] == nil {
-			s.invertedIndex[lableName(l.Name)][labelValue(l.Value)] = make([]seriesID, 0, 256)
+			s.invertedIndex[lableName(l.Name)][labelValue(l.Value)] = postings.New(s.compressPostings)
 		}
 
 		// Map label name, label value to the series id
-		s.invertedIndex[lableName(l.Name)][labelValue(l.Value)] =
-			append(s.invertedIndex[lableName(l.Name)][labelValue(l.Value)], existingSeriesID)
+		s.invertedIndex[lableName(l.Name)][labelValue(l.Value)].Add(existingSeriesID)
 
 		// Build lables map
 		if s.labelsByID[existingSeriesID] == nil {
@@ -83,16 +239,36 @@ func (s *InMemory) write(labels []domain.Label, samples []domain.Sample) {
 		}
 		s.labelsByID[existingSeriesID][lableName(l.Name)] = labelValue(l.Value)
 	}
-}
 
-// WriteMultiple writes multiple time series to in-memory storage.
-func (s *InMemory) WriteMultiple(series []domain.TimeSeries) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return existingSeriesID
+}
 
+// WriteMultiple writes multiple time series to in-memory storage and returns
+// the number of stored samples.
+func (s *InMemory) WriteMultiple(series []domain.TimeSeries) int {
+	var appended int
 	for _, ts := range series {
-		s.write(ts.Labels, ts.Samples)
+		appended += s.write(ts.Labels, ts.Samples)
+	}
+
+	return appended
+}
+
+// RejectedSamples returns the number of samples of the series that were
+// rejected for being too far out of order.
+func (s *InMemory) RejectedSamples(labels []domain.Label) uint64 {
+	hash := s.buildLabelsHash(slices.Clone(labels))
+	st := s.stripeByHash(hash)
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	id, ok := st.hashes[hash]
+	if !ok {
+		return 0
 	}
+
+	return st.series[id].rejected
 }
 
 func (s *InMemory) buildLabelsHash(labels []domain.Label) labelsHash {
@@ -116,76 +292,72 @@ func (s *InMemory) buildLabelsHash(labels []domain.Label) labelsHash {
 	return labelsHash(h.Sum64())
 }
 
-// Read returns time series based on the provided options.
+// Read returns time series based on the provided options. Samples persisted
+// in blocks are followed by the ones from the head.
 func (s *InMemory) Read(
 	fromMs,
 	toMs int64,
 	labelMatchers []domain.LabelMatcher) (timeSeries []domain.TimeSeries) {
+	matchers, err := domain.NewMatchers(labelMatchers)
+	if err != nil {
+		// Invalid matchers can't select anything
+		return
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	neqLabels := make([]domain.LabelMatcher, 0)
+	fromMs = max(fromMs, s.retentionMinMs)
 
-	// Find values that match with all EQ labels
-	seriesIDs := make([]seriesID, 0)
-	for _, l := range labelMatchers {
-		// Skip non EQ types
-		if l.Type != domain.EQ {
-			// TODO: fix me when regexp type is supported
-			// Collect all NEQ labels for further filtering
-			neqLabels = append(neqLabels, l)
-
-			continue
+	// Blocks hold older data, read them first
+	fromBlocks := make(map[string]int)
+	err = s.readBlocks(fromMs, toMs, matchers, func(cs domain.ChunkedSeries) error {
+		samples, err := chunk.Decode(cs.Chunks)
+		if err != nil {
+			return err
 		}
 
-		values, ok := s.invertedIndex[lableName(l.Name)]
+		key := domain.LabelsKey(cs.Labels)
+		i, ok := fromBlocks[key]
 		if !ok {
-			// No matching values - abort further checking
-			return
+			i = len(timeSeries)
+			fromBlocks[key] = i
+			timeSeries = append(timeSeries, domain.TimeSeries{Labels: cs.Labels})
 		}
+		timeSeries[i].Samples = append(timeSeries[i].Samples, samples...)
 
-		ids, ok := values[labelValue(l.Value)]
-		if !ok {
-			// No matching values - abort further checking
-			return
-		}
-
-		if len(seriesIDs) == 0 {
-			// Init case: when it's the very first slice so
-			// there's nothing to intersect it with
-			seriesIDs = ids
-		} else {
-			// Otherwise just find intersection to leave only the
-			// ids that matched
-			seriesIDs = findIntersection(seriesIDs, ids)
-			if len(seriesIDs) == 0 {
-				// No matching values - abort further checking
-				return
-			}
-		}
+		return nil
+	})
+	if err != nil {
+		s.log.Error("failed to read blocks", slog.Any("error", err))
 	}
 
-	// Filter ids by remaining NEQ labels and
-	// collect matching time series
-	for _, id := range seriesIDs {
-		// Check if we need to skip current id
-		var skip bool
-		for _, l := range neqLabels {
-			if v, ok := s.labelsByID[id][lableName(l.Name)]; ok && v == labelValue(l.Value) {
-				skip = true
+	// Collect matching time series
+	headFromMs := max(fromMs, s.headMinTimeMs)
+	for _, id := range s.seriesIDsForMatchers(matchers) {
+		var (
+			ts      domain.TimeSeries
+			deleted bool
+		)
+
+		// Collect time series and filter samples by from/to range
+		s.withSeries(id, func(ms *memSeries) {
+			ts.Samples = ms.samples(headFromMs, toMs)
+			deleted = len(ms.tombstones) > 0
+		})
+
+		if len(fromBlocks) > 0 {
+			if i, ok := fromBlocks[domain.LabelsKey(s.sortedLabels(id))]; ok {
+				timeSeries[i].Samples = append(timeSeries[i].Samples, ts.Samples...)
 
-				break
+				continue
 			}
 		}
-		if skip {
-			// Skip current id as NEQ label mismatched
+
+		if len(ts.Samples) == 0 && deleted {
+			// Deleted within the range
 			continue
 		}
-
-		var ts domain.TimeSeries
-
-		// Collect time series and filter samples by from/to range
-		ts.Samples = filterSamples(s.series[id], fromMs, toMs)
 		for k, v := range s.labelsByID[id] {
 			ts.Labels = append(ts.Labels, domain.Label{
 				Name:  string(k),
@@ -199,33 +371,204 @@ func (s *InMemory) Read(
 	return timeSeries
 }
 
-// findIntersection returns a slice of common elements that are both
-// in a and b slices.
-func findIntersection[T comparable](a, b []T) []T {
-	if len(a) > len(b) {
-		return findIntersection(b, a)
+// ReadChunks streams matching series, sorted by labels, with their encoded
+// chunks within the time range, chunks from blocks come first. The lock is
+// only held while a single head series is copied, so a slow consumer doesn't
+// block writes.
+func (s *InMemory) ReadChunks(
+	fromMs,
+	toMs int64,
+	labelMatchers []domain.LabelMatcher,
+	fn func(domain.ChunkedSeries) error) error {
+	matchers, err := domain.NewMatchers(labelMatchers)
+	if err != nil {
+		return err
+	}
+
+	type seriesRef struct {
+		id     seriesID
+		inHead bool
+		labels []domain.Label
+		chunks []domain.Chunk // from blocks
 	}
 
-	result := make([]T, 0)
+	var (
+		refs  []*seriesRef
+		byKey = make(map[string]*seriesRef)
+	)
+
+	s.mu.RLock()
+	fromMs = max(fromMs, s.retentionMinMs)
+	err = s.readBlocks(fromMs, toMs, matchers, func(cs domain.ChunkedSeries) error {
+		key := domain.LabelsKey(cs.Labels)
+		if ref, ok := byKey[key]; ok {
+			ref.chunks = append(ref.chunks, cs.Chunks...)
+
+			return nil
+		}
+
+		ref := &seriesRef{labels: cs.Labels, chunks: cs.Chunks}
+		byKey[key] = ref
+		refs = append(refs, ref)
+
+		return nil
+	})
+	if err != nil {
+		s.mu.RUnlock()
+
+		return err
+	}
+
+	for _, id := range s.seriesIDsForMatchers(matchers) {
+		labels := s.sortedLabels(id)
+		ref, ok := byKey[domain.LabelsKey(labels)]
+		if !ok {
+			ref = &seriesRef{labels: labels}
+			refs = append(refs, ref)
+		}
+		ref.id, ref.inHead = id, true
+	}
+	headFromMs := max(fromMs, s.headMinTimeMs)
+	s.mu.RUnlock()
+
+	slices.SortFunc(refs, func(a, b *seriesRef) int {
+		return compareLabels(a.labels, b.labels)
+	})
+
+	for _, ref := range refs {
+		chunks := ref.chunks
+		if ref.inHead {
+			s.withSeries(ref.id, func(ms *memSeries) {
+				chunks = append(chunks, ms.chunksInRange(headFromMs, toMs)...)
+			})
+		}
+
+		if len(chunks) == 0 {
+			// Deleted in the meantime or no samples within the range
+			continue
+		}
+
+		if err := fn(domain.ChunkedSeries{Labels: ref.labels, Chunks: chunks}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortedLabels returns labels of the series sorted by name.
+// Must be called under the read lock.
+func (s *InMemory) sortedLabels(id seriesID) []domain.Label {
+	labels := make([]domain.Label, 0, len(s.labelsByID[id]))
+	for k, v := range s.labelsByID[id] {
+		labels = append(labels, domain.Label{
+			Name:  string(k),
+			Value: string(v),
+		})
+	}
+
+	slices.SortFunc(labels, func(a, b domain.Label) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return labels
+}
+
+// compareLabels compares two sorted label sets the way Prometheus orders series.
+func compareLabels(a, b []domain.Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := cmp.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(len(a), len(b))
+}
+
+// seriesIDsForMatchers returns sorted ids of the series that satisfy all the
+// given matchers. It follows Prometheus semantics: a missing label is treated
+// as an empty value, so matchers that accept "" also select series without
+// the label. Must be called under the read lock.
+func (s *InMemory) seriesIDsForMatchers(matchers []*domain.Matcher) []seriesID {
+	if len(matchers) == 0 {
+		return nil
+	}
+
+	var (
+		// Lists of ids to intersect
+		included []postings.List
+		// Lists of ids to subtract from the intersection
+		excluded []postings.List
+	)
+
+	for _, m := range matchers {
+		if m.Matches("") {
+			// The matcher selects series without the label too, so it's
+			// cheaper to remove the series whose value is rejected
+			excluded = append(excluded, s.postingsForMatcher(m.Inverse()))
+
+			continue
+		}
+
+		ids := s.postingsForMatcher(m)
+		if len(ids) == 0 {
+			// No matching values - abort further checking
+			return nil
+		}
+
+		included = append(included, ids)
+	}
+
+	// Every matcher accepts an empty value, start from all series
+	if len(included) == 0 {
+		included = append(included, s.allPostings.List())
+	}
+
+	// Never hand out lists owned by the index, they change with it
+	return slices.Clone(postings.Subtract(postings.Intersect(included...), excluded...))
+}
+
+// postingsForMatcher returns ids of the series that have the matcher's label
+// set to a value accepted by the matcher. Must be called under the read lock.
+func (s *InMemory) postingsForMatcher(m *domain.Matcher) postings.List {
+	values, ok := s.invertedIndex[lableName(m.Name)]
+	if !ok {
+		return nil
+	}
+
+	// Fast path: exact value lookup
+	if m.Type == domain.EQ {
+		if p, ok := values[labelValue(m.Value)]; ok {
+			return p.List()
+		}
+
+		return nil
+	}
+
+	// Fast path: regexp is a set of literals, resolve it from the index directly
+	if set := m.SetMatches(); set != nil {
+		lists := make([]postings.List, 0, len(set))
+		for _, v := range set {
+			if p, ok := values[labelValue(v)]; ok {
+				lists = append(lists, p.List())
+			}
+		}
 
-	// Build a map from the longer slice so we
-	// can check which elements are in A and B slices
-	mappingA := make(map[T]struct{})
-	for _, el := range a {
-		mappingA[el] = struct{}{}
+		return postings.Union(lists...)
 	}
 
-	// Traverse each element in the shortest slice and
-	// check wether it contains in A mapping
-	for _, el := range b {
-		_, ok := mappingA[el]
-		if ok {
-			// Add common element to the result
-			result = append(result, el)
+	// Slow path: check every known value of the label
+	lists := make([]postings.List, 0)
+	for v, p := range values {
+		if m.Matches(string(v)) {
+			lists = append(lists, p.List())
 		}
 	}
 
-	return result
+	return postings.Union(lists...)
 }
 
 func filterSamples(samples []domain.Sample, fromMs, toMs int64) []domain.Sample {
@@ -1,15 +1,17 @@
 package storage
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
 	"github.com/dstdfx/mini-tsdb/internal/domain"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestInMemory_BuildHash(t *testing.T) {
-	s := NewInMemory()
+	s := NewInMemory(Opts{})
 
 	labels := []domain.Label{
 		{
@@ -35,58 +37,6 @@ func TestInMemory_BuildHash(t *testing.T) {
 	assert.Equal(t, expected, got)
 }
 
-func TestFindIntersection(t *testing.T) {
-	tableTest := []struct {
-		msg      string
-		a        []int
-		b        []int
-		expected []int
-	}{
-		{
-			msg:      "empty values",
-			a:        []int{},
-			b:        []int{},
-			expected: []int{},
-		},
-		{
-			msg:      "equal slices",
-			a:        []int{1, 2, 3},
-			b:        []int{1, 2, 3},
-			expected: []int{1, 2, 3},
-		},
-		{
-			msg:      "with intersection, len(a) > len(b)",
-			a:        []int{1, 2, 3, 4},
-			b:        []int{1, 2, 3},
-			expected: []int{1, 2, 3},
-		},
-		{
-			msg:      "with intersection, len(a) < len(b)",
-			a:        []int{1, 2, 3},
-			b:        []int{1, 2, 3, 4},
-			expected: []int{1, 2, 3},
-		},
-		{
-			msg:      "no intersection, len(a) > len(b)",
-			a:        []int{5, 6, 7, 8},
-			b:        []int{1, 2, 3},
-			expected: []int{},
-		},
-		{
-			msg:      "no intersection, len(a) < len(b)",
-			a:        []int{1, 2, 3},
-			b:        []int{5, 6, 7, 8},
-			expected: []int{},
-		},
-	}
-
-	for _, test := range tableTest {
-		t.Run(test.msg, func(t *testing.T) {
-			assert.Equal(t, test.expected, findIntersection(test.a, test.b))
-		})
-	}
-}
-
 func TestInMemory_Write_Read(t *testing.T) {
 	type (
 		expected struct {
@@ -347,7 +297,7 @@ func TestInMemory_Write_Read(t *testing.T) {
 
 	for _, test := range tableTest {
 		t.Run(test.msg, func(t *testing.T) {
-			s := NewInMemory()
+			s := NewInMemory(Opts{})
 
 			// Write data
 			for _, w := range test.writes {
@@ -553,3 +503,374 @@ func BenchmarkFilterSamples(b *testing.B) {
 		_ = filterSamples(samples, from, to)
 	}
 }
+
+func TestInMemory_Read_Matchers(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed postings %t", compress), func(t *testing.T) {
+			testReadMatchers(t, NewInMemory(Opts{CompressPostings: compress}))
+		})
+	}
+}
+
+func testReadMatchers(t *testing.T, s *InMemory) {
+	samples := []domain.Sample{
+		{
+			Timestamp: 1,
+			Value:     1,
+		},
+	}
+
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "api"},
+		{Name: "env", Value: "prod"},
+	}, samples)
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "web"},
+	}, samples)
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "worker"},
+		{Name: "env", Value: "dev"},
+	}, samples)
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}, samples)
+
+	tableTest := []struct {
+		msg      string
+		matchers []domain.LabelMatcher
+		expected []string // expected values of "job" label in the result
+	}{
+		{
+			msg: "regexp is anchored",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.RE, Name: "job", Value: "w"},
+			},
+			expected: []string{},
+		},
+		{
+			msg: "regexp",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.RE, Name: "job", Value: "w.*"},
+			},
+			expected: []string{"web", "worker"},
+		},
+		{
+			msg: "regexp set of literals",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.RE, Name: "job", Value: "api|worker|unknown"},
+			},
+			expected: []string{"api", "worker", "api"},
+		},
+		{
+			msg: "negative regexp",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.NRE, Name: "job", Value: "w.*"},
+			},
+			expected: []string{"api"},
+		},
+		{
+			msg: "negative regexp only",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.NRE, Name: "__name__", Value: "http_.*"},
+			},
+			expected: []string{"api"},
+		},
+		{
+			msg: "not equal selects series without the label",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.NEQ, Name: "env", Value: "prod"},
+			},
+			expected: []string{"web", "worker"},
+		},
+		{
+			msg: "empty value selects series without the label",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.EQ, Name: "env", Value: ""},
+			},
+			expected: []string{"web"},
+		},
+		{
+			msg: "not empty value selects series with the label",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.NEQ, Name: "env", Value: ""},
+			},
+			expected: []string{"api", "worker"},
+		},
+		{
+			msg: "regexp matching empty value",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "http_requests_total"},
+				{Type: domain.RE, Name: "env", Value: "dev|"},
+			},
+			expected: []string{"web", "worker"},
+		},
+		{
+			msg: "invalid regexp",
+			matchers: []domain.LabelMatcher{
+				{Type: domain.RE, Name: "job", Value: "(api"},
+			},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tableTest {
+		t.Run(test.msg, func(t *testing.T) {
+			got := s.Read(0, 10, test.matchers)
+
+			jobs := make([]string, 0, len(got))
+			for _, ts := range got {
+				for _, l := range ts.Labels {
+					if l.Name == "job" {
+						jobs = append(jobs, l.Value)
+					}
+				}
+			}
+
+			assert.Equal(t, test.expected, jobs)
+		})
+	}
+}
+
+func TestInMemory_Read_AcrossChunks(t *testing.T) {
+	s := NewInMemory(Opts{})
+
+	labels := []domain.Label{
+		{
+			Name:  "__name__",
+			Value: "up",
+		},
+	}
+
+	// Write enough samples to cut several chunks, in a few batches
+	const total = 1000
+	written := make([]domain.Sample, 0, total)
+	for i := 0; i < total; i++ {
+		written = append(written, domain.Sample{
+			Timestamp: int64(i * 15_000),
+			Value:     float64(i % 7),
+		})
+	}
+	for i := 0; i < total; i += 100 {
+		s.Write(labels, written[i:i+100])
+	}
+
+	matchers := []domain.LabelMatcher{
+		{
+			Type:  domain.EQ,
+			Name:  "__name__",
+			Value: "up",
+		},
+	}
+
+	got := s.Read(0, int64(total*15_000), matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, written, got[0].Samples)
+	}
+
+	got = s.Read(written[250].Timestamp, written[700].Timestamp, matchers)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, written[250:701], got[0].Samples)
+	}
+}
+
+func TestInMemory_Write_OutOfOrder(t *testing.T) {
+	labels := []domain.Label{
+		{
+			Name:  "__name__",
+			Value: "up",
+		},
+	}
+
+	samples := func(ts ...int64) []domain.Sample {
+		result := make([]domain.Sample, 0, len(ts))
+		for _, t := range ts {
+			result = append(result, domain.Sample{Timestamp: t, Value: float64(t)})
+		}
+
+		return result
+	}
+
+	testCases := []struct {
+		name             string
+		opts             Opts
+		batches          [][]domain.Sample
+		expectedSamples  []domain.Sample
+		expectedStored   int
+		expectedRejected uint64
+	}{
+		{
+			name: "reject out of order",
+			opts: Opts{},
+			batches: [][]domain.Sample{
+				samples(10, 20, 30),
+				samples(15, 25, 40),
+			},
+			expectedSamples:  samples(10, 20, 30, 40),
+			expectedStored:   4,
+			expectedRejected: 2,
+		},
+		{
+			name: "insert within the window",
+			opts: Opts{OutOfOrderWindow: 10 * time.Millisecond},
+			batches: [][]domain.Sample{
+				samples(10, 20, 30),
+				samples(15, 25, 40),
+				samples(29, 35),
+			},
+			expectedSamples:  samples(10, 20, 25, 30, 35, 40),
+			expectedStored:   6,
+			expectedRejected: 2,
+		},
+		{
+			name: "last write wins",
+			opts: Opts{OutOfOrderWindow: time.Second},
+			batches: [][]domain.Sample{
+				samples(10, 20, 30),
+				{{Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}},
+			},
+			expectedSamples: []domain.Sample{{Timestamp: 10, Value: 10}, {Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}},
+			expectedStored:  5,
+		},
+		{
+			name: "first write wins",
+			opts: Opts{OutOfOrderWindow: time.Second, DuplicatePolicy: domain.FirstWriteWins},
+			batches: [][]domain.Sample{
+				samples(10, 20, 30),
+				{{Timestamp: 20, Value: 2}, {Timestamp: 30, Value: 3}},
+			},
+			expectedSamples: samples(10, 20, 30),
+			expectedStored:  3,
+		},
+		{
+			name: "duplicates of the latest sample without the window",
+			opts: Opts{},
+			batches: [][]domain.Sample{
+				samples(10, 20, 30),
+				{{Timestamp: 30, Value: 3}},
+			},
+			expectedSamples: []domain.Sample{{Timestamp: 10, Value: 10}, {Timestamp: 20, Value: 20}, {Timestamp: 30, Value: 3}},
+			expectedStored:  4,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewInMemory(tc.opts)
+			var stored int
+			for _, batch := range tc.batches {
+				stored += s.WriteMultiple([]domain.TimeSeries{{Labels: labels, Samples: batch}})
+			}
+
+			got := s.Read(0, 100, []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}})
+			if assert.Len(t, got, 1) {
+				assert.Equal(t, tc.expectedSamples, got[0].Samples)
+			}
+			assert.Equal(t, tc.expectedStored, stored)
+			assert.Equal(t, tc.expectedRejected, s.RejectedSamples(labels))
+		})
+	}
+}
+
+func TestInMemory_Write_OutOfOrder_AcrossChunks(t *testing.T) {
+	s := NewInMemory(Opts{OutOfOrderWindow: time.Hour})
+
+	labels := []domain.Label{
+		{
+			Name:  "__name__",
+			Value: "up",
+		},
+	}
+
+	// Even timestamps first, then odd ones fill the gaps in every chunk
+	const total = 1000
+	var even, odd, expected []domain.Sample
+	for i := 0; i < total; i++ {
+		sample := domain.Sample{Timestamp: int64(i), Value: float64(i)}
+		if i%2 == 0 {
+			even = append(even, sample)
+		} else {
+			odd = append(odd, sample)
+		}
+		expected = append(expected, sample)
+	}
+
+	s.Write(labels, even)
+	s.Write(labels, odd)
+
+	got := s.Read(0, total, []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}})
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, expected, got[0].Samples)
+	}
+
+	// No chunk outgrows the limit
+	for _, ms := range s.headSeries() {
+		for _, c := range ms.allChunks() {
+			assert.LessOrEqual(t, c.NumSamples(), chunk.MaxSamples)
+		}
+	}
+}
+
+func TestInMemory_ReadChunks(t *testing.T) {
+	s := NewInMemory(Opts{})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}}
+	up2 := []domain.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}}
+
+	written := make([]domain.Sample, 0, 300)
+	for i := 0; i < 300; i++ {
+		written = append(written, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+	s.Write(up, written)
+	s.Write(up2, written[:10])
+
+	var got []domain.ChunkedSeries
+	err := s.ReadChunks(100, 250, []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+		func(series domain.ChunkedSeries) error {
+			got = append(got, series)
+
+			return nil
+		})
+	assert.NoError(t, err)
+
+	// up2 has no samples within the range, up comes sorted by labels
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}}, got[0].Labels)
+
+		var samples []domain.Sample
+		for _, c := range got[0].Chunks {
+			decoded, err := chunk.FromBytes(c.Data)
+			if assert.NoError(t, err) {
+				assert.Equal(t, c.MinTimeMs, decoded.MinTime())
+				assert.Equal(t, c.MaxTimeMs, decoded.MaxTime())
+
+				chunkSamples, err := decoded.Samples()
+				assert.NoError(t, err)
+				samples = append(samples, chunkSamples...)
+			}
+		}
+		assert.Equal(t, written[100:251], samples)
+	}
+
+	// Series come sorted by labels
+	got = nil
+	err = s.ReadChunks(0, 300, []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+		func(series domain.ChunkedSeries) error {
+			got = append(got, series)
+
+			return nil
+		})
+	assert.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, "a", got[0].Labels[1].Value)
+		assert.Equal(t, "b", got[1].Labels[1].Value)
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons of discarded samples.
+const (
+	reasonMaxSeries              = "max_series"
+	reasonMaxSeriesPerMetric     = "max_series_per_metric"
+	reasonMaxLabelNamesPerSeries = "max_label_names_per_series"
+	reasonMaxLabelValueLength    = "max_label_value_length"
+)
+
+// Limits protect the head from a cardinality explosion, zero disables
+// a limit.
+type Limits struct {
+	// MaxSeries is the maximum number of series in the head.
+	MaxSeries int
+	// MaxSeriesPerMetric is the maximum number of series in the head with
+	// the same metric name.
+	MaxSeriesPerMetric int
+	// MaxLabelNamesPerSeries is the maximum number of labels of a series,
+	// including the metric name.
+	MaxLabelNamesPerSeries int
+	// MaxLabelValueLength is the maximum length of a label value in bytes.
+	MaxLabelValueLength int
+}
+
+// newDiscardedSamples creates the counter of samples discarded for exceeding
+// the limits, it's only registered if reg is not nil.
+func newDiscardedSamples(reg prometheus.Registerer) *prometheus.CounterVec {
+	discarded := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "minitsdb_discarded_samples_total",
+		Help: "Total number of samples discarded for exceeding the cardinality limits.",
+	}, []string{"reason"})
+
+	// Export all the reasons right away
+	for _, reason := range []string{
+		reasonMaxSeries, reasonMaxSeriesPerMetric, reasonMaxLabelNamesPerSeries, reasonMaxLabelValueLength,
+	} {
+		discarded.WithLabelValues(reason)
+	}
+
+	return discarded
+}
+
+// ApplyLimits returns the series that can be written without exceeding the
+// limits, the rest are dropped and their samples are counted as discarded.
+// The error describes the first dropped series. It's only a check, concurrent
+// writes of new series may exceed the series limits by the number of series
+// they create.
+func (s *InMemory) ApplyLimits(series []domain.TimeSeries) ([]domain.TimeSeries, error) {
+	if s.limits == (Limits{}) {
+		return series, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		accepted  = make([]domain.TimeSeries, 0, len(series))
+		created   = make(map[labelsHash]struct{})
+		perMetric = make(map[string]int)
+		dropped   int
+		firstErr  error
+	)
+	for _, ts := range series {
+		reason, err := s.checkLimits(ts, created, perMetric)
+		if err == nil {
+			accepted = append(accepted, ts)
+
+			continue
+		}
+
+		s.discardedSamples.WithLabelValues(reason).Add(float64(len(ts.Samples)))
+		dropped++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return accepted, fmt.Errorf("dropped %d of %d series: %w", dropped, len(series), firstErr)
+	}
+
+	return accepted, nil
+}
+
+// checkLimits returns the reason and the error of the first limit the series
+// exceeds. New series accepted so far are tracked in created and perMetric.
+// Must be called under the read lock.
+func (s *InMemory) checkLimits(
+	ts domain.TimeSeries,
+	created map[labelsHash]struct{},
+	perMetric map[string]int) (string, error) {
+	if limit := s.limits.MaxLabelNamesPerSeries; limit > 0 && len(ts.Labels) > limit {
+		return reasonMaxLabelNamesPerSeries, fmt.Errorf(
+			"%w: series of metric %q has %d label names, the limit is %d",
+			domain.ErrInvalidSeries, metricName(ts.Labels), len(ts.Labels), limit)
+	}
+
+	if limit := s.limits.MaxLabelValueLength; limit > 0 {
+		for _, l := range ts.Labels {
+			if len(l.Value) > limit {
+				return reasonMaxLabelValueLength, fmt.Errorf(
+					"%w: value of label %q of metric %q is %d bytes long, the limit is %d",
+					domain.ErrInvalidSeries, l.Name, metricName(ts.Labels), len(l.Value), limit)
+			}
+		}
+	}
+
+	if s.limits.MaxSeries <= 0 && s.limits.MaxSeriesPerMetric <= 0 {
+		return "", nil
+	}
+
+	hash := s.buildLabelsHash(ts.Labels)
+	if _, ok := s.stripeByHash(hash).hashes[hash]; ok {
+		return "", nil
+	}
+	if _, ok := created[hash]; ok {
+		return "", nil
+	}
+
+	name := metricName(ts.Labels)
+	if limit := s.limits.MaxSeries; limit > 0 && s.allPostings.Len()+len(created) >= limit {
+		return reasonMaxSeries, fmt.Errorf(
+			"%w: series limit of %d exceeded by a new series of metric %q",
+			domain.ErrTooManySeries, limit, name)
+	}
+
+	if limit := s.limits.MaxSeriesPerMetric; limit > 0 && s.metricSeries(name)+perMetric[name] >= limit {
+		return reasonMaxSeriesPerMetric, fmt.Errorf(
+			"%w: metric %q exceeds the limit of %d series per metric",
+			domain.ErrTooManySeries, name, limit)
+	}
+
+	created[hash] = struct{}{}
+	perMetric[name]++
+
+	return "", nil
+}
+
+// metricSeries returns the number of the head series of the metric.
+// Must be called under the read lock.
+func (s *InMemory) metricSeries(name string) int {
+	p, ok := s.invertedIndex["__name__"][labelValue(name)]
+	if !ok {
+		return 0
+	}
+
+	return p.Len()
+}
+
+// metricName returns the value of the metric name label.
+func metricName(labels []domain.Label) string {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+
+	return ""
+}
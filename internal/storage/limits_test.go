@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_ApplyLimits(t *testing.T) {
+	series := func(name string, instances ...int) []domain.TimeSeries {
+		var result []domain.TimeSeries
+		for _, i := range instances {
+			result = append(result, domain.TimeSeries{
+				Labels: []domain.Label{
+					{Name: "__name__", Value: name},
+					{Name: "instance", Value: fmt.Sprint(i)},
+				},
+				Samples: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+			})
+		}
+
+		return result
+	}
+
+	testCases := []struct {
+		name           string
+		limits         Limits
+		series         []domain.TimeSeries
+		expectedSeries []domain.TimeSeries
+		expectedErr    error
+		expectedMsg    string
+		expectedReason string
+	}{
+		{
+			name:           "no limits",
+			series:         series("up", 1, 2, 3, 4),
+			expectedSeries: series("up", 1, 2, 3, 4),
+		},
+		{
+			name:           "existing series",
+			limits:         Limits{MaxSeries: 2, MaxSeriesPerMetric: 1},
+			series:         series("up", 0),
+			expectedSeries: series("up", 0),
+		},
+		{
+			name:           "duplicate new series",
+			limits:         Limits{MaxSeries: 3},
+			series:         series("up", 1, 1),
+			expectedSeries: series("up", 1, 1),
+		},
+		{
+			name:           "max series",
+			limits:         Limits{MaxSeries: 2},
+			series:         append(series("up", 0, 1), series("http_requests_total", 0)...),
+			expectedSeries: series("up", 0, 1),
+			expectedErr:    domain.ErrTooManySeries,
+			expectedMsg:    `dropped 1 of 3 series: too many series: series limit of 2 exceeded by a new series of metric "http_requests_total"`,
+			expectedReason: reasonMaxSeries,
+		},
+		{
+			name:           "max series per metric",
+			limits:         Limits{MaxSeriesPerMetric: 2},
+			series:         append(series("http_requests_total", 0, 1), series("up", 1, 2)...),
+			expectedSeries: append(series("http_requests_total", 0, 1), series("up", 1)...),
+			expectedErr:    domain.ErrTooManySeries,
+			expectedMsg:    `dropped 1 of 4 series: too many series: metric "up" exceeds the limit of 2 series per metric`,
+			expectedReason: reasonMaxSeriesPerMetric,
+		},
+		{
+			name:           "max label names per series",
+			limits:         Limits{MaxLabelNamesPerSeries: 1},
+			series:         series("up", 0),
+			expectedErr:    domain.ErrInvalidSeries,
+			expectedSeries: []domain.TimeSeries{},
+			expectedMsg:    `dropped 1 of 1 series: invalid series: series of metric "up" has 2 label names, the limit is 1`,
+			expectedReason: reasonMaxLabelNamesPerSeries,
+		},
+		{
+			name:   "max label value length",
+			limits: Limits{MaxLabelValueLength: 8},
+			series: []domain.TimeSeries{{
+				Labels: []domain.Label{
+					{Name: "__name__", Value: "up"},
+					{Name: "request_id", Value: strings.Repeat("f", 16)},
+				},
+				Samples: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+			}},
+			expectedErr:    domain.ErrInvalidSeries,
+			expectedSeries: []domain.TimeSeries{},
+			expectedMsg:    `dropped 1 of 1 series: invalid series: value of label "request_id" of metric "up" is 16 bytes long, the limit is 8`,
+			expectedReason: reasonMaxLabelValueLength,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			s := NewInMemory(Opts{Limits: tc.limits, Registerer: reg})
+			s.WriteMultiple(series("up", 0))
+
+			accepted, err := s.ApplyLimits(tc.series)
+			assert.Equal(t, tc.expectedSeries, accepted)
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+				assert.Equal(t, 4, testutil.CollectAndCount(reg, "minitsdb_discarded_samples_total"))
+				assert.Zero(t, testutil.ToFloat64(s.discardedSamples.WithLabelValues(reasonMaxSeries)))
+
+				return
+			}
+
+			require.ErrorIs(t, err, tc.expectedErr)
+			assert.EqualError(t, err, tc.expectedMsg)
+
+			// Only samples of the dropped series are discarded
+			assert.Equal(t, float64(2*(len(tc.series)-len(accepted))),
+				testutil.ToFloat64(s.discardedSamples.WithLabelValues(tc.expectedReason)))
+		})
+	}
+}
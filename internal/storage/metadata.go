@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"math"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// LabelNames returns sorted names of the labels of the series that match the
+// matchers and have samples within the time range. No matchers select every
+// series.
+func (s *InMemory) LabelNames(fromMs, toMs int64, labelMatchers []domain.LabelMatcher) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(labelMatchers) == 0 && unbounded(fromMs, toMs) && len(s.tombstoned) == 0 && len(s.blocks) == 0 {
+		// Fast path: the inverted index has all the names
+		names := make([]string, 0, len(s.invertedIndex))
+		for name := range s.invertedIndex {
+			names = append(names, string(name))
+		}
+		slices.Sort(names)
+
+		return names
+	}
+
+	fromMs = max(fromMs, s.retentionMinMs)
+	ids, ok := s.selectSeries(fromMs, toMs, labelMatchers)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[lableName]struct{})
+	for _, id := range ids {
+		for name := range s.labelsByID[id] {
+			seen[name] = struct{}{}
+		}
+	}
+	for _, labels := range s.blockSeries(fromMs, toMs, labelMatchers) {
+		for _, l := range labels {
+			seen[lableName(l.Name)] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, string(name))
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// LabelValues returns sorted values of the label among the series that match
+// the matchers and have samples within the time range. No matchers select
+// every series.
+func (s *InMemory) LabelValues(name string, fromMs, toMs int64, labelMatchers []domain.LabelMatcher) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(labelMatchers) == 0 && unbounded(fromMs, toMs) && len(s.tombstoned) == 0 && len(s.blocks) == 0 {
+		// Fast path: the inverted index has all the values
+		values := make([]string, 0, len(s.invertedIndex[lableName(name)]))
+		for value := range s.invertedIndex[lableName(name)] {
+			values = append(values, string(value))
+		}
+		slices.Sort(values)
+
+		return values
+	}
+
+	fromMs = max(fromMs, s.retentionMinMs)
+	ids, ok := s.selectSeries(fromMs, toMs, labelMatchers)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[labelValue]struct{})
+	for _, id := range ids {
+		if value, ok := s.labelsByID[id][lableName(name)]; ok {
+			seen[value] = struct{}{}
+		}
+	}
+	for _, labels := range s.blockSeries(fromMs, toMs, labelMatchers) {
+		for _, l := range labels {
+			if l.Name == name {
+				seen[labelValue(l.Value)] = struct{}{}
+			}
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for value := range seen {
+		values = append(values, string(value))
+	}
+	slices.Sort(values)
+
+	return values
+}
+
+// Series returns label sets of the series that match the matchers and have
+// samples within the time range, sorted by labels.
+func (s *InMemory) Series(fromMs, toMs int64, labelMatchers []domain.LabelMatcher) [][]domain.Label {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fromMs = max(fromMs, s.retentionMinMs)
+	ids, ok := s.selectSeries(fromMs, toMs, labelMatchers)
+	if !ok {
+		return nil
+	}
+
+	result := make([][]domain.Label, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.sortedLabels(id))
+	}
+	result = append(result, s.blockSeries(fromMs, toMs, labelMatchers)...)
+
+	// A series may be both in blocks and in the head
+	slices.SortFunc(result, compareLabels)
+
+	return slices.CompactFunc(result, func(a, b []domain.Label) bool {
+		return compareLabels(a, b) == 0
+	})
+}
+
+// selectSeries returns ids of the series that match the matchers and have
+// chunks overlapping with the time range that are not entirely deleted, no
+// matchers select every series.
+// It reports false if the matchers are invalid.
+// Must be called under the read lock.
+func (s *InMemory) selectSeries(fromMs, toMs int64, labelMatchers []domain.LabelMatcher) ([]seriesID, bool) {
+	var ids []seriesID
+	if len(labelMatchers) == 0 {
+		ids = slices.Clone(s.allPostings.List())
+	} else {
+		matchers, err := domain.NewMatchers(labelMatchers)
+		if err != nil {
+			// Invalid matchers can't select anything
+			return nil, false
+		}
+
+		ids = s.seriesIDsForMatchers(matchers)
+	}
+
+	if unbounded(fromMs, toMs) && len(s.tombstoned) == 0 && len(s.blocks) == 0 {
+		return ids, true
+	}
+
+	// Older samples of the head are already in blocks
+	fromMs = max(fromMs, s.headMinTimeMs)
+
+	return slices.DeleteFunc(ids, func(id seriesID) bool {
+		var overlaps bool
+		s.withSeries(id, func(ms *memSeries) {
+			overlaps = ms.overlaps(fromMs, toMs)
+		})
+
+		return !overlaps
+	}), true
+}
+
+// unbounded reports whether the time range covers all the possible samples.
+func unbounded(fromMs, toMs int64) bool {
+	return fromMs == math.MinInt64 && toMs == math.MaxInt64
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemory_Metadata(t *testing.T) {
+	s := NewInMemory(Opts{})
+
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+		{Name: "instance", Value: "1"},
+	}, []domain.Sample{{Timestamp: 100, Value: 1}})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "db"},
+	}, []domain.Sample{{Timestamp: 200, Value: 1}})
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "requests_total"},
+		{Name: "job", Value: "api"},
+		{Name: "path", Value: "/"},
+	}, []domain.Sample{{Timestamp: 300, Value: 1}})
+
+	const (
+		minTime = math.MinInt64
+		maxTime = math.MaxInt64
+	)
+	up := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	t.Run("label names", func(t *testing.T) {
+		assert.Equal(t, []string{"__name__", "instance", "job", "path"}, s.LabelNames(minTime, maxTime, nil))
+		assert.Equal(t, []string{"__name__", "instance", "job"}, s.LabelNames(minTime, maxTime, up))
+		assert.Equal(t, []string{"__name__", "job"}, s.LabelNames(150, 250, nil))
+		assert.Empty(t, s.LabelNames(minTime, maxTime, []domain.LabelMatcher{{Type: domain.RE, Name: "job", Value: "("}}))
+	})
+
+	t.Run("label values", func(t *testing.T) {
+		assert.Equal(t, []string{"api", "db"}, s.LabelValues("job", minTime, maxTime, nil))
+		assert.Equal(t, []string{"requests_total", "up"}, s.LabelValues("__name__", minTime, maxTime, nil))
+		assert.Equal(t, []string{"1"}, s.LabelValues("instance", minTime, maxTime, up))
+		assert.Equal(t, []string{"api"}, s.LabelValues("job", 250, maxTime, nil))
+		assert.Empty(t, s.LabelValues("missing", minTime, maxTime, nil))
+	})
+
+	t.Run("series", func(t *testing.T) {
+		assert.Equal(t, [][]domain.Label{
+			{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "1"}, {Name: "job", Value: "api"}},
+			{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}},
+		}, s.Series(minTime, maxTime, up))
+
+		assert.Equal(t, [][]domain.Label{
+			{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}},
+		}, s.Series(200, 200, up))
+
+		assert.Empty(t, s.Series(minTime, maxTime, []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "web"}}))
+	})
+}
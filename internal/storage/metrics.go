@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// headMetrics are the metrics of the in-memory head.
+type headMetrics struct {
+	seriesCreated     prometheus.Counter
+	samplesAppended   prometheus.Counter
+	outOfOrderSamples prometheus.Counter
+}
+
+// newHeadMetrics creates the head metrics, they are only registered if reg
+// is not nil. The number of series is taken from the index on scrape.
+func newHeadMetrics(reg prometheus.Registerer, s *InMemory) *headMetrics {
+	factory := promauto.With(reg)
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "minitsdb_head_series",
+		Help: "Number of series in the head.",
+	}, func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		return float64(s.allPostings.Len())
+	})
+
+	return &headMetrics{
+		seriesCreated: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_head_series_created_total",
+			Help: "Total number of series created in the head.",
+		}),
+		samplesAppended: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_head_samples_appended_total",
+			Help: "Total number of samples appended to the head.",
+		}),
+		outOfOrderSamples: factory.NewCounter(prometheus.CounterOpts{
+			Name: "minitsdb_head_out_of_order_samples_total",
+			Help: "Total number of samples rejected for being too far out of order.",
+		}),
+	}
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemory_HeadMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := NewInMemory(Opts{Registerer: reg})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "a"}}
+	s.Write(up, []domain.Sample{{Timestamp: 2, Value: 1}, {Timestamp: 3, Value: 1}})
+	s.Write(up, []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 4, Value: 1}})
+	s.WriteMultiple([]domain.TimeSeries{
+		{
+			Labels:  []domain.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "b"}},
+			Samples: []domain.Sample{{Timestamp: 1, Value: 1}},
+		},
+	})
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(s.headMetrics.seriesCreated))
+	assert.Equal(t, float64(4), testutil.ToFloat64(s.headMetrics.samplesAppended))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.headMetrics.outOfOrderSamples))
+
+	expected := `
+# HELP minitsdb_head_series Number of series in the head.
+# TYPE minitsdb_head_series gauge
+minitsdb_head_series 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "minitsdb_head_series"))
+}
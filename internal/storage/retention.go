@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// housekeepingInterval is how often samples out of retention and deleted
+// samples are removed, and the head is persisted to blocks that are
+// compacted.
+const housekeepingInterval = time.Minute
+
+// Run enforces the retention period, reclaims deleted samples, cuts and
+// compacts blocks until the context is canceled.
+func (s *InMemory) Run(ctx context.Context) {
+	ticker := time.NewTicker(housekeepingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.retention > 0 {
+				s.DeleteBefore(s.timeFn().Add(-s.retention).UnixMilli())
+			}
+			s.CleanTombstones()
+
+			if err := s.CutBlocks(); err != nil {
+				s.log.Error("failed to cut blocks", slog.Any("error", err))
+			}
+			if err := s.Compact(ctx); err != nil {
+				s.log.Error("failed to compact blocks", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// DeleteBefore removes blocks and chunks that only hold samples older than
+// mintMs and drops series that become empty from the index. A chunk that
+// spans mintMs is kept as a whole, reads filter out its older samples.
+// It returns the number of removed series of the head.
+func (s *InMemory) DeleteBefore(mintMs int64) int {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.retentionMinMs = max(s.retentionMinMs, mintMs)
+	s.deleteBlocksBefore(mintMs)
+
+	var removed int
+	for id, ms := range s.headSeries() {
+		if !ms.truncateBefore(mintMs) {
+			continue
+		}
+
+		s.deleteSeries(id)
+		removed++
+	}
+
+	return removed
+}
+
+// deleteSeries removes the series along with its index entries.
+// Must be called under the write locks of the index and the series stripe.
+func (s *InMemory) deleteSeries(id seriesID) {
+	labels := make([]domain.Label, 0, len(s.labelsByID[id]))
+	for name, value := range s.labelsByID[id] {
+		labels = append(labels, domain.Label{
+			Name:  string(name),
+			Value: string(value),
+		})
+
+		// Remove the series from the inverted index
+		p := s.invertedIndex[name][value]
+		p.Remove(id)
+
+		if p.Len() == 0 {
+			delete(s.invertedIndex[name], value)
+			if len(s.invertedIndex[name]) == 0 {
+				delete(s.invertedIndex, name)
+			}
+		}
+	}
+	s.allPostings.Remove(id)
+
+	st := s.stripeByID(id)
+	delete(st.hashes, s.buildLabelsHash(labels))
+	delete(st.series, id)
+	delete(s.labelsByID, id)
+	delete(s.tombstoned, id)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_DeleteBefore(t *testing.T) {
+	s := NewInMemory(Opts{})
+
+	old := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "old"},
+	}
+	live := []domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "live"},
+	}
+
+	// Several chunks worth of samples for the live series
+	samples := make([]domain.Sample, 0, 3*chunk.MaxSamples)
+	for i := 0; i < 3*chunk.MaxSamples; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	s.Write(old, samples[:10])
+	s.Write(live, samples)
+
+	// Drops the whole old series and the first chunk of the live one
+	mint := int64(chunk.MaxSamples + 10)
+	assert.Equal(t, 1, s.DeleteBefore(mint))
+
+	assert.Equal(t, 1, s.numSeries())
+	assert.Len(t, s.labelsByID, 1)
+	assert.Equal(t, 1, numHashes(s))
+	assert.NotContains(t, s.invertedIndex["job"], labelValue("old"))
+	assert.Equal(t, 1, s.invertedIndex["__name__"]["up"].Len())
+
+	got := s.Read(0, int64(len(samples)), []domain.LabelMatcher{
+		{Type: domain.EQ, Name: "__name__", Value: "up"},
+	})
+	if assert.Len(t, got, 1) {
+		assert.ElementsMatch(t, live, got[0].Labels)
+		// The chunk spanning mint is kept, but its older samples aren't read
+		assert.Equal(t, samples[mint:], got[0].Samples)
+	}
+
+	var chunked []domain.Sample
+	require.NoError(t, s.ReadChunks(0, int64(len(samples)), []domain.LabelMatcher{
+		{Type: domain.EQ, Name: "__name__", Value: "up"},
+	}, func(cs domain.ChunkedSeries) error {
+		decoded, err := chunk.Decode(cs.Chunks)
+		chunked = append(chunked, decoded...)
+
+		return err
+	}))
+	assert.Equal(t, samples[mint:], chunked)
+
+	// Dropped series can be written again
+	s.Write(old, samples[:1])
+	got = s.Read(0, 0, []domain.LabelMatcher{
+		{Type: domain.EQ, Name: "job", Value: "old"},
+	})
+	assert.Len(t, got, 1)
+
+	// Everything is out of retention
+	assert.Equal(t, 2, s.DeleteBefore(int64(len(samples))))
+	assert.Zero(t, s.numSeries())
+	assert.Empty(t, s.invertedIndex)
+	assert.Empty(t, s.labelsByID)
+	assert.Zero(t, numHashes(s))
+}
@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// memSeries holds compressed samples of a single series: a list of sealed
+// chunks and an open head chunk that new samples are appended to.
+type memSeries struct {
+	chunks []*chunk.XOR // sealed chunks, asc sorted by time
+	head   *chunk.XOR   // open chunk, nil until the first sample arrives
+
+	rejected uint64 // number of samples rejected for being out of order
+
+	tombstones []interval // deleted time ranges that are not reclaimed yet
+}
+
+// interval is a time range (inclusive).
+type interval struct {
+	mint, maxt int64
+}
+
+// appendOpts controls how samples that aren't newer than the latest one
+// are handled.
+type appendOpts struct {
+	oooWindowMs     int64
+	duplicatePolicy domain.DuplicatePolicy
+	minValidTimeMs  int64 // older samples are already persisted in blocks
+}
+
+// append adds samples to the head chunk, cutting a new one when it's full.
+// Samples that aren't newer than the latest one are inserted in order if they
+// fit in the out-of-order window, or rejected otherwise. Samples older than
+// the min valid time are always rejected. It returns the number of stored
+// samples, duplicates dropped by the policy aren't counted.
+func (ms *memSeries) append(samples []domain.Sample, opts appendOpts) int {
+	var appended int
+	for _, sample := range samples {
+		if sample.Timestamp < opts.minValidTimeMs {
+			ms.rejected++
+
+			continue
+		}
+
+		maxT, ok := ms.maxTime()
+		if ok && sample.Timestamp <= maxT {
+			if sample.Timestamp < maxT-opts.oooWindowMs {
+				ms.rejected++
+
+				continue
+			}
+
+			if ms.insert(sample, opts.duplicatePolicy) {
+				ms.undelete(sample.Timestamp)
+				appended++
+			}
+
+			continue
+		}
+
+		if ms.head == nil {
+			ms.head = chunk.NewXOR()
+		}
+
+		if err := ms.head.Append(sample.Timestamp, sample.Value); err == chunk.ErrFull {
+			// Seal the full head chunk and start a new one
+			ms.head.Seal()
+			ms.chunks = append(ms.chunks, ms.head)
+
+			ms.head = chunk.NewXOR()
+			_ = ms.head.Append(sample.Timestamp, sample.Value)
+		}
+		appended++
+	}
+
+	return appended
+}
+
+// maxTime returns the timestamp of the latest sample, if there's any.
+func (ms *memSeries) maxTime() (int64, bool) {
+	chunks := ms.allChunks()
+	if len(chunks) == 0 {
+		return 0, false
+	}
+
+	return chunks[len(chunks)-1].MaxTime(), true
+}
+
+// insert puts a sample that isn't newer than the latest one in its place by
+// re-encoding the chunk it belongs to. The chunk is split if it overflows.
+// It reports whether the sample is stored.
+func (ms *memSeries) insert(sample domain.Sample, policy domain.DuplicatePolicy) bool {
+	chunks := ms.allChunks()
+
+	// The first chunk that ends at or after the sample, there's always one
+	idx := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].MaxTime() >= sample.Timestamp
+	})
+
+	// Chunks are only ever built in memory, decoding them can't fail
+	decoded, _ := chunks[idx].Samples()
+
+	pos, found := slices.BinarySearchFunc(decoded, sample.Timestamp, func(s domain.Sample, t int64) int {
+		return cmp.Compare(s.Timestamp, t)
+	})
+	if found {
+		if policy == domain.FirstWriteWins {
+			return false
+		}
+		decoded[pos] = sample
+	} else {
+		decoded = slices.Insert(decoded, pos, sample)
+	}
+
+	// Re-encode, splitting into several chunks if needed
+	var rebuilt []*chunk.XOR
+	for part := range slices.Chunk(decoded, chunk.MaxSamples) {
+		c, _ := chunk.FromSamples(part)
+		rebuilt = append(rebuilt, c)
+	}
+
+	if idx < len(ms.chunks) {
+		for _, c := range rebuilt {
+			c.Seal()
+		}
+		ms.chunks = slices.Replace(ms.chunks, idx, idx+1, rebuilt...)
+
+		return true
+	}
+
+	// The head was rebuilt, the last part stays open
+	last := len(rebuilt) - 1
+	for _, c := range rebuilt[:last] {
+		c.Seal()
+		ms.chunks = append(ms.chunks, c)
+	}
+	ms.head = rebuilt[last]
+
+	return true
+}
+
+// samples decodes samples within the given time range (inclusive).
+func (ms *memSeries) samples(fromMs, toMs int64) []domain.Sample {
+	result := make([]domain.Sample, 0)
+
+	for _, c := range ms.allChunks() {
+		if c.MaxTime() < fromMs || c.MinTime() > toMs {
+			// Skip chunks that don't overlap with the range
+			continue
+		}
+
+		it := c.Iterator()
+		for it.Next() {
+			result = append(result, it.At())
+		}
+	}
+
+	return ms.filterDeleted(filterSamples(result, fromMs, toMs))
+}
+
+// chunksInRange returns encoded chunks that overlap with the given time range
+// (inclusive). Chunks sticking out of the range or holding deleted samples are
+// re-encoded with only the visible samples, the head chunk is copied as it
+// keeps changing.
+func (ms *memSeries) chunksInRange(fromMs, toMs int64) []domain.Chunk {
+	var result []domain.Chunk
+
+	for _, c := range ms.allChunks() {
+		if c.MaxTime() < fromMs || c.MinTime() > toMs {
+			// Skip chunks that don't overlap with the range
+			continue
+		}
+
+		if c.MinTime() < fromMs || c.MaxTime() > toMs || ms.hasDeleted(c.MinTime(), c.MaxTime()) {
+			samples, _ := c.Samples()
+			c, _ = chunk.FromSamples(ms.filterDeleted(filterSamples(samples, fromMs, toMs)))
+			if c.NumSamples() == 0 {
+				// The range falls between two samples or everything is deleted
+				continue
+			}
+		}
+
+		data := c.Bytes()
+		if c == ms.head {
+			data = slices.Clone(data)
+		}
+
+		result = append(result, domain.Chunk{
+			MinTimeMs: c.MinTime(),
+			MaxTimeMs: c.MaxTime(),
+			Data:      data,
+		})
+	}
+
+	return result
+}
+
+// overlaps reports whether any chunk overlaps with the given time range
+// (inclusive). Chunks are only checked against tombstones as a whole, so a
+// chunk whose samples within the range are all deleted may still count.
+func (ms *memSeries) overlaps(fromMs, toMs int64) bool {
+	for _, c := range ms.allChunks() {
+		lo, hi := max(c.MinTime(), fromMs), min(c.MaxTime(), toMs)
+		if lo <= hi && !ms.isDeleted(lo, hi) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addTombstone marks samples within the given time range (inclusive) as
+// deleted. The range is clamped to the latest sample, so samples written
+// later are not affected. It reports whether there was anything to delete.
+func (ms *memSeries) addTombstone(mintMs, maxtMs int64) bool {
+	maxT, ok := ms.maxTime()
+	if !ok {
+		return false
+	}
+	maxtMs = min(maxtMs, maxT)
+	if mintMs > maxtMs || !ms.overlaps(mintMs, maxtMs) {
+		return false
+	}
+
+	ms.tombstones = append(ms.tombstones, interval{mint: mintMs, maxt: maxtMs})
+
+	// Keep the intervals sorted and merged
+	slices.SortFunc(ms.tombstones, func(a, b interval) int {
+		return cmp.Compare(a.mint, b.mint)
+	})
+	merged := ms.tombstones[:1]
+	for _, t := range ms.tombstones[1:] {
+		last := &merged[len(merged)-1]
+		if t.mint <= last.maxt+1 {
+			last.maxt = max(last.maxt, t.maxt)
+
+			continue
+		}
+		merged = append(merged, t)
+	}
+	ms.tombstones = merged
+
+	return true
+}
+
+// undelete removes the timestamp from the tombstones, so a sample written
+// after a deletion isn't hidden by it.
+func (ms *memSeries) undelete(t int64) {
+	for i, d := range ms.tombstones {
+		if t < d.mint || t > d.maxt {
+			continue
+		}
+
+		var parts []interval
+		if d.mint < t {
+			parts = append(parts, interval{mint: d.mint, maxt: t - 1})
+		}
+		if t < d.maxt {
+			parts = append(parts, interval{mint: t + 1, maxt: d.maxt})
+		}
+		ms.tombstones = slices.Replace(ms.tombstones, i, i+1, parts...)
+
+		return
+	}
+}
+
+// isDeleted reports whether the whole time range (inclusive) is deleted.
+func (ms *memSeries) isDeleted(fromMs, toMs int64) bool {
+	for _, t := range ms.tombstones {
+		if t.mint <= fromMs && t.maxt >= toMs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasDeleted reports whether any part of the time range (inclusive) is deleted.
+func (ms *memSeries) hasDeleted(fromMs, toMs int64) bool {
+	for _, t := range ms.tombstones {
+		if t.mint <= toMs && t.maxt >= fromMs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterDeleted drops deleted samples in place.
+func (ms *memSeries) filterDeleted(samples []domain.Sample) []domain.Sample {
+	if len(ms.tombstones) == 0 {
+		return samples
+	}
+
+	return slices.DeleteFunc(samples, func(s domain.Sample) bool {
+		return ms.hasDeleted(s.Timestamp, s.Timestamp)
+	})
+}
+
+// cleanTombstones re-encodes chunks holding deleted samples without them and
+// forgets the tombstones. It reports whether the series has no samples left.
+func (ms *memSeries) cleanTombstones() bool {
+	var (
+		chunks []*chunk.XOR
+		head   *chunk.XOR
+	)
+	for _, c := range ms.allChunks() {
+		if !ms.hasDeleted(c.MinTime(), c.MaxTime()) {
+			if c == ms.head {
+				head = c
+			} else {
+				chunks = append(chunks, c)
+			}
+
+			continue
+		}
+
+		samples, _ := c.Samples()
+		samples = ms.filterDeleted(samples)
+		if len(samples) == 0 {
+			continue
+		}
+
+		rebuilt, _ := chunk.FromSamples(samples)
+		if c == ms.head {
+			head = rebuilt
+		} else {
+			rebuilt.Seal()
+			chunks = append(chunks, rebuilt)
+		}
+	}
+
+	ms.chunks, ms.head = chunks, head
+	ms.tombstones = nil
+
+	return len(ms.chunks) == 0 && (ms.head == nil || ms.head.NumSamples() == 0)
+}
+
+// allChunks returns sealed chunks followed by the head chunk.
+func (ms *memSeries) allChunks() []*chunk.XOR {
+	if ms.head == nil || ms.head.NumSamples() == 0 {
+		return ms.chunks
+	}
+
+	return append(ms.chunks[:len(ms.chunks):len(ms.chunks)], ms.head)
+}
+
+// truncateBefore drops chunks that only hold samples older than mintMs.
+// It reports whether the series has no samples left.
+func (ms *memSeries) truncateBefore(mintMs int64) bool {
+	drop := 0
+	for drop < len(ms.chunks) && ms.chunks[drop].MaxTime() < mintMs {
+		drop++
+	}
+	if drop > 0 {
+		ms.chunks = slices.Delete(ms.chunks, 0, drop)
+	}
+
+	if len(ms.chunks) == 0 && ms.head != nil && ms.head.NumSamples() > 0 && ms.head.MaxTime() < mintMs {
+		ms.head = nil
+	}
+
+	return len(ms.chunks) == 0 && (ms.head == nil || ms.head.NumSamples() == 0)
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// Snapshot file layout:
+//
+//	magic (4B) | version (1B) | WAL position (varint) | number of series (uvarint) | series... | CRC32C (4B)
+//
+// Every series is written as its labels, the number of rejected samples,
+// tombstones, sealed chunks and the head chunk. Strings and chunks are
+// prefixed with their length. The checksum covers everything before it.
+const (
+	snapshotMagic   = "MTSS"
+	snapshotVersion = 1
+
+	snapshotHeaderSize = len(snapshotMagic) + 1
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotSeries is the state of a series in a snapshot.
+type snapshotSeries struct {
+	labels     []domain.Label
+	rejected   uint64
+	tombstones []interval
+	chunks     [][]byte
+	head       []byte
+}
+
+// WriteSnapshot persists the whole head to the file along with the WAL
+// position it covers, so only the WAL records after it need to be replayed.
+// The file is read back and verified before it atomically replaces the
+// previous one.
+func (s *InMemory) WriteSnapshot(path string, walPosition int64) error {
+	series := s.snapshotSeries()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	if err := writeSnapshot(f, walPosition, series); err != nil {
+		f.Close()
+
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	// The WAL covered by the snapshot is dropped once it's written, make sure
+	// it can be loaded before replacing the previous one
+	if _, _, err := readSnapshot(tmp); err != nil {
+		return fmt.Errorf("failed to verify snapshot: %w", err)
+	}
+
+	return fileutil.Replace(tmp, path)
+}
+
+// writeSnapshot encodes the snapshot followed by its checksum.
+func writeSnapshot(w io.Writer, walPosition int64, series []snapshotSeries) error {
+	crc := crc32.New(castagnoliTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	buf := append([]byte(snapshotMagic), snapshotVersion)
+	buf = binary.AppendVarint(buf, walPosition)
+	buf = binary.AppendUvarint(buf, uint64(len(series)))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+
+	for _, ss := range series {
+		buf = ss.encode(buf[:0])
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+
+	return err
+}
+
+// snapshotSeries captures the state of every series sorted by labels.
+func (s *InMemory) snapshotSeries() []snapshotSeries {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]snapshotSeries, 0, s.numSeries())
+	for id := range s.headSeries() {
+		ss := snapshotSeries{labels: s.sortedLabels(id)}
+
+		s.withSeries(id, func(ms *memSeries) {
+			ss.rejected = ms.rejected
+			ss.tombstones = slices.Clone(ms.tombstones)
+
+			// Sealed chunks never change, the head one is still appended to
+			for _, c := range ms.chunks {
+				ss.chunks = append(ss.chunks, c.Bytes())
+			}
+			if ms.head != nil && ms.head.NumSamples() > 0 {
+				ss.head = slices.Clone(ms.head.Bytes())
+			}
+		})
+
+		result = append(result, ss)
+	}
+
+	slices.SortFunc(result, func(a, b snapshotSeries) int {
+		return compareLabels(a.labels, b.labels)
+	})
+
+	return result
+}
+
+func (ss snapshotSeries) encode(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(ss.labels)))
+	for _, l := range ss.labels {
+		buf = appendBytes(buf, []byte(l.Name))
+		buf = appendBytes(buf, []byte(l.Value))
+	}
+
+	buf = binary.AppendUvarint(buf, ss.rejected)
+
+	buf = binary.AppendUvarint(buf, uint64(len(ss.tombstones)))
+	for _, t := range ss.tombstones {
+		buf = binary.AppendVarint(buf, t.mint)
+		buf = binary.AppendVarint(buf, t.maxt)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(ss.chunks)))
+	for _, c := range ss.chunks {
+		buf = appendBytes(buf, c)
+	}
+
+	return appendBytes(buf, ss.head)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+
+	return append(buf, b...)
+}
+
+// LoadSnapshot restores the head from the snapshot file and returns the WAL
+// position it covers. A snapshot of another version or with a checksum
+// mismatch is rejected without changing the head. It must be called before
+// anything is written.
+func (s *InMemory) LoadSnapshot(path string) (int64, error) {
+	walPosition, series, err := readSnapshot(path)
+	if err != nil {
+		return 0, err
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	for _, ss := range series {
+		id := s.addSeries(s.buildLabelsHash(ss.labels), ss.labels, ss.restored)
+		if len(ss.tombstones) > 0 {
+			s.tombstoned[id] = struct{}{}
+		}
+	}
+
+	return walPosition, nil
+}
+
+// restoredSeries is a decoded snapshot series along with its loaded chunks.
+type restoredSeries struct {
+	snapshotSeries
+	restored *memSeries
+}
+
+// readSnapshot reads and validates the snapshot file, decoding all the
+// chunks of its series.
+func readSnapshot(path string) (int64, []restoredSeries, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(data) < snapshotHeaderSize+crc32.Size || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, nil, errors.New("not a snapshot file")
+	}
+	if version := data[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, nil, fmt.Errorf("unsupported snapshot version %d, expected %d", version, snapshotVersion)
+	}
+
+	body, sum := data[:len(data)-crc32.Size], data[len(data)-crc32.Size:]
+	if crc32.Checksum(body, castagnoliTable) != binary.BigEndian.Uint32(sum) {
+		return 0, nil, errors.New("snapshot checksum mismatch")
+	}
+
+	walPosition, series, err := decodeSnapshot(bytes.NewReader(body[snapshotHeaderSize:]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	result := make([]restoredSeries, 0, len(series))
+	for _, ss := range series {
+		ms, err := ss.restore()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to restore series: %w", err)
+		}
+		result = append(result, restoredSeries{snapshotSeries: ss, restored: ms})
+	}
+
+	return walPosition, result, nil
+}
+
+func decodeSnapshot(r *bytes.Reader) (int64, []snapshotSeries, error) {
+	walPosition, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read wal position: %w", err)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read number of series: %w", err)
+	}
+
+	series := make([]snapshotSeries, 0, min(n, uint64(r.Len())))
+	for range n {
+		ss, err := decodeSnapshotSeries(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		series = append(series, ss)
+	}
+
+	if r.Len() > 0 {
+		return 0, nil, fmt.Errorf("unexpected %d trailing bytes", r.Len())
+	}
+
+	return walPosition, series, nil
+}
+
+func decodeSnapshotSeries(r *bytes.Reader) (snapshotSeries, error) {
+	var ss snapshotSeries
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ss, fmt.Errorf("failed to read number of labels: %w", err)
+	}
+	for range n {
+		name, err := readBytes(r)
+		if err != nil {
+			return ss, fmt.Errorf("failed to read label name: %w", err)
+		}
+		value, err := readBytes(r)
+		if err != nil {
+			return ss, fmt.Errorf("failed to read label value: %w", err)
+		}
+		ss.labels = append(ss.labels, domain.Label{Name: string(name), Value: string(value)})
+	}
+
+	if ss.rejected, err = binary.ReadUvarint(r); err != nil {
+		return ss, fmt.Errorf("failed to read rejected samples: %w", err)
+	}
+
+	if n, err = binary.ReadUvarint(r); err != nil {
+		return ss, fmt.Errorf("failed to read number of tombstones: %w", err)
+	}
+	for range n {
+		var t interval
+		if t.mint, err = binary.ReadVarint(r); err != nil {
+			return ss, fmt.Errorf("failed to read tombstone: %w", err)
+		}
+		if t.maxt, err = binary.ReadVarint(r); err != nil {
+			return ss, fmt.Errorf("failed to read tombstone: %w", err)
+		}
+		ss.tombstones = append(ss.tombstones, t)
+	}
+
+	if n, err = binary.ReadUvarint(r); err != nil {
+		return ss, fmt.Errorf("failed to read number of chunks: %w", err)
+	}
+	for range n {
+		c, err := readBytes(r)
+		if err != nil {
+			return ss, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		ss.chunks = append(ss.chunks, c)
+	}
+
+	if ss.head, err = readBytes(r); err != nil {
+		return ss, fmt.Errorf("failed to read head chunk: %w", err)
+	}
+
+	return ss, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+
+	return b, err
+}
+
+// restore loads the chunks of the series.
+func (ss snapshotSeries) restore() (*memSeries, error) {
+	ms := &memSeries{
+		rejected:   ss.rejected,
+		tombstones: ss.tombstones,
+	}
+
+	for _, b := range ss.chunks {
+		c, err := chunk.FromBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		ms.chunks = append(ms.chunks, c)
+	}
+
+	if len(ss.head) == 0 {
+		return ms, nil
+	}
+
+	// Loaded chunks are read-only, re-encode the head to keep appending to it
+	c, err := chunk.FromBytes(ss.head)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := c.Samples()
+	if err != nil {
+		return nil, err
+	}
+	if ms.head, err = chunk.FromSamples(samples); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/chunk"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "head.snapshot")
+
+	api := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	db := []domain.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "db"}}
+	up := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	// Sealed chunks along with an open head one
+	samples := make([]domain.Sample, 0, 2*chunk.MaxSamples+10)
+	for i := 0; i < 2*chunk.MaxSamples+10; i++ {
+		samples = append(samples, domain.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+
+	s := NewInMemory(Opts{})
+	s.Write(api, samples)
+	s.Write(db, samples[:10])
+	s.Write(db, []domain.Sample{{Timestamp: 0, Value: 1}})
+	_, err := s.Delete(domain.Tombstone{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		MinTimeMs: 5,
+		MaxTimeMs: math.MaxInt64,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.WriteSnapshot(path, 42))
+
+	restored := NewInMemory(Opts{})
+	position, err := restored.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), position)
+
+	// Labels of read series come in no particular order
+	all := func(s *InMemory) []domain.TimeSeries {
+		got := s.Read(math.MinInt64, math.MaxInt64, up)
+		for _, ts := range got {
+			slices.SortFunc(ts.Labels, func(a, b domain.Label) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+		}
+		slices.SortFunc(got, func(a, b domain.TimeSeries) int {
+			return compareLabels(a.Labels, b.Labels)
+		})
+
+		return got
+	}
+	assert.Equal(t, all(s), all(restored))
+	assert.Equal(t, [][]domain.Label{api, db}, restored.Series(math.MinInt64, math.MaxInt64, up))
+	assert.EqualValues(t, 1, restored.RejectedSamples(db))
+
+	// The head keeps accepting samples, deletions still apply to the old ones
+	next := domain.Sample{Timestamp: int64(len(samples)), Value: 1}
+	restored.Write(api, []domain.Sample{next})
+	restored.Write(db, []domain.Sample{next})
+
+	got := all(restored)
+	assert.Equal(t, []domain.TimeSeries{
+		{Labels: api, Samples: append(samples[:len(samples):len(samples)], next)},
+		{Labels: db, Samples: append(samples[:5:5], next)},
+	}, got)
+
+	// Deleted samples are reclaimed after the restore too
+	assert.Zero(t, restored.CleanTombstones())
+	assert.Equal(t, got, all(restored))
+}
+
+func TestInMemory_LoadSnapshot_Rejected(t *testing.T) {
+	dir := t.TempDir()
+
+	s := NewInMemory(Opts{})
+	s.Write([]domain.Label{{Name: "__name__", Value: "up"}}, []domain.Sample{{Timestamp: 1, Value: 1}})
+
+	valid := filepath.Join(dir, "valid")
+	require.NoError(t, s.WriteSnapshot(valid, 1))
+
+	data, err := os.ReadFile(valid)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		data        []byte
+		expectedErr string
+	}{
+		{
+			name:        "not a snapshot",
+			data:        []byte("MTSW\x01"),
+			expectedErr: "not a snapshot file",
+		},
+		{
+			name: "unsupported version",
+			data: func() []byte {
+				b := append([]byte(nil), data...)
+				b[4] = snapshotVersion + 1
+
+				return b
+			}(),
+			expectedErr: "unsupported snapshot version 2, expected 1",
+		},
+		{
+			name: "corrupted",
+			data: func() []byte {
+				b := append([]byte(nil), data...)
+				b[len(b)/2] ^= 0xff
+
+				return b
+			}(),
+			expectedErr: "snapshot checksum mismatch",
+		},
+		{
+			name:        "truncated",
+			data:        data[:len(data)-1],
+			expectedErr: "snapshot checksum mismatch",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "snapshot")
+			require.NoError(t, os.WriteFile(path, tc.data, 0o644))
+
+			restored := NewInMemory(Opts{})
+			_, err := restored.LoadSnapshot(path)
+			assert.EqualError(t, err, tc.expectedErr)
+			assert.Zero(t, restored.numSeries())
+		})
+	}
+
+	_, err = NewInMemory(Opts{}).LoadSnapshot(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
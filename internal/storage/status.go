@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// HeadStats returns stats of the head series that match the matchers, all of
+// them without matchers, with up to limit entries in every top list.
+func (s *InMemory) HeadStats(limit int, labelMatchers []domain.LabelMatcher) (domain.HeadStats, error) {
+	matchers, err := domain.NewMatchers(labelMatchers)
+	if err != nil {
+		return domain.HeadStats{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.allPostings.List()
+	if len(matchers) > 0 {
+		ids = s.seriesIDsForMatchers(matchers)
+	}
+
+	stats := domain.HeadStats{NumSeries: len(ids)}
+
+	// Chunks are only read under the locks of their stripes
+	first := true
+	chunkBytes := make(map[seriesID]int, len(ids))
+	for _, id := range ids {
+		s.withSeries(id, func(ms *memSeries) {
+			chunks := ms.allChunks()
+			if len(chunks) == 0 {
+				return
+			}
+			stats.NumChunks += len(chunks)
+
+			for _, c := range chunks {
+				chunkBytes[id] += c.Size()
+			}
+
+			mint, maxt := chunks[0].MinTime(), chunks[len(chunks)-1].MaxTime()
+			if first || mint < stats.MinTimeMs {
+				stats.MinTimeMs = mint
+			}
+			if first || maxt > stats.MaxTimeMs {
+				stats.MaxTimeMs = maxt
+			}
+			first = false
+		})
+	}
+
+	stats.Cardinality = s.cardinality(ids, len(matchers) == 0, chunkBytes, limit)
+
+	return stats, nil
+}
+
+// cardinality returns the top lists of the series. Series counts of the
+// whole head are taken from the inverted index, labels of the series are
+// walked otherwise. Memory of metrics is estimated from the labels and the
+// chunk bytes of their series. Must be called under the read lock.
+func (s *InMemory) cardinality(ids []seriesID, all bool, chunkBytes map[seriesID]int, limit int) domain.Cardinality {
+	// Number of series of every label pair
+	pairs := make(map[lableName]map[labelValue]int)
+	if all {
+		for name, values := range s.invertedIndex {
+			pairs[name] = make(map[labelValue]int, len(values))
+			for value, p := range values {
+				pairs[name][value] = p.Len()
+			}
+		}
+	} else {
+		for _, id := range ids {
+			for name, value := range s.labelsByID[id] {
+				if pairs[name] == nil {
+					pairs[name] = make(map[labelValue]int)
+				}
+				pairs[name][value]++
+			}
+		}
+	}
+
+	metricBytes := make(map[labelValue]int)
+	for _, id := range ids {
+		metric, ok := s.labelsByID[id]["__name__"]
+		if !ok {
+			continue
+		}
+
+		size := chunkBytes[id]
+		for name, value := range s.labelsByID[id] {
+			size += len(name) + len(value)
+		}
+		metricBytes[metric] += size
+	}
+
+	var metrics, valueCounts, pairCounts, labelBytes, metricsBytes []domain.Stat
+	for name, values := range pairs {
+		valueCounts = append(valueCounts, domain.Stat{Name: string(name), Value: len(values)})
+
+		var size int
+		for value, n := range values {
+			if name == "__name__" {
+				metrics = append(metrics, domain.Stat{Name: string(value), Value: n})
+			}
+			pairCounts = append(pairCounts, domain.Stat{Name: string(name) + "=" + string(value), Value: n})
+			size += len(value) * n
+		}
+		labelBytes = append(labelBytes, domain.Stat{Name: string(name), Value: size})
+	}
+	for name, size := range metricBytes {
+		metricsBytes = append(metricsBytes, domain.Stat{Name: string(name), Value: size})
+	}
+
+	return domain.Cardinality{
+		SeriesCountByMetricName:     topStats(metrics, limit),
+		LabelValueCountByLabelName:  topStats(valueCounts, limit),
+		SeriesCountByLabelValuePair: topStats(pairCounts, limit),
+		MemoryInBytesByLabelName:    topStats(labelBytes, limit),
+		MemoryInBytesByMetricName:   topStats(metricsBytes, limit),
+	}
+}
+
+// topStats returns up to limit stats with the highest values, ties are
+// sorted by name.
+func topStats(stats []domain.Stat, limit int) []domain.Stat {
+	slices.SortFunc(stats, func(a, b domain.Stat) int {
+		if c := cmp.Compare(b.Value, a.Value); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+
+	return stats
+}
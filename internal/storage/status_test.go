@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_HeadStats(t *testing.T) {
+	s := NewInMemory(Opts{})
+	empty, err := s.HeadStats(10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, domain.HeadStats{}, empty)
+
+	for i := 0; i < 3; i++ {
+		s.Write([]domain.Label{
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "instance", Value: fmt.Sprint(i)},
+			{Name: "job", Value: "api"},
+		}, []domain.Sample{{Timestamp: 1_000, Value: 1}})
+	}
+	s.Write([]domain.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: "0"},
+		{Name: "job", Value: "api"},
+	}, []domain.Sample{{Timestamp: 500, Value: 1}, {Timestamp: 2_000, Value: 1}})
+
+	testCases := []struct {
+		name     string
+		limit    int
+		matchers []domain.LabelMatcher
+		expected domain.HeadStats
+	}{
+		{
+			name:  "all",
+			limit: 10,
+			expected: domain.HeadStats{
+				NumSeries: 4,
+				NumChunks: 4,
+				MinTimeMs: 500,
+				MaxTimeMs: 2_000,
+				Cardinality: domain.Cardinality{
+					SeriesCountByMetricName: []domain.Stat{
+						{Name: "http_requests_total", Value: 3},
+						{Name: "up", Value: 1},
+					},
+					LabelValueCountByLabelName: []domain.Stat{
+						{Name: "instance", Value: 3},
+						{Name: "__name__", Value: 2},
+						{Name: "job", Value: 1},
+					},
+					SeriesCountByLabelValuePair: []domain.Stat{
+						{Name: "job=api", Value: 4},
+						{Name: "__name__=http_requests_total", Value: 3},
+						{Name: "instance=0", Value: 2},
+						{Name: "__name__=up", Value: 1},
+						{Name: "instance=1", Value: 1},
+						{Name: "instance=2", Value: 1},
+					},
+					MemoryInBytesByLabelName: []domain.Stat{
+						{Name: "__name__", Value: 3*19 + 2},
+						{Name: "job", Value: 4 * 3},
+						{Name: "instance", Value: 4},
+					},
+				},
+			},
+		},
+		{
+			name:  "limited",
+			limit: 1,
+			expected: domain.HeadStats{
+				NumSeries: 4,
+				NumChunks: 4,
+				MinTimeMs: 500,
+				MaxTimeMs: 2_000,
+				Cardinality: domain.Cardinality{
+					SeriesCountByMetricName:     []domain.Stat{{Name: "http_requests_total", Value: 3}},
+					LabelValueCountByLabelName:  []domain.Stat{{Name: "instance", Value: 3}},
+					SeriesCountByLabelValuePair: []domain.Stat{{Name: "job=api", Value: 4}},
+					MemoryInBytesByLabelName:    []domain.Stat{{Name: "__name__", Value: 3*19 + 2}},
+				},
+			},
+		},
+		{
+			name:     "matchers",
+			limit:    10,
+			matchers: []domain.LabelMatcher{{Type: domain.EQ, Name: "instance", Value: "0"}},
+			expected: domain.HeadStats{
+				NumSeries: 2,
+				NumChunks: 2,
+				MinTimeMs: 500,
+				MaxTimeMs: 2_000,
+				Cardinality: domain.Cardinality{
+					SeriesCountByMetricName: []domain.Stat{
+						{Name: "http_requests_total", Value: 1},
+						{Name: "up", Value: 1},
+					},
+					LabelValueCountByLabelName: []domain.Stat{
+						{Name: "__name__", Value: 2},
+						{Name: "instance", Value: 1},
+						{Name: "job", Value: 1},
+					},
+					SeriesCountByLabelValuePair: []domain.Stat{
+						{Name: "instance=0", Value: 2},
+						{Name: "job=api", Value: 2},
+						{Name: "__name__=http_requests_total", Value: 1},
+						{Name: "__name__=up", Value: 1},
+					},
+					MemoryInBytesByLabelName: []domain.Stat{
+						{Name: "__name__", Value: 19 + 2},
+						{Name: "job", Value: 2 * 3},
+						{Name: "instance", Value: 2},
+					},
+				},
+			},
+		},
+		{
+			name:     "no matching series",
+			limit:    10,
+			matchers: []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := s.HeadStats(tc.limit, tc.matchers)
+			require.NoError(t, err)
+
+			// Memory of metrics depends on the chunk encoding, check its order only
+			byMetric := got.Cardinality.MemoryInBytesByMetricName
+			got.Cardinality.MemoryInBytesByMetricName = nil
+			assert.Equal(t, tc.expected, got)
+
+			require.Len(t, byMetric, min(tc.limit, len(tc.expected.Cardinality.SeriesCountByMetricName)))
+			for i, stat := range byMetric {
+				assert.Equal(t, tc.expected.Cardinality.SeriesCountByMetricName[i].Name, stat.Name)
+				assert.Positive(t, stat.Value)
+			}
+		})
+	}
+
+	_, err = s.HeadStats(10, []domain.LabelMatcher{{Type: domain.RE, Name: "job", Value: "("}})
+	assert.Error(t, err)
+}
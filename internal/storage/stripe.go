@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"iter"
+	"sync"
+)
+
+// defaultStripes is the number of stripes the head is split into.
+const defaultStripes = 64
+
+// stripe holds the head series whose labels hash falls into it, so appends
+// to series of different stripes don't contend. Its maps only change under
+// both the index and the stripe lock, holding either one is enough to read
+// them. Samples of its series are only accessed under the stripe lock.
+type stripe struct {
+	mu     sync.RWMutex
+	series map[seriesID]*memSeries // used to map series identifier to its compressed samples
+	hashes map[labelsHash]seriesID // to check if we already had a sequence of labels before
+}
+
+func newStripes(n int) []stripe {
+	stripes := make([]stripe, n)
+	for i := range stripes {
+		stripes[i].series = make(map[seriesID]*memSeries)
+		stripes[i].hashes = make(map[labelsHash]seriesID)
+	}
+
+	return stripes
+}
+
+// stripeByHash returns the stripe of the series with the labels hash.
+func (s *InMemory) stripeByHash(hash labelsHash) *stripe {
+	return &s.stripes[uint64(hash)%uint64(len(s.stripes))]
+}
+
+// stripeByID returns the stripe of the series, ids of a stripe are equal to
+// its index modulo the number of stripes.
+func (s *InMemory) stripeByID(id seriesID) *stripe {
+	return &s.stripes[id%uint64(len(s.stripes))]
+}
+
+// nextID allocates an id for a new series with the labels hash. Ids grow
+// in the order series are created and keep the index of their stripe.
+// Must be called under the index write lock.
+func (s *InMemory) nextID(hash labelsHash) seriesID {
+	s.lastSeriesID++
+	n := uint64(len(s.stripes))
+
+	return s.lastSeriesID*n + uint64(hash)%n
+}
+
+// headSeries iterates over the series of every stripe.
+// Must be called under the index lock.
+func (s *InMemory) headSeries() iter.Seq2[seriesID, *memSeries] {
+	return func(yield func(seriesID, *memSeries) bool) {
+		for i := range s.stripes {
+			for id, ms := range s.stripes[i].series {
+				if !yield(id, ms) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// numSeries returns the number of the head series.
+// Must be called under the index lock.
+func (s *InMemory) numSeries() int {
+	var n int
+	for i := range s.stripes {
+		n += len(s.stripes[i].series)
+	}
+
+	return n
+}
+
+// withSeries calls fn with the series under the read lock of its stripe,
+// it's not called if the series doesn't exist.
+func (s *InMemory) withSeries(id seriesID, fn func(ms *memSeries)) {
+	st := s.stripeByID(id)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	if ms, ok := st.series[id]; ok {
+		fn(ms)
+	}
+}
+
+// lockAll takes the index lock and the locks of all the stripes, for
+// changes that span the whole head.
+func (s *InMemory) lockAll() {
+	s.mu.Lock()
+	for i := range s.stripes {
+		s.stripes[i].mu.Lock()
+	}
+}
+
+func (s *InMemory) unlockAll() {
+	for i := range s.stripes {
+		s.stripes[i].mu.Unlock()
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// numHashes returns the number of label hashes known to the head.
+func numHashes(s *InMemory) int {
+	var n int
+	for i := range s.stripes {
+		n += len(s.stripes[i].hashes)
+	}
+
+	return n
+}
+
+func TestInMemory_Stripes(t *testing.T) {
+	s := NewInMemory(Opts{Stripes: 4})
+
+	for i := 0; i < 100; i++ {
+		s.Write([]domain.Label{
+			{Name: "__name__", Value: "up"},
+			{Name: "instance", Value: fmt.Sprint(i)},
+		}, []domain.Sample{{Timestamp: 1, Value: 1}})
+	}
+
+	assert.Equal(t, 100, s.numSeries())
+	assert.Equal(t, 100, numHashes(s))
+
+	// Every series lives in the stripe of its id and its labels hash
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		assert.NotEmpty(t, st.series)
+
+		for hash, id := range st.hashes {
+			assert.Same(t, st, s.stripeByID(id))
+			assert.Same(t, st, s.stripeByHash(hash))
+			assert.Contains(t, st.series, id)
+		}
+	}
+}
+
+func TestInMemory_ConcurrentWrites(t *testing.T) {
+	const (
+		writers = 8
+		series  = 50
+		samples = 200
+	)
+
+	s := NewInMemory(Opts{Stripes: 4})
+	up := []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}}
+
+	var (
+		wg   sync.WaitGroup
+		done atomic.Bool
+	)
+
+	// Readers run along with the writers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for !done.Load() {
+			s.Read(math.MinInt64, math.MaxInt64, up)
+			s.Series(math.MinInt64, math.MaxInt64, up)
+		}
+	}()
+
+	var writersWg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWg.Add(1)
+		go func() {
+			defer writersWg.Done()
+
+			// Writers share the series, every one writes its own timestamps
+			for i := 0; i < samples; i++ {
+				for j := 0; j < series; j++ {
+					s.Write([]domain.Label{
+						{Name: "__name__", Value: "up"},
+						{Name: "instance", Value: fmt.Sprint(j)},
+					}, []domain.Sample{{Timestamp: int64(i*writers + w), Value: 1}})
+				}
+			}
+		}()
+	}
+	writersWg.Wait()
+	done.Store(true)
+	wg.Wait()
+
+	got := s.Read(math.MinInt64, math.MaxInt64, up)
+	require.Len(t, got, series)
+
+	// Out of order samples are rejected, but none are lost or duplicated
+	for _, ts := range got {
+		rejected := s.RejectedSamples(ts.Labels)
+		assert.Equal(t, writers*samples, len(ts.Samples)+int(rejected))
+	}
+}
+
+func BenchmarkInMemory_Write_Parallel(b *testing.B) {
+	for _, stripes := range []int{1, defaultStripes} {
+		b.Run(fmt.Sprintf("stripes=%d", stripes), func(b *testing.B) {
+			s := NewInMemory(Opts{Stripes: stripes})
+
+			const numSeries = 10_000
+			labels := make([][]domain.Label, numSeries)
+			for i := range labels {
+				labels[i] = []domain.Label{
+					{Name: "__name__", Value: "up"},
+					{Name: "instance", Value: fmt.Sprint(i)},
+				}
+			}
+
+			var ts atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.IntN(numSeries)
+				for pb.Next() {
+					s.Write(labels[i%numSeries], []domain.Sample{{Timestamp: ts.Add(1), Value: 1}})
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package wal
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+const (
+	checkpointSuffix = ".checkpoint"
+	tmpSuffix        = ".tmp"
+
+	// checkpointSeriesPerRecord limits the size of a single checkpoint record.
+	checkpointSeriesPerRecord = 1000
+)
+
+// listCheckpoints returns a sorted list (asc) of checkpoint files. A checkpoint
+// is named after the timestamp of the last partition it covers.
+func (l *wal) listCheckpoints() ([]walFile, error) {
+	entries, err := os.ReadDir(l.partitionsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]walFile, 0)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), checkpointSuffix) {
+			continue
+		}
+
+		withoutSuffix, _ := strings.CutSuffix(e.Name(), checkpointSuffix)
+		ts, err := strconv.ParseInt(withoutSuffix, 10, 64)
+		if err != nil {
+			// Skip invalid files
+			continue
+		}
+
+		files = append(files, walFile{
+			name: e.Name(),
+			ts:   ts,
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ts < files[j].ts
+	})
+
+	return files, nil
+}
+
+// latestCheckpoint returns the most recent checkpoint, if any.
+func (l *wal) latestCheckpoint() (*walFile, error) {
+	checkpoints, err := l.listCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(checkpoints) == 0 {
+		return nil, nil
+	}
+
+	return &checkpoints[len(checkpoints)-1], nil
+}
+
+// checkpointSeries accumulates the state of a single series.
+type checkpointSeries struct {
+	labels  []domain.Label
+	samples []domain.Sample
+	maxTs   int64 // timestamp of the latest accepted sample
+	seen    bool  // whether any sample is accepted
+}
+
+// add keeps the samples the head keeps: a sample that isn't newer than the
+// latest one is rejected unless it fits in the out-of-order window. Samples
+// older than mintMs are accepted, but not carried over.
+func (s *checkpointSeries) add(samples []domain.Sample, mintMs, oooWindowMs int64) {
+	for _, sample := range samples {
+		if s.seen && sample.Timestamp < s.maxTs-oooWindowMs {
+			continue
+		}
+		if !s.seen || sample.Timestamp > s.maxTs {
+			s.maxTs, s.seen = sample.Timestamp, true
+		}
+
+		if sample.Timestamp >= mintMs {
+			s.samples = append(s.samples, sample)
+		}
+	}
+}
+
+// Checkpoint compacts all the closed partitions along with the previous
+// checkpoint into a new checkpoint that holds a single deduplicated list
+// of samples per series, then deletes the files it covers. Out-of-order
+// samples and duplicates are resolved by the same rules as in the head, so
+// samples it rejected don't come back. Tombstones are applied to the samples
+// and not carried over. Replay starts
+// from the latest checkpoint and continues with the newer partitions.
+func (l *wal) Checkpoint() error {
+	l.checkpointMu.Lock()
+	defer l.checkpointMu.Unlock()
+
+	start := time.Now()
+
+	files, err := l.listWalFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list wal files: %w", err)
+	}
+
+	previous, err := l.latestCheckpoint()
+	if err != nil {
+		return fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	// Only partitions that are not written to anymore can be compacted.
+	// Close the current file if its window is over, so no append is in
+	// flight to any of the covered partitions.
+	l.mutex.Lock()
+	currentTs := l.getNextPartitionTs()
+	if l.currentFile != nil && l.currentFileTimestamp < currentTs {
+		l.closeCurrentFile()
+	}
+	l.mutex.Unlock()
+
+	covered := make([]walFile, 0, len(files))
+	for _, f := range files {
+		if f.ts >= currentTs {
+			break
+		}
+		if previous != nil && f.ts <= previous.ts {
+			// Already in the previous checkpoint, left over after a failed cleanup
+			continue
+		}
+		covered = append(covered, f)
+	}
+
+	if len(covered) == 0 {
+		return nil
+	}
+
+	// Samples out of retention are not carried over
+	mintMs := int64(math.MinInt64)
+	if l.retention > 0 {
+		mintMs = l.timeFn().Add(-l.retention).UnixMilli()
+	}
+
+	// Merge the previous checkpoint and the covered partitions
+	series := make(map[string]*checkpointSeries)
+	apply := func(e domain.WalEntity) error {
+		for _, ts := range e.TimeSeries {
+			key := domain.LabelsKey(ts.Labels)
+
+			s, ok := series[key]
+			if !ok {
+				s = &checkpointSeries{labels: ts.Labels}
+				series[key] = s
+			}
+			s.add(ts.Samples, mintMs, l.oooWindowMs)
+		}
+
+		// Deletions only affect samples written before them
+		for _, t := range e.Tombstones {
+			matchers, err := domain.NewMatchers(t.Matchers)
+			if err != nil {
+				return fmt.Errorf("failed to compile tombstone matchers: %w", err)
+			}
+
+			for _, s := range series {
+				if domain.MatchLabels(matchers, s.labels) {
+					s.samples = slices.DeleteFunc(s.samples, func(sample domain.Sample) bool {
+						return sample.Timestamp >= t.MinTimeMs && sample.Timestamp <= t.MaxTimeMs
+					})
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if previous != nil {
+		if _, err := l.streamWalFile(previous.name, apply); err != nil {
+			return fmt.Errorf("failed to read checkpoint %s: %w", previous.name, err)
+		}
+	}
+
+	for _, f := range covered {
+		if _, err := l.streamWalFile(f.name, apply); err != nil {
+			return fmt.Errorf("failed to read wal file %s: %w", f.name, err)
+		}
+	}
+
+	lastTs := covered[len(covered)-1].ts
+	name := strconv.FormatInt(lastTs, 10) + checkpointSuffix
+
+	if err := l.writeCheckpoint(name, lastTs, series); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	// The new checkpoint is durable, drop everything it covers
+	obsolete := covered
+	if checkpoints, err := l.listCheckpoints(); err == nil {
+		for _, c := range checkpoints {
+			if c.ts < lastTs {
+				obsolete = append(obsolete, c)
+			}
+		}
+	}
+	for _, f := range obsolete {
+		if err := os.Remove(filepath.Join(l.partitionsPath, f.name)); err != nil {
+			l.log.Error("failed to remove obsolete wal file",
+				slog.String("file", f.name),
+				slog.Any("error", err))
+		}
+	}
+
+	l.log.Info("wal checkpoint created",
+		slog.String("checkpoint", name),
+		slog.Int("partitions", len(covered)),
+		slog.Int("series", len(series)),
+		slog.Duration("duration", time.Since(start)))
+
+	return nil
+}
+
+// writeCheckpoint atomically writes the series state to a checkpoint file.
+func (l *wal) writeCheckpoint(name string, ts int64, series map[string]*checkpointSeries) error {
+	tmpPath := filepath.Join(l.partitionsPath, name+tmpSuffix)
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if err := writeFileHeader(bw); err != nil {
+		return err
+	}
+
+	// Write series in a stable order
+	keys := make([]string, 0, len(series))
+	for k, s := range series {
+		if len(s.samples) == 0 {
+			// Every sample is out of retention or deleted
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	enc := newEncoder()
+	for len(keys) > 0 {
+		n := min(len(keys), checkpointSeriesPerRecord)
+
+		entity := domain.WalEntity{
+			Timestamp:  ts,
+			TimeSeries: make([]domain.TimeSeries, 0, n),
+		}
+		for _, k := range keys[:n] {
+			s := series[k]
+			entity.TimeSeries = append(entity.TimeSeries, domain.TimeSeries{
+				Labels:  s.labels,
+				Samples: dedupSamples(s.samples, l.duplicatePolicy),
+			})
+		}
+		keys = keys[n:]
+
+		if _, err := bw.Write(enc.encode(entity)); err != nil {
+			return err
+		}
+		enc.commit()
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(l.partitionsPath, name)); err != nil {
+		return err
+	}
+
+	return syncDir(l.partitionsPath)
+}
+
+// dedupSamples sorts samples by timestamp and keeps a single sample for each
+// timestamp, the first or the last written one according to the policy.
+func dedupSamples(samples []domain.Sample, policy domain.DuplicatePolicy) []domain.Sample {
+	// Stable sort keeps the write order of samples with the same timestamp
+	slices.SortStableFunc(samples, func(a, b domain.Sample) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	result := samples[:0]
+	for i, s := range samples {
+		if policy == domain.FirstWriteWins {
+			if len(result) > 0 && result[len(result)-1].Timestamp == s.Timestamp {
+				// A sample is already stored for the timestamp
+				continue
+			}
+		} else if i+1 < len(samples) && samples[i+1].Timestamp == s.Timestamp {
+			// Overwritten by a later sample
+			continue
+		}
+		result = append(result, s)
+	}
+
+	return result
+}
+
+// syncDir fsyncs a directory so renames and removals in it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
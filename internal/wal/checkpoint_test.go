@@ -0,0 +1,258 @@
+package wal
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWal_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+	})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+	down := []domain.Label{{Name: "__name__", Value: "down"}}
+
+	appendSamples := func(labels []domain.Label, samples ...domain.Sample) {
+		require.NoError(t, w.Append(domain.WalEntity{
+			Timestamp: now.Unix(),
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels:  labels,
+					Samples: samples,
+				},
+			},
+		}))
+	}
+
+	// First partition
+	appendSamples(up, domain.Sample{Timestamp: 1, Value: 1}, domain.Sample{Timestamp: 2, Value: 2})
+	appendSamples(down, domain.Sample{Timestamp: 1, Value: 0})
+
+	// Second partition, with a retried batch and an overwritten sample
+	now = now.Add(30 * time.Second)
+	appendSamples(up, domain.Sample{Timestamp: 2, Value: 2}, domain.Sample{Timestamp: 3, Value: 3})
+	appendSamples(up, domain.Sample{Timestamp: 3, Value: 33})
+
+	// Third partition is the current one
+	now = now.Add(30 * time.Second)
+	appendSamples(down, domain.Sample{Timestamp: 2, Value: 0})
+
+	require.NoError(t, w.Checkpoint())
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	checkpoints, err := w.listCheckpoints()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+	assert.Less(t, checkpoints[0].ts, files[0].ts)
+
+	got, _, err := replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	// Checkpoint holds deduplicated series sorted by their labels
+	assert.ElementsMatch(t, []domain.TimeSeries{
+		{
+			Labels:  up,
+			Samples: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 33}},
+		},
+		{
+			Labels:  down,
+			Samples: []domain.Sample{{Timestamp: 1, Value: 0}},
+		},
+	}, got[0].TimeSeries)
+
+	// Followed by the current partition
+	assert.Equal(t, []domain.TimeSeries{
+		{
+			Labels:  down,
+			Samples: []domain.Sample{{Timestamp: 2, Value: 0}},
+		},
+	}, got[1].TimeSeries)
+
+	// Nothing new to checkpoint
+	require.NoError(t, w.Checkpoint())
+	checkpoints, err = w.listCheckpoints()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+
+	// Next checkpoint includes the previous one
+	now = now.Add(30 * time.Second)
+	appendSamples(up, domain.Sample{Timestamp: 4, Value: 4})
+	require.NoError(t, w.Checkpoint())
+
+	checkpoints, err = w.listCheckpoints()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 1)
+	files, err = w.listWalFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	got, _, err = replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.ElementsMatch(t, []domain.TimeSeries{
+		{
+			Labels:  up,
+			Samples: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 33}},
+		},
+		{
+			Labels:  down,
+			Samples: []domain.Sample{{Timestamp: 1, Value: 0}, {Timestamp: 2, Value: 0}},
+		},
+	}, got[0].TimeSeries)
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.NotEqual(t, tmpSuffix, filepath.Ext(e.Name()))
+	}
+}
+
+func TestWal_Checkpoint_Tombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+		OutOfOrderWindow:   time.Second,
+	})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+	down := []domain.Label{{Name: "__name__", Value: "down"}}
+
+	require.NoError(t, w.Append(domain.WalEntity{
+		Timestamp: now.Unix(),
+		TimeSeries: []domain.TimeSeries{
+			{Labels: up, Samples: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}},
+			{Labels: down, Samples: []domain.Sample{{Timestamp: 1, Value: 0}}},
+		},
+	}))
+
+	// Deletes the whole down series and the first sample of up
+	require.NoError(t, w.Append(domain.WalEntity{
+		Timestamp: now.Unix(),
+		Tombstones: []domain.Tombstone{
+			{
+				Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "down"}},
+				MinTimeMs: math.MinInt64,
+				MaxTimeMs: math.MaxInt64,
+			},
+			{
+				Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+				MinTimeMs: 0,
+				MaxTimeMs: 1,
+			},
+		},
+	}))
+
+	// Samples written after the deletion are kept
+	require.NoError(t, w.Append(domain.WalEntity{
+		Timestamp: now.Unix(),
+		TimeSeries: []domain.TimeSeries{
+			{Labels: up, Samples: []domain.Sample{{Timestamp: 1, Value: 11}}},
+		},
+	}))
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, w.Checkpoint())
+
+	got, _, err := replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+
+	// Tombstones are applied and not carried over
+	assert.Equal(t, []domain.TimeSeries{
+		{
+			Labels:  up,
+			Samples: []domain.Sample{{Timestamp: 1, Value: 11}, {Timestamp: 2, Value: 2}},
+		},
+	}, got[0].TimeSeries)
+	assert.Empty(t, got[0].Tombstones)
+}
+
+func TestWal_Checkpoint_HeadRules(t *testing.T) {
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+
+	testCases := []struct {
+		name     string
+		opts     Opts
+		writes   [][]domain.Sample
+		expected []domain.Sample
+	}{
+		{
+			name:     "out of order",
+			writes:   [][]domain.Sample{{{Timestamp: 1, Value: 1}, {Timestamp: 3, Value: 3}}, {{Timestamp: 2, Value: 2}}},
+			expected: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 3, Value: 3}},
+		},
+		{
+			name: "out of order window",
+			opts: Opts{OutOfOrderWindow: 5 * time.Millisecond},
+			writes: [][]domain.Sample{
+				{{Timestamp: 10, Value: 10}},
+				{{Timestamp: 6, Value: 6}, {Timestamp: 4, Value: 4}},
+			},
+			expected: []domain.Sample{{Timestamp: 6, Value: 6}, {Timestamp: 10, Value: 10}},
+		},
+		{
+			name:     "last write wins",
+			writes:   [][]domain.Sample{{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}, {{Timestamp: 2, Value: 22}}},
+			expected: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 22}},
+		},
+		{
+			name: "first write wins",
+			opts: Opts{OutOfOrderWindow: time.Second, DuplicatePolicy: domain.FirstWriteWins},
+			writes: [][]domain.Sample{
+				{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+				{{Timestamp: 1, Value: 11}, {Timestamp: 2, Value: 22}},
+			},
+			expected: []domain.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Unix(1_700_000_001, 0)
+			opts := tc.opts
+			opts.PartitionsPath = t.TempDir()
+			opts.PartitionSizeInSec = 30
+			opts.TimeNow = func() time.Time { return now }
+			w := New(slog.New(slog.DiscardHandler), opts)
+
+			for _, samples := range tc.writes {
+				require.NoError(t, w.Append(domain.WalEntity{
+					Timestamp:  now.Unix(),
+					TimeSeries: []domain.TimeSeries{{Labels: up, Samples: samples}},
+				}))
+			}
+
+			now = now.Add(30 * time.Second)
+			require.NoError(t, w.Checkpoint())
+
+			// Samples the head rejects don't come back after a restart
+			got, _, err := replayAll(w)
+			require.NoError(t, err)
+			require.Len(t, got, 1)
+			assert.Equal(t, []domain.TimeSeries{{Labels: up, Samples: tc.expected}}, got[0].TimeSeries)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are the metrics of the WAL.
+type metrics struct {
+	appendDuration prometheus.Histogram
+	fsyncDuration  prometheus.Histogram
+	replayDuration prometheus.Gauge
+}
+
+// newMetrics creates the WAL metrics, they are only registered if reg is
+// not nil. Partition gauges are computed from the WAL directory on scrape.
+func newMetrics(reg prometheus.Registerer, l *wal) *metrics {
+	factory := promauto.With(reg)
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "minitsdb_wal_partitions",
+		Help: "Number of WAL partition files.",
+	}, func() float64 {
+		files, _ := l.partitionsSize()
+
+		return float64(files)
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "minitsdb_wal_partitions_bytes",
+		Help: "Total size of WAL partition files in bytes.",
+	}, func() float64 {
+		_, bytes := l.partitionsSize()
+
+		return float64(bytes)
+	})
+
+	return &metrics{
+		appendDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minitsdb_wal_append_duration_seconds",
+			Help:    "Duration of WAL appends, including the wait for fsync in always and batch sync modes.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}),
+		fsyncDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minitsdb_wal_fsync_duration_seconds",
+			Help:    "Duration of WAL partition fsyncs.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}),
+		replayDuration: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "minitsdb_wal_replay_duration_seconds",
+			Help: "Duration of the last WAL replay.",
+		}),
+	}
+}
+
+// partitionsSize returns the number of partition files and their total size.
+// Files removed while they're listed are skipped.
+func (l *wal) partitionsSize() (int, int64) {
+	files, err := l.listWalFiles()
+	if err != nil {
+		return 0, 0
+	}
+
+	var (
+		n     int
+		bytes int64
+	)
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(l.partitionsPath, f.name))
+		if err != nil {
+			continue
+		}
+		n++
+		bytes += info.Size()
+	}
+
+	return n, bytes
+}
@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWal_Metrics(t *testing.T) {
+	walDir := t.TempDir()
+	reg := prometheus.NewRegistry()
+
+	tNow := time.Unix(1_700_000_001, 0)
+	w := New(nil, Opts{
+		PartitionsPath:     walDir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+		Registerer:         reg,
+	})
+
+	// Three appends spread over two partitions
+	for i := 0; i < 3; i++ {
+		require.NoError(t, w.Append(domain.WalEntity{
+			Timestamp: tNow.Unix(),
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels:  []domain.Label{{Name: "a", Value: "b"}},
+					Samples: []domain.Sample{{Timestamp: int64(i), Value: 1}},
+				},
+			},
+		}))
+		tNow = tNow.Add(15 * time.Second)
+	}
+	w.closeCurrentFile()
+
+	// Unrelated files are not counted
+	require.NoError(t, os.WriteFile(filepath.Join(walDir, "garbage"), []byte("garbage"), 0644))
+
+	_, _, err := replayAll(w)
+	require.NoError(t, err)
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	var size int64
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(walDir, f.name))
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	expected := fmt.Sprintf(`
+# HELP minitsdb_wal_partitions Number of WAL partition files.
+# TYPE minitsdb_wal_partitions gauge
+minitsdb_wal_partitions 2
+# HELP minitsdb_wal_partitions_bytes Total size of WAL partition files in bytes.
+# TYPE minitsdb_wal_partitions_bytes gauge
+minitsdb_wal_partitions_bytes %d
+`, size)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"minitsdb_wal_partitions", "minitsdb_wal_partitions_bytes"))
+
+	// Every append is fsync'ed in the always sync mode
+	assert.Equal(t, 3, sampleCount(t, w.metrics.appendDuration, "minitsdb_wal_append_duration_seconds"))
+	assert.GreaterOrEqual(t, sampleCount(t, w.metrics.fsyncDuration, "minitsdb_wal_fsync_duration_seconds"), 3)
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, "minitsdb_wal_replay_duration_seconds"))
+}
+
+// sampleCount returns the number of observations of the histogram.
+func sampleCount(t *testing.T, h prometheus.Histogram, name string) int {
+	out, err := testutil.CollectAndFormat(h, expfmt.TypeTextPlain, name)
+	require.NoError(t, err)
+
+	for _, line := range strings.Split(string(out), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if ok && strings.HasSuffix(name, "_count") {
+			var n int
+			_, err := fmt.Sscan(value, &n)
+			require.NoError(t, err)
+
+			return n
+		}
+	}
+
+	t.Fatalf("no sample count in %s", out)
+
+	return 0
+}
@@ -0,0 +1,467 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// WAL partition file layout:
+//
+//	<4-byte magic><1-byte format version><record>...
+//
+// Record layout:
+//
+//	<4-byte payload length><4-byte CRC32C of payload><payload>
+//
+// Payload of an entity record:
+//
+//	<1-byte record type>
+//	<varint entity timestamp>
+//	<uvarint number of new series>
+//	  <uvarint series ref><uvarint number of labels>
+//	    <uvarint len><name><uvarint len><value>...
+//	<uvarint number of series with samples>
+//	  <uvarint series ref><uvarint number of samples>
+//	    <varint timestamp delta><8-byte float64 value>...
+//
+// Payload of a tombstones record:
+//
+//	<1-byte record type>
+//	<varint entity timestamp>
+//	<uvarint number of tombstones>
+//	  <varint min time><varint max time><uvarint number of matchers>
+//	    <1-byte matcher type><uvarint len><name><uvarint len><value>...
+//
+// Series are defined once per partition file and referenced by their ref
+// afterwards, so labels are not repeated in every record.
+const (
+	walMagic      uint32 = 0x4D545357 // "MTSW"
+	formatVersion byte   = 1
+
+	fileHeaderSize   = 5
+	recordHeaderSize = 8
+
+	// maxRecordSize protects from allocating huge buffers when reading corrupted lengths.
+	maxRecordSize = 256 << 20
+)
+
+type recordType byte
+
+const (
+	recordEntity     recordType = 1
+	recordTombstones recordType = 2
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errBadMagic    = errors.New("bad magic number")
+	errBadVersion  = errors.New("unsupported format version")
+	errBadChecksum = errors.New("checksum mismatch")
+	errBadRecord   = errors.New("malformed record")
+)
+
+func writeFileHeader(w io.Writer) error {
+	var header [fileHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], walMagic)
+	header[4] = formatVersion
+
+	_, err := w.Write(header[:])
+
+	return err
+}
+
+func readFileHeader(r io.Reader) error {
+	var header [fileHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+
+	if binary.BigEndian.Uint32(header[:4]) != walMagic {
+		return errBadMagic
+	}
+	if header[4] != formatVersion {
+		return fmt.Errorf("%w: %d", errBadVersion, header[4])
+	}
+
+	return nil
+}
+
+// encoder turns WAL entities into records. It keeps track of the series
+// that were already defined in the current partition file.
+type encoder struct {
+	refs    map[string]uint64 // labels key to series ref
+	nextRef uint64
+	pending map[string]uint64 // refs defined by the last encoded record
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		refs:    make(map[string]uint64),
+		nextRef: 1,
+		pending: make(map[string]uint64),
+	}
+}
+
+// encode builds records for the entity: one for its samples and one for its
+// tombstones, if it has any. Series defined by the record are remembered only
+// after commit is called, so a failed write doesn't leave dangling refs behind.
+func (e *encoder) encode(entity domain.WalEntity) []byte {
+	clear(e.pending)
+
+	if len(entity.Tombstones) == 0 {
+		return e.encodeSeries(entity)
+	}
+	if len(entity.TimeSeries) == 0 {
+		return encodeTombstones(entity)
+	}
+
+	return append(e.encodeSeries(entity), encodeTombstones(entity)...)
+}
+
+// encodeSeries builds an entity record.
+func (e *encoder) encodeSeries(entity domain.WalEntity) []byte {
+	refs := make([]uint64, len(entity.TimeSeries))
+
+	buf := make([]byte, recordHeaderSize, 64)
+	buf = append(buf, byte(recordEntity))
+	buf = binary.AppendVarint(buf, entity.Timestamp)
+
+	// Define new series first
+	newSeries := make([]int, 0)
+	for i, ts := range entity.TimeSeries {
+		key := domain.LabelsKey(ts.Labels)
+
+		ref, ok := e.refs[key]
+		if !ok {
+			ref, ok = e.pending[key]
+		}
+		if !ok {
+			ref = e.nextRef + uint64(len(e.pending))
+			e.pending[key] = ref
+			newSeries = append(newSeries, i)
+		}
+		refs[i] = ref
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(newSeries)))
+	for _, i := range newSeries {
+		labels := entity.TimeSeries[i].Labels
+
+		buf = binary.AppendUvarint(buf, refs[i])
+		buf = binary.AppendUvarint(buf, uint64(len(labels)))
+		for _, l := range labels {
+			buf = appendString(buf, l.Name)
+			buf = appendString(buf, l.Value)
+		}
+	}
+
+	// Then their samples
+	buf = binary.AppendUvarint(buf, uint64(len(entity.TimeSeries)))
+	for i, ts := range entity.TimeSeries {
+		buf = binary.AppendUvarint(buf, refs[i])
+		buf = binary.AppendUvarint(buf, uint64(len(ts.Samples)))
+
+		var prevTs int64
+		for _, s := range ts.Samples {
+			buf = binary.AppendVarint(buf, s.Timestamp-prevTs)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(s.Value))
+			prevTs = s.Timestamp
+		}
+	}
+
+	return finishRecord(buf)
+}
+
+// encodeTombstones builds a tombstones record.
+func encodeTombstones(entity domain.WalEntity) []byte {
+	buf := make([]byte, recordHeaderSize, 64)
+	buf = append(buf, byte(recordTombstones))
+	buf = binary.AppendVarint(buf, entity.Timestamp)
+
+	buf = binary.AppendUvarint(buf, uint64(len(entity.Tombstones)))
+	for _, t := range entity.Tombstones {
+		buf = binary.AppendVarint(buf, t.MinTimeMs)
+		buf = binary.AppendVarint(buf, t.MaxTimeMs)
+		buf = binary.AppendUvarint(buf, uint64(len(t.Matchers)))
+		for _, m := range t.Matchers {
+			buf = append(buf, byte(m.Type))
+			buf = appendString(buf, m.Name)
+			buf = appendString(buf, m.Value)
+		}
+	}
+
+	return finishRecord(buf)
+}
+
+// finishRecord fills in the header of a record.
+func finishRecord(buf []byte) []byte {
+	payload := buf[recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, castagnoliTable))
+
+	return buf
+}
+
+// commit remembers the series defined by the last encoded record.
+func (e *encoder) commit() {
+	for key, ref := range e.pending {
+		e.refs[key] = ref
+	}
+	e.nextRef += uint64(len(e.pending))
+	clear(e.pending)
+}
+
+// seed makes the encoder aware of series defined by the decoder, used
+// when appending to an existing partition file.
+func (e *encoder) seed(d *decoder) {
+	for ref, labels := range d.series {
+		e.refs[domain.LabelsKey(labels)] = ref
+		if ref >= e.nextRef {
+			e.nextRef = ref + 1
+		}
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+
+	return append(buf, s...)
+}
+
+// decoder turns records back into WAL entities. It keeps track of the
+// series defined in the current partition file.
+type decoder struct {
+	series map[uint64][]domain.Label
+}
+
+func newDecoder() *decoder {
+	return &decoder{
+		series: make(map[uint64][]domain.Label),
+	}
+}
+
+// readRecord reads a single record and verifies its checksum.
+// It returns io.EOF if there are no more records.
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil, io.EOF // reached end
+		}
+		return nil, fmt.Errorf("read record header: %w", err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("%w: record length %d is too big", errBadRecord, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			// The header is there but the payload is not
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read record payload: %w", err)
+	}
+
+	if crc32.Checksum(payload, castagnoliTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errBadChecksum
+	}
+
+	return payload, nil
+}
+
+// decode parses a record payload.
+func (d *decoder) decode(payload []byte) (domain.WalEntity, error) {
+	var entity domain.WalEntity
+
+	r := bytes.NewReader(payload)
+
+	typ, err := r.ReadByte()
+	if err != nil {
+		return entity, errBadRecord
+	}
+
+	if entity.Timestamp, err = binary.ReadVarint(r); err != nil {
+		return entity, errBadRecord
+	}
+
+	switch recordType(typ) {
+	case recordEntity:
+		err = d.decodeSeries(r, &entity)
+	case recordTombstones:
+		err = decodeTombstones(r, &entity)
+	default:
+		return entity, fmt.Errorf("%w: unknown record type %d", errBadRecord, typ)
+	}
+	if err != nil {
+		return entity, err
+	}
+
+	if r.Len() != 0 {
+		return entity, fmt.Errorf("%w: %d trailing bytes", errBadRecord, r.Len())
+	}
+
+	return entity, nil
+}
+
+// decodeSeries parses series definitions and samples of an entity record.
+func (d *decoder) decodeSeries(r *bytes.Reader, entity *domain.WalEntity) error {
+	// Series definitions
+	numSeries, err := readCount(r)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numSeries; i++ {
+		ref, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errBadRecord
+		}
+
+		numLabels, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		labels := make([]domain.Label, numLabels)
+		for j := range labels {
+			if labels[j].Name, err = readString(r); err != nil {
+				return err
+			}
+			if labels[j].Value, err = readString(r); err != nil {
+				return err
+			}
+		}
+
+		d.series[ref] = labels
+	}
+
+	// Samples
+	numSeries, err = readCount(r)
+	if err != nil {
+		return err
+	}
+	entity.TimeSeries = make([]domain.TimeSeries, numSeries)
+	for i := range entity.TimeSeries {
+		ref, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errBadRecord
+		}
+
+		labels, ok := d.series[ref]
+		if !ok {
+			return fmt.Errorf("%w: unknown series ref %d", errBadRecord, ref)
+		}
+
+		numSamples, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		samples := make([]domain.Sample, numSamples)
+
+		var prevTs int64
+		for j := range samples {
+			delta, err := binary.ReadVarint(r)
+			if err != nil {
+				return errBadRecord
+			}
+
+			var value [8]byte
+			if _, err := io.ReadFull(r, value[:]); err != nil {
+				return errBadRecord
+			}
+
+			samples[j] = domain.Sample{
+				Timestamp: prevTs + delta,
+				Value:     math.Float64frombits(binary.LittleEndian.Uint64(value[:])),
+			}
+			prevTs = samples[j].Timestamp
+		}
+
+		entity.TimeSeries[i] = domain.TimeSeries{
+			// Labels are shared between records, hand out a copy
+			Labels:  slices.Clone(labels),
+			Samples: samples,
+		}
+	}
+
+	return nil
+}
+
+// decodeTombstones parses the tombstones of a tombstones record.
+func decodeTombstones(r *bytes.Reader, entity *domain.WalEntity) error {
+	numTombstones, err := readCount(r)
+	if err != nil {
+		return err
+	}
+
+	entity.Tombstones = make([]domain.Tombstone, numTombstones)
+	for i := range entity.Tombstones {
+		t := &entity.Tombstones[i]
+		if t.MinTimeMs, err = binary.ReadVarint(r); err != nil {
+			return errBadRecord
+		}
+		if t.MaxTimeMs, err = binary.ReadVarint(r); err != nil {
+			return errBadRecord
+		}
+
+		numMatchers, err := readCount(r)
+		if err != nil {
+			return err
+		}
+		t.Matchers = make([]domain.LabelMatcher, numMatchers)
+		for j := range t.Matchers {
+			typ, err := r.ReadByte()
+			if err != nil {
+				return errBadRecord
+			}
+			t.Matchers[j].Type = domain.LabelMatcherType(typ)
+			if t.Matchers[j].Name, err = readString(r); err != nil {
+				return err
+			}
+			if t.Matchers[j].Value, err = readString(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readCount reads a number of elements and makes sure it's sane
+// with respect to the remaining payload.
+func readCount(r *bytes.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, errBadRecord
+	}
+	if n > uint64(r.Len()) {
+		return 0, fmt.Errorf("%w: count %d exceeds record size", errBadRecord, n)
+	}
+
+	return int(n), nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", errBadRecord
+	}
+
+	return string(buf), nil
+}
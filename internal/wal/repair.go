@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// quarantineDir is a directory inside the partitions path where
+// unrecoverable partitions and damaged tails are moved to.
+const quarantineDir = "quarantine"
+
+// corruptionError describes a damaged partition file.
+type corruptionError struct {
+	offset int64 // end of the last valid record, 0 if the file header is damaged
+	err    error
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("corrupted at offset %d: %v", e.offset, e.err)
+}
+
+func (e *corruptionError) Unwrap() error {
+	return e.err
+}
+
+// TruncatedPartition describes a partition that had its damaged tail cut off.
+type TruncatedPartition struct {
+	File         string
+	Offset       int64 // new size of the file
+	DroppedBytes int64
+	Reason       string
+}
+
+// RepairReport describes what was repaired during a replay.
+type RepairReport struct {
+	Truncated   []TruncatedPartition
+	Quarantined []string
+}
+
+// Empty reports whether nothing was repaired.
+func (r RepairReport) Empty() bool {
+	return len(r.Truncated) == 0 && len(r.Quarantined) == 0
+}
+
+// repair fixes a damaged partition: if its header is fine the file is
+// truncated to the last valid record, otherwise it's moved to quarantine.
+// Must be called under the lock.
+func (l *wal) repair(file walFile, corruption *corruptionError, report *RepairReport) error {
+	// Never keep writing to a file that is being repaired
+	if l.currentFile != nil && l.currentFileTimestamp == file.ts {
+		l.closeCurrentFile()
+	}
+
+	path := filepath.Join(l.partitionsPath, file.name)
+
+	if corruption.offset == 0 {
+		// Nothing can be read from the file
+		if err := l.quarantine(file.name); err != nil {
+			return err
+		}
+
+		l.log.Warn("moved unreadable wal file to quarantine",
+			slog.String("file", file.name),
+			slog.Any("error", corruption.err))
+		report.Quarantined = append(report.Quarantined, file.name)
+
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dropped := info.Size() - corruption.offset
+
+	// A partially written record at the end is an expected result of a crash.
+	// Anything else means the data was damaged, so keep the tail for analysis.
+	if !errors.Is(corruption.err, io.ErrUnexpectedEOF) {
+		if err := l.quarantineTail(file.name, corruption.offset); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Truncate(path, corruption.offset); err != nil {
+		return err
+	}
+
+	l.log.Warn("truncated damaged wal file",
+		slog.String("file", file.name),
+		slog.Int64("offset", corruption.offset),
+		slog.Int64("dropped_bytes", dropped),
+		slog.Any("error", corruption.err))
+	report.Truncated = append(report.Truncated, TruncatedPartition{
+		File:         file.name,
+		Offset:       corruption.offset,
+		DroppedBytes: dropped,
+		Reason:       corruption.err.Error(),
+	})
+
+	return nil
+}
+
+// quarantine moves the whole partition file to the quarantine directory.
+func (l *wal) quarantine(filename string) error {
+	dir := filepath.Join(l.partitionsPath, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(l.partitionsPath, filename), filepath.Join(dir, filename))
+}
+
+// quarantineTail copies the part of the partition file that starts
+// at the given offset to the quarantine directory.
+func (l *wal) quarantineTail(filename string, offset int64) error {
+	dir := filepath.Join(l.partitionsPath, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(filepath.Join(l.partitionsPath, filename))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(filepath.Join(dir, filename+"."+strconv.FormatInt(offset, 10)+".tail"))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Sync()
+}
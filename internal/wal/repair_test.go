@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntities(n int) []domain.WalEntity {
+	entities := make([]domain.WalEntity, 0, n)
+	for i := 0; i < n; i++ {
+		entities = append(entities, domain.WalEntity{
+			Timestamp: int64(i),
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels: []domain.Label{
+						{Name: "__name__", Value: "requests_total"},
+						{Name: "instance", Value: strconv.Itoa(i % 2)},
+					},
+					Samples: []domain.Sample{
+						{Timestamp: int64(i * 1000), Value: float64(i)},
+						{Timestamp: int64(i*1000 + 500), Value: float64(i) + 0.5},
+					},
+				},
+			},
+		})
+	}
+
+	return entities
+}
+
+// writePartition writes entities to a partition file and returns the file
+// content along with the offsets where each record ends.
+func writePartition(t *testing.T, entities []domain.WalEntity) ([]byte, []int64) {
+	t.Helper()
+
+	dir := t.TempDir()
+	tNow := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+	})
+
+	ends := make([]int64, 0, len(entities))
+	for _, e := range entities {
+		require.NoError(t, w.Append(e))
+
+		info, err := w.currentFile.Stat()
+		require.NoError(t, err)
+		ends = append(ends, info.Size())
+	}
+	w.closeCurrentFile()
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(filepath.Join(dir, files[0].name))
+	require.NoError(t, err)
+
+	return data, ends
+}
+
+// TestWal_Replay_TornWrite simulates a crash at every possible byte offset
+// of a partition and makes sure all the complete records survive.
+func TestWal_Replay_TornWrite(t *testing.T) {
+	entities := testEntities(5)
+	data, ends := writePartition(t, entities)
+
+	for cut := 0; cut <= len(data); cut++ {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "100.wal"), data[:cut], 0644))
+
+		w := New(slog.New(slog.DiscardHandler), Opts{
+			PartitionsPath:     dir,
+			PartitionSizeInSec: 30,
+			TimeNow:            func() time.Time { return time.Unix(200, 0) },
+		})
+
+		got, report, err := replayAll(w)
+		require.NoError(t, err, "cut at %d", cut)
+
+		if cut < fileHeaderSize {
+			// Header is damaged, nothing to recover
+			assert.Empty(t, got, "cut at %d", cut)
+			assert.Equal(t, []string{"100.wal"}, report.Quarantined, "cut at %d", cut)
+			assert.FileExists(t, filepath.Join(dir, quarantineDir, "100.wal"))
+
+			continue
+		}
+
+		// Find out how many records are complete
+		complete := 0
+		validSize := int64(fileHeaderSize)
+		for complete < len(ends) && ends[complete] <= int64(cut) {
+			validSize = ends[complete]
+			complete++
+		}
+
+		if complete == 0 {
+			assert.Empty(t, got, "cut at %d", cut)
+		} else {
+			assert.Equal(t, entities[:complete], got, "cut at %d", cut)
+		}
+
+		if validSize == int64(cut) {
+			assert.True(t, report.Empty(), "cut at %d", cut)
+		} else if assert.Len(t, report.Truncated, 1, "cut at %d", cut) {
+			assert.Equal(t, []TruncatedPartition{
+				{
+					File:         "100.wal",
+					Offset:       validSize,
+					DroppedBytes: int64(cut) - validSize,
+					Reason:       report.Truncated[0].Reason,
+				},
+			}, report.Truncated, "cut at %d", cut)
+		}
+
+		info, err := os.Stat(filepath.Join(dir, "100.wal"))
+		require.NoError(t, err)
+		assert.Equal(t, validSize, info.Size(), "cut at %d", cut)
+
+		// Repaired partition is readable again
+		got, report, err = replayAll(w)
+		require.NoError(t, err)
+		assert.True(t, report.Empty())
+		assert.Len(t, got, complete)
+	}
+}
+
+func TestWal_Replay_AppendAfterRepair(t *testing.T) {
+	entities := testEntities(3)
+	data, ends := writePartition(t, entities)
+
+	dir := t.TempDir()
+	tNow := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+	})
+
+	// The last record is torn, the partition is still the current one
+	partition := strconv.FormatInt(w.getNextPartitionTs(), 10) + partitionSuffix
+	require.NoError(t, os.WriteFile(filepath.Join(dir, partition), data[:ends[2]-4], 0644))
+
+	got, report, err := replayAll(w)
+	require.NoError(t, err)
+	assert.Len(t, report.Truncated, 1)
+	assert.Equal(t, entities[:2], got)
+
+	// New records go right after the last valid one
+	require.NoError(t, w.Append(entities[2]))
+
+	got, report, err = replayAll(w)
+	require.NoError(t, err)
+	assert.True(t, report.Empty())
+	assert.Equal(t, entities, got)
+}
+
+func TestWal_Append_TornPartition(t *testing.T) {
+	entities := testEntities(3)
+	data, ends := writePartition(t, entities)
+
+	dir := t.TempDir()
+	tNow := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+	})
+
+	// The current partition has a torn record and isn't replayed before
+	// the next append
+	partition := strconv.FormatInt(w.getNextPartitionTs(), 10) + partitionSuffix
+	require.NoError(t, os.WriteFile(filepath.Join(dir, partition), data[:ends[2]-4], 0644))
+
+	require.NoError(t, w.Append(entities[2]))
+
+	got, report, err := replayAll(w)
+	require.NoError(t, err)
+	assert.True(t, report.Empty())
+	assert.Equal(t, entities, got)
+}
+
+func TestWal_Append_FailedWrite(t *testing.T) {
+	entities := testEntities(2)
+
+	tNow := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+	})
+
+	require.NoError(t, w.Append(entities[0]))
+
+	// Writes to the file fail, the partition is opened again by the next write
+	require.NoError(t, w.currentFile.Close())
+	require.Error(t, w.Append(entities[1]))
+	assert.Nil(t, w.currentFile)
+
+	require.NoError(t, w.Append(entities[1]))
+
+	got, report, err := replayAll(w)
+	require.NoError(t, err)
+	assert.True(t, report.Empty())
+	assert.Equal(t, entities, got)
+}
+
+func TestWal_Replay_Corruption(t *testing.T) {
+	entities := testEntities(4)
+	data, ends := writePartition(t, entities)
+
+	dir := t.TempDir()
+
+	// Damage the third record
+	damaged := append([]byte(nil), data...)
+	damaged[ends[1]+recordHeaderSize+2] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "100.wal"), damaged, 0644))
+
+	// Not a WAL file at all
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "200.wal"), []byte("definitely not a wal"), 0644))
+
+	// Healthy partition after the damaged ones
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "300.wal"), data, 0644))
+
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return time.Unix(400, 0) },
+	})
+
+	got, report, err := replayAll(w)
+	require.NoError(t, err)
+
+	// Records before the corruption and the healthy partition are kept
+	assert.Equal(t, append(append([]domain.WalEntity{}, entities[:2]...), entities...), got)
+
+	assert.Equal(t, []string{"200.wal"}, report.Quarantined)
+	if assert.Len(t, report.Truncated, 1) {
+		assert.Equal(t, "100.wal", report.Truncated[0].File)
+		assert.Equal(t, ends[1], report.Truncated[0].Offset)
+		assert.Equal(t, int64(len(data))-ends[1], report.Truncated[0].DroppedBytes)
+	}
+
+	// Damaged tail is preserved for analysis
+	tail, err := os.ReadFile(filepath.Join(dir, quarantineDir, "100.wal."+strconv.FormatInt(ends[1], 10)+".tail"))
+	require.NoError(t, err)
+	assert.Equal(t, damaged[ends[1]:], tail)
+}
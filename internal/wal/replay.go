@@ -0,0 +1,266 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// replayProgressInterval is how often replay progress is logged.
+const replayProgressInterval = 10 * time.Second
+
+// ReplayStats describes a finished replay.
+type ReplayStats struct {
+	Files    int
+	Records  int
+	Bytes    int64
+	Duration time.Duration
+	Repairs  RepairReport
+}
+
+// Replay streams the entries of the latest checkpoint and the WAL partitions
+// written after it to apply, in the order they were appended. Entries are
+// handed over as soon as they're decoded, so the whole WAL is never held in
+// memory. With several replay workers files are decoded concurrently, but
+// entries are still applied in order. Replay stops on the first error
+// returned by apply.
+//
+// Partitions damaged by a crash or a disk failure are repaired on the fly:
+// valid records up to the corruption point are kept and the damaged tail is
+// truncated, partitions that can't be read at all are moved to the quarantine
+// directory.
+func (l *wal) Replay(apply func(domain.WalEntity) error) (ReplayStats, error) {
+	return l.ReplayAfter(math.MinInt64, apply)
+}
+
+// ReplayAfter replays like Replay, but skips the partitions and checkpoints
+// up to the one returned by Cut, as their state is restored elsewhere.
+func (l *wal) ReplayAfter(ts int64, apply func(domain.WalEntity) error) (ReplayStats, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var stats ReplayStats
+	start := time.Now()
+
+	files, err := l.replayFiles(ts)
+	if err != nil {
+		return stats, err
+	}
+
+	progress := newReplayProgress(l.log, len(files))
+
+	if l.replayWorkers > 1 && len(files) > 1 {
+		err = l.replayParallel(files, apply, &stats, progress)
+	} else {
+		err = l.replaySequential(files, apply, &stats, progress)
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Duration = time.Since(start)
+	l.metrics.replayDuration.Set(stats.Duration.Seconds())
+
+	return stats, nil
+}
+
+// replaySequential streams records of the files one by one.
+func (l *wal) replaySequential(
+	files []walFile,
+	apply func(domain.WalEntity) error,
+	stats *ReplayStats,
+	progress *replayProgress) error {
+	for _, file := range files {
+		n, err := l.streamWalFile(file.name, func(e domain.WalEntity) error {
+			stats.Records++
+			progress.record()
+
+			return apply(e)
+		})
+		if err := l.finishFile(file, n, err, stats, progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodedFile holds all the records of a file decoded by a replay worker.
+type decodedFile struct {
+	entities []domain.WalEntity
+	bytes    int64
+	err      error
+}
+
+// replayParallel decodes files concurrently with a bounded number of workers,
+// while records are still applied strictly in the order of the files, so
+// samples of every series arrive sorted. At most replayWorkers decoded files
+// are held in memory at a time.
+func (l *wal) replayParallel(
+	files []walFile,
+	apply func(domain.WalEntity) error,
+	stats *ReplayStats,
+	progress *replayProgress) error {
+	results := make([]chan decodedFile, len(files))
+	for i := range results {
+		results[i] = make(chan decodedFile, 1)
+	}
+
+	// Stop dispatching when the replay is aborted
+	done := make(chan struct{})
+	defer close(done)
+
+	slots := make(chan struct{}, l.replayWorkers)
+	go func() {
+		for i, file := range files {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			go func() {
+				var decoded decodedFile
+				decoded.bytes, decoded.err = l.streamWalFile(file.name, func(e domain.WalEntity) error {
+					decoded.entities = append(decoded.entities, e)
+
+					return nil
+				})
+				results[i] <- decoded
+			}()
+		}
+	}()
+
+	for i, file := range files {
+		decoded := <-results[i]
+
+		for _, e := range decoded.entities {
+			stats.Records++
+			progress.record()
+
+			if err := apply(e); err != nil {
+				return fmt.Errorf("failed to replay wal file %s: %w", file.name, err)
+			}
+		}
+
+		// Let the next file be decoded only once this one is released
+		decoded.entities = nil
+		<-slots
+
+		if err := l.finishFile(file, decoded.bytes, decoded.err, stats, progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finishFile accounts for a replayed file and repairs it if it's damaged.
+func (l *wal) finishFile(file walFile, n int64, err error, stats *ReplayStats, progress *replayProgress) error {
+	if err != nil {
+		var corruption *corruptionError
+		if !errors.As(err, &corruption) {
+			return fmt.Errorf("failed to replay wal file %s: %w", file.name, err)
+		}
+
+		if err := l.repair(file, corruption, &stats.Repairs); err != nil {
+			return fmt.Errorf("failed to repair wal file %s: %w", file.name, err)
+		}
+	}
+
+	stats.Files++
+	stats.Bytes += n
+	progress.fileDone(n)
+
+	return nil
+}
+
+// replayFiles returns the files to replay: the latest checkpoint followed
+// by the partitions written after it, all of them newer than afterTs.
+func (l *wal) replayFiles(afterTs int64) ([]walFile, error) {
+	files, err := l.listWalFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wal files: %w", err)
+	}
+
+	checkpoint, err := l.latestCheckpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	var result []walFile
+	if checkpoint != nil && checkpoint.ts > afterTs {
+		result = append(result, *checkpoint)
+		afterTs = checkpoint.ts
+	}
+
+	for _, f := range files {
+		if f.ts > afterTs {
+			result = append(result, f)
+		}
+	}
+
+	return result, nil
+}
+
+// replayProgress periodically logs how far the replay got.
+type replayProgress struct {
+	log        *slog.Logger
+	totalFiles int
+
+	start       time.Time
+	lastLog     time.Time
+	lastRecords int
+	filesDone   int
+	records     int
+	bytes       int64
+}
+
+func newReplayProgress(log *slog.Logger, totalFiles int) *replayProgress {
+	now := time.Now()
+
+	return &replayProgress{
+		log:        log,
+		totalFiles: totalFiles,
+		start:      now,
+		lastLog:    now,
+	}
+}
+
+func (p *replayProgress) record() {
+	p.records++
+
+	// Checking the clock on every record is too expensive
+	if p.records%1024 == 0 {
+		p.maybeLog()
+	}
+}
+
+func (p *replayProgress) fileDone(bytes int64) {
+	p.filesDone++
+	p.bytes += bytes
+	p.maybeLog()
+}
+
+func (p *replayProgress) maybeLog() {
+	now := time.Now()
+	elapsed := now.Sub(p.lastLog)
+	if elapsed < replayProgressInterval {
+		return
+	}
+
+	p.log.Info("replaying wal",
+		slog.Int("files_done", p.filesDone),
+		slog.Int("files_total", p.totalFiles),
+		slog.Int("records", p.records),
+		slog.Float64("records_per_sec", float64(p.records-p.lastRecords)/elapsed.Seconds()),
+		slog.Int64("bytes", p.bytes),
+		slog.Duration("elapsed", now.Sub(p.start)))
+
+	p.lastLog = now
+	p.lastRecords = p.records
+}
@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+)
+
+// retentionCheckInterval is how often files out of retention are removed.
+const retentionCheckInterval = time.Minute
+
+// DeleteBefore removes partitions and checkpoints that were closed before
+// the given time, so all the data they hold is older than it. Samples out
+// of retention within newer checkpoints are dropped when the next
+// checkpoint is created.
+func (l *wal) DeleteBefore(t time.Time) error {
+	removed, err := l.deleteBefore(t.Unix())
+	if removed > 0 {
+		l.log.Info("removed wal files out of retention",
+			slog.Int("files", removed),
+			slog.Time("before", t))
+	}
+
+	return err
+}
+
+// Truncate removes partitions and checkpoints up to the one returned by
+// Cut, once the state they hold is persisted elsewhere.
+func (l *wal) Truncate(ts int64) error {
+	removed, err := l.deleteBefore(ts + 1)
+	if removed > 0 {
+		l.log.Info("truncated wal",
+			slog.Int("files", removed),
+			slog.Int64("partition", ts))
+	}
+
+	return err
+}
+
+// errNewerSample stops reading a file once it holds a sample to keep.
+var errNewerSample = errors.New("newer sample")
+
+// TruncateSamplesBefore removes the oldest partitions and checkpoints as long
+// as all the samples they hold are older than tsMs, e.g. once those samples
+// are persisted in blocks. Files are removed in order up to the first one
+// holding a newer sample, so tombstones are never dropped before the samples
+// they delete. Partitions that may still be written to are kept.
+func (l *wal) TruncateSamplesBefore(tsMs int64) error {
+	l.checkpointMu.Lock()
+	defer l.checkpointMu.Unlock()
+
+	// Close the current file if its window is over, it's not written to anymore
+	l.mutex.Lock()
+	currentTs := l.getNextPartitionTs()
+	if l.currentFile != nil && l.currentFileTimestamp < currentTs {
+		l.closeCurrentFile()
+	}
+	l.mutex.Unlock()
+
+	files, err := l.listWalFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list wal files: %w", err)
+	}
+
+	checkpoints, err := l.listCheckpoints()
+	if err != nil {
+		return fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	// A checkpoint goes before the partitions written after it
+	files = append(checkpoints, files...)
+	slices.SortStableFunc(files, func(a, b walFile) int {
+		return cmp.Compare(a.ts, b.ts)
+	})
+
+	var removed int
+	for _, f := range files {
+		if f.ts >= currentTs {
+			break
+		}
+
+		_, err := l.streamWalFile(f.name, func(e domain.WalEntity) error {
+			for _, ts := range e.TimeSeries {
+				for _, sample := range ts.Samples {
+					if sample.Timestamp >= tsMs {
+						return errNewerSample
+					}
+				}
+			}
+
+			return nil
+		})
+		if errors.Is(err, errNewerSample) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", f.name, err)
+		}
+
+		if err := os.Remove(filepath.Join(l.partitionsPath, f.name)); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", f.name, err)
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		l.log.Info("truncated wal files with persisted samples",
+			slog.Int("files", removed),
+			slog.Time("before", time.UnixMilli(tsMs)))
+	}
+
+	return nil
+}
+
+// deleteBefore removes partitions and checkpoints named after a timestamp
+// older than cutoff and returns the number of removed files.
+func (l *wal) deleteBefore(cutoff int64) (int, error) {
+	l.checkpointMu.Lock()
+	defer l.checkpointMu.Unlock()
+
+	files, err := l.listWalFiles()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list wal files: %w", err)
+	}
+
+	checkpoints, err := l.listCheckpoints()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+
+	var removed int
+	for _, f := range append(files, checkpoints...) {
+		// A file is named after the end of the time window it was written in
+		if f.ts >= cutoff {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(l.partitionsPath, f.name)); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %w", f.name, err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,151 @@
+package wal
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWal_DeleteBefore(t *testing.T) {
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+		Retention:          time.Minute,
+	})
+
+	appendSample := func(ts int64) {
+		require.NoError(t, w.Append(domain.WalEntity{
+			Timestamp: now.Unix(),
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels:  []domain.Label{{Name: "__name__", Value: "up"}},
+					Samples: []domain.Sample{{Timestamp: ts, Value: 1}},
+				},
+			},
+		}))
+	}
+
+	// Three partitions, 30 seconds apart
+	start := now
+	for i := 0; i < 3; i++ {
+		appendSample(now.UnixMilli())
+		now = now.Add(30 * time.Second)
+	}
+
+	// The first partition ends within 30 seconds from the start
+	require.NoError(t, w.DeleteBefore(start.Add(30*time.Second)))
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	got, _, err := replayAll(w)
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
+
+func TestWal_Checkpoint_Retention(t *testing.T) {
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+		Retention:          time.Minute,
+	})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+	down := []domain.Label{{Name: "__name__", Value: "down"}}
+
+	start := now.UnixMilli()
+	require.NoError(t, w.Append(domain.WalEntity{
+		Timestamp: now.Unix(),
+		TimeSeries: []domain.TimeSeries{
+			{
+				Labels:  up,
+				Samples: []domain.Sample{{Timestamp: start, Value: 1}, {Timestamp: start + 45_000, Value: 2}},
+			},
+			{
+				Labels:  down,
+				Samples: []domain.Sample{{Timestamp: start, Value: 0}},
+			},
+		},
+	}))
+
+	// Samples older than a minute are out of retention by now
+	now = now.Add(90 * time.Second)
+	require.NoError(t, w.Checkpoint())
+
+	got, _, err := replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, []domain.TimeSeries{
+		{
+			Labels:  up,
+			Samples: []domain.Sample{{Timestamp: start + 45_000, Value: 2}},
+		},
+	}, got[0].TimeSeries)
+}
+
+func TestWal_TruncateSamplesBefore(t *testing.T) {
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+	})
+
+	up := []domain.Label{{Name: "__name__", Value: "up"}}
+	appendEntity := func(e domain.WalEntity) {
+		e.Timestamp = now.Unix()
+		require.NoError(t, w.Append(e))
+		now = now.Add(30 * time.Second)
+	}
+	appendSamples := func(ts ...int64) {
+		samples := make([]domain.Sample, 0, len(ts))
+		for _, t := range ts {
+			samples = append(samples, domain.Sample{Timestamp: t, Value: 1})
+		}
+		appendEntity(domain.WalEntity{TimeSeries: []domain.TimeSeries{{Labels: up, Samples: samples}}})
+	}
+
+	// Partitions are closed long after their samples are, or before, which
+	// doesn't matter for their removal
+	appendSamples(1, 2)
+	appendSamples(5)
+	appendEntity(domain.WalEntity{Tombstones: []domain.Tombstone{{
+		Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "__name__", Value: "up"}},
+		MinTimeMs: 5,
+		MaxTimeMs: 5,
+	}}})
+	appendSamples(3)
+
+	// The last partition is the current one
+	now = now.Add(-30 * time.Second)
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 4)
+
+	// The second partition holds a newer sample, the files after it are
+	// kept along with it
+	require.NoError(t, w.TruncateSamplesBefore(4))
+
+	got, _, err := replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, []domain.Sample{{Timestamp: 5, Value: 1}}, got[0].TimeSeries[0].Samples)
+
+	// The current partition is never removed
+	require.NoError(t, w.TruncateSamplesBefore(10))
+
+	got, _, err = replayAll(w)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, []domain.Sample{{Timestamp: 3, Value: 1}}, got[0].TimeSeries[0].Samples)
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SyncMode defines when appended records are fsync'ed to the disk.
+type SyncMode string
+
+const (
+	// SyncAlways fsyncs every append before acknowledging it.
+	// Loss window: none, acknowledged writes are always on the disk.
+	// Throughput is limited by how fast the disk can fsync.
+	SyncAlways SyncMode = "always"
+
+	// SyncBatch acknowledges an append only after it's fsync'ed too, but
+	// concurrent appenders share a single fsync (group commit): while one
+	// fsync is in flight, new records pile up and get synced by the next one.
+	// Loss window: none, at the cost of slightly higher append latency.
+	SyncBatch SyncMode = "batch"
+
+	// SyncInterval acknowledges appends right away and fsyncs in the
+	// background every SyncInterval.
+	// Loss window: up to SyncInterval of acknowledged writes on power loss
+	// or kernel crash, a process crash alone loses nothing.
+	SyncInterval SyncMode = "interval"
+)
+
+// ParseSyncMode validates a sync mode name.
+func ParseSyncMode(s string) (SyncMode, error) {
+	switch mode := SyncMode(s); mode {
+	case SyncAlways, SyncBatch, SyncInterval:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown wal sync mode %q, expected one of: %s, %s, %s",
+		s, SyncAlways, SyncBatch, SyncInterval)
+}
+
+// waitSynced blocks until the record with the given sequence number is
+// fsync'ed. The first waiter becomes a leader and fsyncs on behalf of
+// everyone who has written so far, the rest wait for it to finish.
+func (l *wal) waitSynced(seq uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	for {
+		// A later fsync doesn't cover records lost by a failed one
+		if l.syncErr != nil && seq <= l.syncFailed {
+			return fmt.Errorf("failed to sync wal file: %w", l.syncErr)
+		}
+		if l.synced >= seq {
+			return nil
+		}
+
+		if l.syncing {
+			// Someone else is syncing, wait for it
+			l.syncCond.Wait()
+
+			continue
+		}
+
+		l.syncing = true
+		l.syncMu.Unlock()
+
+		target, err := l.syncCurrent()
+
+		l.syncMu.Lock()
+		l.syncing = false
+		if err == nil {
+			l.markSynced(target)
+		}
+		l.syncCond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// syncCurrent fsyncs the current partition file and returns the sequence
+// number of the last record covered by the fsync.
+func (l *wal) syncCurrent() (uint64, error) {
+	l.mutex.RLock()
+	f, target := l.currentFile, l.written
+	l.mutex.RUnlock()
+
+	if f == nil {
+		// Nothing was written yet or the file was closed, which syncs it
+		return l.closedSynced(target)
+	}
+
+	if err := l.fsync(f); err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			// Partition was rotated in the meantime, closing syncs it
+			return l.closedSynced(target)
+		}
+
+		return 0, fmt.Errorf("failed to sync wal file: %w", err)
+	}
+
+	return target, nil
+}
+
+// closedSynced returns the target once the closed partition is synced,
+// unless the fsync on close failed for the records up to it.
+func (l *wal) closedSynced(target uint64) (uint64, error) {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if l.syncErr != nil && target <= l.syncFailed {
+		return 0, fmt.Errorf("failed to sync wal file: %w", l.syncErr)
+	}
+
+	return target, nil
+}
+
+// markSynced records that everything up to the given sequence number is
+// on the disk. Must be called under syncMu.
+func (l *wal) markSynced(seq uint64) {
+	if seq > l.synced {
+		l.synced = seq
+	}
+}
+
+// Sync fsyncs all the records appended so far.
+func (l *wal) Sync() error {
+	l.mutex.RLock()
+	seq := l.written
+	l.mutex.RUnlock()
+
+	return l.waitSynced(seq)
+}
+
+// fsync syncs the partition file and records how long it took.
+func (l *wal) fsync(f *os.File) error {
+	start := time.Now()
+	defer func() {
+		l.metrics.fsyncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	return l.syncFile(f)
+}
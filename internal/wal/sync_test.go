@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSyncMode(t *testing.T) {
+	for _, mode := range []string{"always", "batch", "interval"} {
+		got, err := ParseSyncMode(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, SyncMode(mode), got)
+	}
+
+	_, err := ParseSyncMode("sometimes")
+	assert.Error(t, err)
+}
+
+func TestWal_SyncModes(t *testing.T) {
+	const (
+		appenders = 8
+		perWorker = 50
+	)
+
+	for _, mode := range []SyncMode{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(string(mode), func(t *testing.T) {
+			w := New(slog.New(slog.DiscardHandler), Opts{
+				PartitionsPath:     t.TempDir(),
+				PartitionSizeInSec: 30,
+				TimeNow:            func() time.Time { return time.Unix(1_700_000_001, 0) },
+				SyncMode:           mode,
+				SyncInterval:       10 * time.Millisecond,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				w.Run(ctx)
+			}()
+
+			var wg sync.WaitGroup
+			for i := 0; i < appenders; i++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+
+					for j := 0; j < perWorker; j++ {
+						assert.NoError(t, w.Append(domain.WalEntity{
+							Timestamp: int64(j),
+							TimeSeries: []domain.TimeSeries{
+								{
+									Labels:  []domain.Label{{Name: "worker", Value: strconv.Itoa(worker)}},
+									Samples: []domain.Sample{{Timestamp: int64(j), Value: float64(j)}},
+								},
+							},
+						}))
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if mode != SyncInterval {
+				// Acknowledged records are already synced
+				w.syncMu.Lock()
+				assert.Equal(t, uint64(appenders*perWorker), w.synced)
+				w.syncMu.Unlock()
+			} else {
+				assert.Eventually(t, func() bool {
+					w.syncMu.Lock()
+					defer w.syncMu.Unlock()
+
+					return w.synced == appenders*perWorker
+				}, time.Second, 10*time.Millisecond)
+			}
+
+			cancel()
+			<-done
+
+			got, report, err := replayAll(w)
+			require.NoError(t, err)
+			assert.True(t, report.Empty())
+			assert.Len(t, got, appenders*perWorker)
+		})
+	}
+}
+
+func BenchmarkWal_Append(b *testing.B) {
+	for _, mode := range []SyncMode{SyncAlways, SyncBatch, SyncInterval} {
+		b.Run(string(mode), func(b *testing.B) {
+			w := New(slog.New(slog.DiscardHandler), Opts{
+				PartitionsPath:     b.TempDir(),
+				PartitionSizeInSec: 3600,
+				TimeNow:            time.Now,
+				SyncMode:           mode,
+			})
+
+			entity := domain.WalEntity{
+				TimeSeries: []domain.TimeSeries{
+					{
+						Labels:  []domain.Label{{Name: "__name__", Value: "up"}},
+						Samples: []domain.Sample{{Timestamp: 1, Value: 1}},
+					},
+				},
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := w.Append(entity); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.StopTimer()
+
+			w.mutex.Lock()
+			w.closeCurrentFile()
+			w.mutex.Unlock()
+		})
+	}
+}
+
+func TestWal_SyncFailedOnRotation(t *testing.T) {
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+		SyncMode:           SyncBatch,
+	})
+
+	entities := testEntities(3)
+	require.NoError(t, w.Append(entities[0]))
+
+	// The record is written, but not synced before the partition is closed
+	errSync := errors.New("disk is gone")
+	w.syncFile = func(*os.File) error { return errSync }
+
+	w.mutex.Lock()
+	seq, err := w.write(entities[1])
+	require.NoError(t, err)
+	w.closeCurrentFile()
+	w.mutex.Unlock()
+
+	// Closing didn't sync the record, for waiters and for a leader that
+	// finds the file closed
+	assert.ErrorIs(t, w.waitSynced(seq), errSync)
+	_, err = w.syncCurrent()
+	assert.ErrorIs(t, err, errSync)
+
+	// Neither does a later fsync of the next partition
+	w.syncFile = (*os.File).Sync
+	now = now.Add(30 * time.Second)
+	require.NoError(t, w.Append(entities[2]))
+	assert.ErrorIs(t, w.waitSynced(seq), errSync)
+	assert.NoError(t, w.Sync())
+}
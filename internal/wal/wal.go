@@ -1,14 +1,14 @@
 package wal
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,12 +16,12 @@ import (
 	"time"
 
 	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// TODO: on start of the service:
-// 1. run replay that will load N latest partitions so we can apply them in storage
-// 2. we need to know what was the last wal file -> check wal directory, get latest one
-
+// partitionSuffix is the extension of WAL partitions, they're named after the
+// unix time their time range starts at. On start the latest checkpoint and
+// the partitions after it are replayed to restore the storage.
 const partitionSuffix = ".wal"
 
 type wal struct {
@@ -30,27 +30,140 @@ type wal struct {
 	partitionsPath       string
 	currentFileTimestamp int64
 	currentFile          *os.File
+	currentFileSize      int64 // end of the last complete record in the current file
+	encoder              *encoder
 	timeFn               func() time.Time
 	mutex                sync.RWMutex
+
+	syncMode     SyncMode
+	syncInterval time.Duration
+	written      uint64 // sequence number of the last written record, guarded by mutex
+	syncMu       sync.Mutex
+	syncCond     *sync.Cond
+	synced       uint64 // sequence number of the last fsync'ed record, guarded by syncMu
+	syncing      bool   // whether there's an fsync in flight, guarded by syncMu
+	syncFailed   uint64 // sequence number of the last record lost by a failed fsync, guarded by syncMu
+	syncErr      error  // error of the failed fsync, guarded by syncMu
+	syncFile     func(*os.File) error
+
+	checkpointInterval time.Duration
+	checkpointMu       sync.Mutex
+
+	replayWorkers int
+
+	retention time.Duration
+
+	oooWindowMs     int64
+	duplicatePolicy domain.DuplicatePolicy
+
+	minPartitionTs int64 // partitions up to a cut are not written to anymore, guarded by mutex
+
+	metrics *metrics
 }
 
 type Opts struct {
 	PartitionSizeInSec int64
 	PartitionsPath     string
 	TimeNow            func() time.Time
+	// SyncMode defines the durability guarantees of Append, SyncAlways by default.
+	SyncMode SyncMode
+	// SyncInterval is how often records are fsync'ed in SyncInterval mode.
+	SyncInterval time.Duration
+	// CheckpointInterval is how often closed partitions are compacted
+	// into a checkpoint, 0 disables checkpointing.
+	CheckpointInterval time.Duration
+	// ReplayWorkers is the number of files decoded concurrently
+	// during replay, GOMAXPROCS by default.
+	ReplayWorkers int
+	// Retention is how long WAL data is kept, 0 keeps it forever.
+	Retention time.Duration
+	// OutOfOrderWindow and DuplicatePolicy must match the storage, so
+	// checkpoints keep the same samples as the head does.
+	OutOfOrderWindow time.Duration
+	DuplicatePolicy  domain.DuplicatePolicy
+	// Registerer registers the WAL metrics if set.
+	Registerer prometheus.Registerer
 }
 
 func New(log *slog.Logger, opts Opts) *wal {
-	return &wal{
+	if opts.SyncMode == "" {
+		opts.SyncMode = SyncAlways
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if opts.ReplayWorkers <= 0 {
+		opts.ReplayWorkers = runtime.GOMAXPROCS(0)
+	}
+	if opts.DuplicatePolicy == "" {
+		opts.DuplicatePolicy = domain.LastWriteWins
+	}
+
+	l := &wal{
 		log:                log,
 		partitionSizeInSec: opts.PartitionSizeInSec,
 		partitionsPath:     opts.PartitionsPath,
 		timeFn:             opts.TimeNow,
+		syncMode:           opts.SyncMode,
+		syncInterval:       opts.SyncInterval,
+		checkpointInterval: opts.CheckpointInterval,
+		replayWorkers:      opts.ReplayWorkers,
+		retention:          opts.Retention,
+		oooWindowMs:        opts.OutOfOrderWindow.Milliseconds(),
+		duplicatePolicy:    opts.DuplicatePolicy,
 	}
+	l.syncCond = sync.NewCond(&l.syncMu)
+	l.syncFile = (*os.File).Sync
+	l.metrics = newMetrics(opts.Registerer, l)
+
+	return l
 }
 
+// Run runs background WAL jobs until the context is canceled,
+// then closes the current partition.
 func (l *wal) Run(ctx context.Context) {
-	<-ctx.Done()
+	var syncC, checkpointC, retentionC <-chan time.Time
+
+	if l.syncMode == SyncInterval {
+		ticker := time.NewTicker(l.syncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+
+	if l.checkpointInterval > 0 {
+		ticker := time.NewTicker(l.checkpointInterval)
+		defer ticker.Stop()
+		checkpointC = ticker.C
+	}
+
+	if l.retention > 0 {
+		ticker := time.NewTicker(retentionCheckInterval)
+		defer ticker.Stop()
+		retentionC = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-syncC:
+			if err := l.Sync(); err != nil {
+				l.log.Error("failed to sync wal", slog.Any("error", err))
+			}
+		case <-checkpointC:
+			if err := l.Checkpoint(); err != nil {
+				l.log.Error("failed to checkpoint wal", slog.Any("error", err))
+			}
+		case <-retentionC:
+			if err := l.DeleteBefore(l.timeFn().Add(-l.retention)); err != nil {
+				l.log.Error("failed to delete wal files out of retention", slog.Any("error", err))
+			}
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
 	l.closeCurrentFile()
 }
@@ -95,166 +208,279 @@ func (l *wal) listWalFiles() ([]walFile, error) {
 	return files, nil
 }
 
-// Append persists WAL entry to the disk.
+// Append persists WAL entry to the disk. When it returns depends on the
+// sync mode, see SyncMode for the guarantees each of them gives.
 func (l *wal) Append(entry domain.WalEntity) error {
+	start := time.Now()
+	defer func() {
+		l.metrics.appendDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
 
-	tNow := l.timeFn().Unix()
-	var (
-		currentFilename string
-		err             error
-	)
+	seq, err := l.write(entry)
+	if err != nil {
+		l.mutex.Unlock()
 
-	if l.currentFile == nil {
-		files, err := l.listWalFiles()
-		if err != nil {
-			return fmt.Errorf("failed to list wal files: %w", err)
+		return err
+	}
+
+	switch l.syncMode {
+	case SyncBatch:
+		l.mutex.Unlock()
+
+		return l.waitSynced(seq)
+	case SyncInterval:
+		l.mutex.Unlock()
+
+		return nil
+	default:
+		defer l.mutex.Unlock()
+
+		if err := l.fsync(l.currentFile); err != nil {
+			return err
 		}
 
-		// Check if we have latest wal partition
-		if len(files) > 0 {
-			currentFilename = files[len(files)-1].name
-			l.currentFileTimestamp = files[len(files)-1].ts
-
-			// Open latest wal partition if it's still active
-			if files[len(files)-1].ts+l.partitionSizeInSec < tNow {
-				l.currentFile, err = l.openFile(currentFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
-				if err != nil {
-					return fmt.Errorf("failed to create new wal partition: %w", err)
-				}
-			}
+		l.syncMu.Lock()
+		l.markSynced(seq)
+		l.syncMu.Unlock()
+
+		return nil
+	}
+}
+
+// write writes the entry to the current partition and returns its
+// sequence number. Must be called under the lock.
+func (l *wal) write(entry domain.WalEntity) (uint64, error) {
+	// Check if we should switch to a new wal partition
+	if partitionTs := l.getNextPartitionTs(); l.currentFile == nil || partitionTs != l.currentFileTimestamp {
+		if err := l.openPartition(partitionTs); err != nil {
+			return 0, fmt.Errorf("failed to open wal partition: %w", err)
 		}
 	}
 
-	// Check if we should create a new wal partition
-	if l.currentFileTimestamp+l.partitionSizeInSec >= tNow || l.currentFileTimestamp == 0 {
-		// Build next wal file name
-		l.currentFileTimestamp = l.getNextPartitionTs()
-		currentFilename = strconv.FormatInt(l.currentFileTimestamp, 10) + partitionSuffix
+	record := l.encoder.encode(entry)
+	if _, err := l.currentFile.Write(record); err != nil {
+		// A partially written record would make the following ones unreadable,
+		// cut it off. If that fails too, the partition is repaired when it's
+		// opened again by the next write.
+		if err := l.currentFile.Truncate(l.currentFileSize); err != nil {
+			l.log.Error("failed to truncate wal file after a failed write", slog.Any("error", err))
+			l.closeCurrentFile()
+		}
 
-		// Close previous wal file
-		l.closeCurrentFile()
+		return 0, fmt.Errorf("failed to write entry: %w", err)
+	}
+	l.currentFileSize += int64(len(record))
+	l.encoder.commit()
+	l.written++
 
-		l.currentFile, err = l.openFile(currentFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
-		if err != nil {
-			return fmt.Errorf("failed to create new wal partition: %w", err)
-		}
+	return l.written, nil
+}
+
+// openPartition makes the partition with the given timestamp the current one.
+// A new partition file gets a header, an existing one is scanned to learn
+// about the series it already defines. A damaged tail of an existing
+// partition, left by a crash or a failed write, is cut off first.
+func (l *wal) openPartition(ts int64) error {
+	// Close previous wal file
+	l.closeCurrentFile()
+
+	err := l.openPartitionFile(ts)
+
+	var corruption *corruptionError
+	if !errors.As(err, &corruption) {
+		return err
+	}
+
+	file := walFile{name: strconv.FormatInt(ts, 10) + partitionSuffix, ts: ts}
+	if err := l.repair(file, corruption, &RepairReport{}); err != nil {
+		return fmt.Errorf("failed to repair partition %s: %w", file.name, err)
+	}
+
+	return l.openPartitionFile(ts)
+}
+
+// openPartitionFile opens the partition file, a damaged one is reported
+// with *corruptionError. Must be called under the lock.
+func (l *wal) openPartitionFile(ts int64) error {
+	filename := strconv.FormatInt(ts, 10) + partitionSuffix
+	f, err := l.openFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND)
+	if err != nil {
+		return err
 	}
 
-	if err := writeEntity(l.currentFile, entry); err != nil {
-		return fmt.Errorf("failed to write entry: %w", err)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
 	}
 
-	// TODO: consider doing fsync every N writes or every N seconds
-	return l.currentFile.Sync()
+	enc := newEncoder()
+	if info.Size() == 0 {
+		if err := writeFileHeader(f); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+	} else {
+		dec := newDecoder()
+		r := io.NewSectionReader(f, 0, info.Size())
+		if err := readFileHeader(r); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read existing partition %s: %w", filename, &corruptionError{err: err})
+		}
+		if _, err := readRecords(r, dec, -1, func(domain.WalEntity) error { return nil }); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read existing partition %s: %w", filename, err)
+		}
+		enc.seed(dec)
+	}
+
+	l.currentFile = f
+	l.currentFileTimestamp = ts
+	l.currentFileSize = max(info.Size(), fileHeaderSize)
+	l.encoder = enc
+
+	return nil
 }
 
+// closeCurrentFile syncs and closes the current partition.
+// Must be called under the lock.
 func (l *wal) closeCurrentFile() {
 	// Close previous wal file
 	if l.currentFile != nil {
+		// Records written in batch and interval modes might not be synced yet
+		if err := l.fsync(l.currentFile); err != nil {
+			l.log.Error("failed to sync wal file", slog.Any("err", err))
+
+			// Don't let waiters think their records made it to the disk
+			l.syncMu.Lock()
+			l.syncFailed, l.syncErr = l.written, err
+			l.syncMu.Unlock()
+		} else {
+			l.syncMu.Lock()
+			l.markSynced(l.written)
+			l.syncMu.Unlock()
+		}
+
 		err := l.currentFile.Close()
 		if err != nil {
 			l.log.Error("failed to close wal file", slog.Any("err", err))
 		}
+		l.currentFile = nil
 	}
 }
 
 func (l *wal) getNextPartitionTs() int64 {
-	return l.timeFn().UTC().
+	ts := l.timeFn().UTC().
 		Truncate(time.Duration(l.partitionSizeInSec) * time.Second).
 		Add(time.Duration(l.partitionSizeInSec) * time.Second).Unix()
-}
-
-func (l *wal) openFile(filename string, mode int) (*os.File, error) {
-	f, err := os.OpenFile(l.partitionsPath+"/"+filename, mode, 0644)
-	if err != nil {
-		return nil, err
-	}
 
-	return f, nil
+	return max(ts, l.minPartitionTs)
 }
 
-func (l *wal) Replay() ([]domain.WalEntity, error) {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+// Cut closes the current partition, so the following records go to a new
+// one, and returns the timestamp of the last partition holding the records
+// appended so far. Replaying after it only yields newer records.
+func (l *wal) Cut() (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closeCurrentFile()
 
-	// TODO: for now read all available files
 	files, err := l.listWalFiles()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list wal files: %w", err)
+		return 0, fmt.Errorf("failed to list wal files: %w", err)
 	}
 
-	// TODO: read files in parallel
-	result := make([]domain.WalEntity, 0)
-	for _, file := range files {
-		entries, err := l.readWalFile(file.name)
-		if err != nil {
-			l.log.Error("failed to read wal file",
-				slog.String("file", file.name),
-				slog.Any("error", err))
-		} else {
-			result = append(result, entries...)
-		}
+	last := l.minPartitionTs - 1
+	if len(files) > 0 {
+		last = max(last, files[len(files)-1].ts)
 	}
+	l.minPartitionTs = last + 1
 
-	return result, nil
+	return last, nil
 }
 
-func writeEntity(w io.Writer, data domain.WalEntity) error {
-	// for the sake of simplicity encode to json for now
-	jsonBytes, err := json.Marshal(data)
+func (l *wal) openFile(filename string, mode int) (*os.File, error) {
+	f, err := os.OpenFile(l.partitionsPath+"/"+filename, mode, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// <4-bytes-length><N-bytes-json-string>
-	length := uint32(len(jsonBytes))
-	err = binary.Write(w, binary.LittleEndian, length)
-	if err != nil {
-		return err
-	}
+	return f, nil
+}
 
-	_, err = w.Write(jsonBytes)
+// readWalFile reads all the records of a partition or checkpoint file.
+func (l *wal) readWalFile(filename string) ([]domain.WalEntity, error) {
+	var result []domain.WalEntity
+	_, err := l.streamWalFile(filename, func(e domain.WalEntity) error {
+		result = append(result, e)
+
+		return nil
+	})
 
-	return err
+	return result, err
 }
 
-func (l *wal) readWalFile(filename string) ([]domain.WalEntity, error) {
+// streamWalFile calls fn for every record of a partition or checkpoint file
+// as soon as it's decoded. It returns the number of bytes of valid records.
+func (l *wal) streamWalFile(filename string, fn func(domain.WalEntity) error) (int64, error) {
 	f, err := l.openFile(filename, os.O_RDONLY)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer f.Close()
 
-	return readNRecords(f, -1)
+	if err := readFileHeader(f); err != nil {
+		return 0, &corruptionError{err: err}
+	}
+
+	return readRecords(f, newDecoder(), -1, fn)
 }
 
+// readNRecords reads up to n records (all of them if n <= 0) from a partition file.
+// On corruption it returns the records read so far along with *corruptionError.
 func readNRecords(r io.Reader, n int) ([]domain.WalEntity, error) {
+	if err := readFileHeader(r); err != nil {
+		return nil, &corruptionError{err: err}
+	}
+
 	var result []domain.WalEntity
+	_, err := readRecords(r, newDecoder(), n, func(e domain.WalEntity) error {
+		result = append(result, e)
+
+		return nil
+	})
+
+	return result, err
+}
 
+// readRecords calls fn for up to n records (all of them if n <= 0) that follow
+// the file header and returns the offset where the last valid record ends.
+// On corruption it returns *corruptionError, errors of fn are returned as is.
+func readRecords(r io.Reader, dec *decoder, n int, fn func(domain.WalEntity) error) (int64, error) {
+	offset := int64(fileHeaderSize)
+	br := bufio.NewReader(r)
 	for i := 0; n <= 0 || i < n; i++ {
-		var length uint32
-		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		payload, err := readRecord(br)
+		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break // reached end
 			}
-			return nil, fmt.Errorf("read length: %w", err)
+			return offset, &corruptionError{offset: offset, err: err}
 		}
 
-		buf := make([]byte, length)
-
-		if _, err := io.ReadFull(r, buf); err != nil {
-			return nil, fmt.Errorf("read data: %w", err)
+		record, err := dec.decode(payload)
+		if err != nil {
+			return offset, &corruptionError{offset: offset, err: fmt.Errorf("decode record: %w", err)}
 		}
 
-		var record domain.WalEntity
-		if err := json.Unmarshal(buf, &record); err != nil {
-			return nil, fmt.Errorf("decode json: %w", err)
+		if err := fn(record); err != nil {
+			return offset, err
 		}
-
-		result = append(result, record)
+		offset += recordHeaderSize + int64(len(payload))
 	}
 
-	return result, nil
+	return offset, nil
 }
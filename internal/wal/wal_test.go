@@ -1,13 +1,21 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
 	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/dstdfx/mini-tsdb/internal/domain"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWal_listWalFiles(t *testing.T) {
@@ -190,7 +198,499 @@ func TestWal(t *testing.T) {
 	assert.Len(t, files, 3)
 
 	// Get data to replay
-	walEntries, err := w.Replay()
+	walEntries, _, err := replayAll(w)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedTimeSeries, walEntries)
 }
+
+func TestRecord_EncodeDecode(t *testing.T) {
+	entities := []domain.WalEntity{
+		{
+			Timestamp: 100,
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels: []domain.Label{
+						{Name: "__name__", Value: "up"},
+						{Name: "job", Value: "api"},
+					},
+					Samples: []domain.Sample{
+						{Timestamp: 1000, Value: 1},
+						{Timestamp: 900, Value: -2.5},
+					},
+				},
+				{
+					Labels: []domain.Label{
+						{Name: "__name__", Value: "up"},
+						{Name: "job", Value: "web"},
+					},
+					Samples: []domain.Sample{
+						{Timestamp: 1000, Value: 0},
+					},
+				},
+			},
+		},
+		{
+			Timestamp: 101,
+			TimeSeries: []domain.TimeSeries{
+				{
+					// Same series with labels in different order is referenced
+					Labels: []domain.Label{
+						{Name: "job", Value: "api"},
+						{Name: "__name__", Value: "up"},
+					},
+					Samples: []domain.Sample{
+						{Timestamp: 2000, Value: 3},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeFileHeader(&buf))
+
+	enc := newEncoder()
+	for _, e := range entities {
+		buf.Write(enc.encode(e))
+		enc.commit()
+	}
+
+	got, err := readNRecords(bytes.NewReader(buf.Bytes()), -1)
+	assert.NoError(t, err)
+
+	// Referenced series keep labels order of their definition
+	entities[1].TimeSeries[0].Labels = entities[0].TimeSeries[0].Labels
+	assert.Equal(t, entities, got)
+
+	got, err = readNRecords(bytes.NewReader(buf.Bytes()), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, entities[:1], got)
+}
+
+func TestRecord_Tombstones(t *testing.T) {
+	series := []domain.TimeSeries{
+		{
+			Labels:  []domain.Label{{Name: "__name__", Value: "up"}},
+			Samples: []domain.Sample{{Timestamp: 1000, Value: 1}},
+		},
+	}
+	tombstones := []domain.Tombstone{
+		{
+			Matchers: []domain.LabelMatcher{
+				{Type: domain.EQ, Name: "__name__", Value: "up"},
+				{Type: domain.NRE, Name: "job", Value: "api|web"},
+			},
+			MinTimeMs: math.MinInt64,
+			MaxTimeMs: math.MaxInt64,
+		},
+		{
+			Matchers:  []domain.LabelMatcher{{Type: domain.EQ, Name: "job", Value: "db"}},
+			MinTimeMs: -100,
+			MaxTimeMs: 2000,
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeFileHeader(&buf))
+
+	enc := newEncoder()
+	buf.Write(enc.encode(domain.WalEntity{Timestamp: 100, Tombstones: tombstones}))
+	enc.commit()
+	// Samples and tombstones of a single entity go to separate records
+	buf.Write(enc.encode(domain.WalEntity{Timestamp: 101, TimeSeries: series, Tombstones: tombstones[1:]}))
+	enc.commit()
+
+	got, err := readNRecords(bytes.NewReader(buf.Bytes()), -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.WalEntity{
+		{Timestamp: 100, Tombstones: tombstones},
+		{Timestamp: 101, TimeSeries: series},
+		{Timestamp: 101, Tombstones: tombstones[1:]},
+	}, got)
+}
+
+func TestRecord_Corruption(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeFileHeader(&buf))
+
+	enc := newEncoder()
+	buf.Write(enc.encode(domain.WalEntity{
+		Timestamp: 1,
+		TimeSeries: []domain.TimeSeries{
+			{
+				Labels:  []domain.Label{{Name: "a", Value: "b"}},
+				Samples: []domain.Sample{{Timestamp: 1, Value: 1}},
+			},
+		},
+	}))
+	valid := buf.Bytes()
+
+	t.Run("foreign file", func(t *testing.T) {
+		_, err := readNRecords(bytes.NewReader([]byte(`{"Timestamp":1}`)), -1)
+		assert.ErrorIs(t, err, errBadMagic)
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		data := bytes.Clone(valid)
+		data[4] = formatVersion + 1
+
+		_, err := readNRecords(bytes.NewReader(data), -1)
+		assert.ErrorIs(t, err, errBadVersion)
+	})
+
+	t.Run("flipped bit", func(t *testing.T) {
+		data := bytes.Clone(valid)
+		data[len(data)-1] ^= 0x01
+
+		_, err := readNRecords(bytes.NewReader(data), -1)
+		assert.ErrorIs(t, err, errBadChecksum)
+	})
+
+	t.Run("truncated record", func(t *testing.T) {
+		_, err := readNRecords(bytes.NewReader(valid[:len(valid)-3]), -1)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestWal_AppendToExistingPartition(t *testing.T) {
+	walDir := t.TempDir()
+
+	tNow := time.Unix(1_700_000_001, 0)
+	opts := Opts{
+		PartitionsPath:     walDir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return tNow },
+	}
+
+	entity := domain.WalEntity{
+		Timestamp: tNow.Unix(),
+		TimeSeries: []domain.TimeSeries{
+			{
+				Labels:  []domain.Label{{Name: "a", Value: "b"}},
+				Samples: []domain.Sample{{Timestamp: 1, Value: 1}},
+			},
+		},
+	}
+
+	// Simulate a restart within the same partition window
+	w := New(nil, opts)
+	assert.NoError(t, w.Append(entity))
+	w.closeCurrentFile()
+
+	w = New(nil, opts)
+	assert.NoError(t, w.Append(entity))
+
+	files, err := w.listWalFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	got, _, err := replayAll(w)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.WalEntity{entity, entity}, got)
+}
+
+// replayAll collects all the replayed entities.
+func replayAll(w *wal) ([]domain.WalEntity, RepairReport, error) {
+	var entities []domain.WalEntity
+	stats, err := w.Replay(func(e domain.WalEntity) error {
+		entities = append(entities, e)
+
+		return nil
+	})
+
+	return entities, stats.Repairs, err
+}
+
+func TestWal_Replay_Streaming(t *testing.T) {
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return time.Unix(1_700_000_001, 0) },
+	})
+
+	entities := testEntities(10)
+	for _, e := range entities {
+		assert.NoError(t, w.Append(e))
+	}
+
+	// Entities are handed over one by one and replay stops on error
+	errStop := errors.New("stop")
+	var got []domain.WalEntity
+	stats, err := w.Replay(func(e domain.WalEntity) error {
+		got = append(got, e)
+		if len(got) == 3 {
+			return errStop
+		}
+
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, entities[:3], got)
+	assert.Equal(t, 3, stats.Records)
+
+	// Replay errors never trigger repairs
+	got, report, err := replayAll(w)
+	assert.NoError(t, err)
+	assert.True(t, report.Empty())
+	assert.Equal(t, entities, got)
+
+	stats, err = w.Replay(func(domain.WalEntity) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Files)
+	assert.Equal(t, len(entities), stats.Records)
+
+	info, err := os.Stat(filepath.Join(w.partitionsPath, "1700000010.wal"))
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), stats.Bytes)
+}
+
+func TestWal_Replay_Parallel(t *testing.T) {
+	dir := t.TempDir()
+
+	// Spread series over many partitions so the order of the files matters
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     dir,
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+		SyncMode:           SyncInterval,
+	})
+
+	entities := testEntities(200)
+	for i, e := range entities {
+		if i%7 == 0 {
+			now = now.Add(30 * time.Second)
+		}
+		assert.NoError(t, w.Append(e))
+	}
+	w.closeCurrentFile()
+
+	files, err := w.listWalFiles()
+	assert.NoError(t, err)
+
+	// Tear the tail of a partition in the middle
+	middle := filepath.Join(dir, files[len(files)/2].name)
+	info, err := os.Stat(middle)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(middle, info.Size()-3))
+
+	sequential := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath: dir,
+		TimeNow:        time.Now,
+		ReplayWorkers:  1,
+	})
+	parallel := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath: dir,
+		TimeNow:        time.Now,
+		ReplayWorkers:  4,
+	})
+
+	// Sequential replay repairs the partition, parallel one sees it repaired
+	expected, report, err := replayAll(sequential)
+	assert.NoError(t, err)
+	assert.Len(t, report.Truncated, 1)
+	assert.Len(t, expected, len(entities)-1)
+
+	got, report, err := replayAll(parallel)
+	assert.NoError(t, err)
+	assert.True(t, report.Empty())
+	assert.Equal(t, expected, got)
+
+	// Per series samples are applied in order
+	lastTs := make(map[string]int64)
+	for _, e := range got {
+		for _, ts := range e.TimeSeries {
+			key := domain.LabelsKey(ts.Labels)
+			for _, s := range ts.Samples {
+				if prev, ok := lastTs[key]; ok {
+					assert.Greater(t, s.Timestamp, prev)
+				}
+				lastTs[key] = s.Timestamp
+			}
+		}
+	}
+
+	// Errors of apply stop the replay
+	errStop := errors.New("stop")
+	var applied int
+	_, err = parallel.Replay(func(domain.WalEntity) error {
+		applied++
+		if applied == 50 {
+			return errStop
+		}
+
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 50, applied)
+}
+
+// BenchmarkWal_Replay measures replay speedup with the number of workers.
+// The size of the synthetic WAL is 256MB by default and can be changed with
+// WAL_BENCH_SIZE_MB, e.g. WAL_BENCH_SIZE_MB=4096 for a multi-GB WAL.
+func TestWal_Cut(t *testing.T) {
+	now := time.Unix(1_700_000_001, 0)
+	w := New(slog.New(slog.DiscardHandler), Opts{
+		PartitionsPath:     t.TempDir(),
+		PartitionSizeInSec: 30,
+		TimeNow:            func() time.Time { return now },
+	})
+
+	entity := func(v float64) domain.WalEntity {
+		return domain.WalEntity{
+			Timestamp: now.Unix(),
+			TimeSeries: []domain.TimeSeries{
+				{
+					Labels:  []domain.Label{{Name: "__name__", Value: "up"}},
+					Samples: []domain.Sample{{Timestamp: now.UnixMilli(), Value: v}},
+				},
+			},
+		}
+	}
+
+	require.NoError(t, w.Append(entity(1)))
+	first := w.getNextPartitionTs()
+
+	position, err := w.Cut()
+	require.NoError(t, err)
+	assert.Equal(t, first, position)
+
+	// Records go to a new partition even within the same time window
+	require.NoError(t, w.Append(entity(2)))
+	require.NoError(t, w.Append(entity(3)))
+
+	var got []domain.WalEntity
+	_, err = w.ReplayAfter(position, func(e domain.WalEntity) error {
+		got = append(got, e)
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []domain.WalEntity{entity(2), entity(3)}, got)
+
+	all, _, err := replayAll(w)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	// Nothing is appended after the second cut
+	second, err := w.Cut()
+	require.NoError(t, err)
+	assert.Equal(t, first+1, second)
+
+	third, err := w.Cut()
+	require.NoError(t, err)
+	assert.Equal(t, second, third)
+
+	// Truncating drops the partitions up to the cut
+	require.NoError(t, w.Truncate(position))
+
+	files, err := w.listWalFiles()
+	require.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, second, files[0].ts)
+	}
+
+	all, _, err = replayAll(w)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.WalEntity{entity(2), entity(3)}, all)
+}
+
+func BenchmarkWal_Replay(b *testing.B) {
+	sizeMB := 256
+	if v := os.Getenv("WAL_BENCH_SIZE_MB"); v != "" {
+		var err error
+		if sizeMB, err = strconv.Atoi(v); err != nil {
+			b.Fatalf("invalid WAL_BENCH_SIZE_MB: %v", err)
+		}
+	}
+
+	dir := b.TempDir()
+	writeSyntheticWal(b, dir, int64(sizeMB)<<20)
+
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			w := New(slog.New(slog.DiscardHandler), Opts{
+				PartitionsPath: dir,
+				TimeNow:        time.Now,
+				ReplayWorkers:  workers,
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stats, err := w.Replay(func(domain.WalEntity) error { return nil })
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(stats.Bytes)
+			}
+		})
+	}
+}
+
+// writeSyntheticWal writes partitions of about 16MB each, with 1000 series
+// scraped every 15 seconds, until the total size is reached.
+func writeSyntheticWal(b *testing.B, dir string, size int64) {
+	b.Helper()
+
+	const (
+		partitionSize = 16 << 20
+		seriesCount   = 1000
+	)
+
+	series := make([][]domain.Label, seriesCount)
+	for i := range series {
+		series[i] = []domain.Label{
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "instance", Value: "host-" + strconv.Itoa(i%50)},
+			{Name: "handler", Value: "/api/v1/handler/" + strconv.Itoa(i/50)},
+		}
+	}
+
+	var (
+		written int64
+		ts      int64
+	)
+	for partition := int64(1); written < size; partition++ {
+		f, err := os.Create(filepath.Join(dir, strconv.FormatInt(partition, 10)+partitionSuffix))
+		if err != nil {
+			b.Fatal(err)
+		}
+		bw := bufio.NewWriter(f)
+		if err := writeFileHeader(bw); err != nil {
+			b.Fatal(err)
+		}
+
+		enc := newEncoder()
+		for fileSize := int64(fileHeaderSize); fileSize < partitionSize; {
+			ts += 15_000
+
+			entity := domain.WalEntity{
+				Timestamp:  ts / 1000,
+				TimeSeries: make([]domain.TimeSeries, 0, seriesCount),
+			}
+			for i, labels := range series {
+				entity.TimeSeries = append(entity.TimeSeries, domain.TimeSeries{
+					Labels:  labels,
+					Samples: []domain.Sample{{Timestamp: ts, Value: float64(ts/1000 + int64(i))}},
+				})
+			}
+
+			record := enc.encode(entity)
+			enc.commit()
+			if _, err := bw.Write(record); err != nil {
+				b.Fatal(err)
+			}
+			fileSize += int64(len(record))
+		}
+
+		if err := bw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			b.Fatal(err)
+		}
+		written += info.Size()
+		f.Close()
+	}
+}
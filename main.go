@@ -3,23 +3,55 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/dstdfx/mini-tsdb/internal/api"
+	"github.com/dstdfx/mini-tsdb/internal/domain"
+	"github.com/dstdfx/mini-tsdb/internal/query"
 	"github.com/dstdfx/mini-tsdb/internal/storage"
 	"github.com/dstdfx/mini-tsdb/internal/wal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
 type config struct {
-	PartitionSizeInSec int64  `env:"PARTITION_SIZE_IN_SEC" envDefault:"30"`
-	WALPartitionsPath  string `env:"WAL_PARTITIONS_PATH" envDefault:"waldata"`
-	Addr               string `env:"PORT" envDefault:":9201"`
+	PartitionSizeInSec int64          `env:"PARTITION_SIZE_IN_SEC" envDefault:"30"`
+	WALPartitionsPath  string         `env:"WAL_PARTITIONS_PATH" envDefault:"waldata"`
+	WALSyncMode        string         `env:"WAL_SYNC_MODE" envDefault:"always"` // always, batch or interval
+	WALSyncInterval    time.Duration  `env:"WAL_SYNC_INTERVAL" envDefault:"1s"`
+	WALCheckpointEvery time.Duration  `env:"WAL_CHECKPOINT_INTERVAL" envDefault:"10m"`
+	WALReplayWorkers   int            `env:"WAL_REPLAY_WORKERS" envDefault:"0"` // 0 means GOMAXPROCS
+	Retention          model.Duration `env:"RETENTION" envDefault:"0s"`         // 0 keeps data forever, e.g. 15d
+	OutOfOrderWindow   time.Duration  `env:"OUT_OF_ORDER_WINDOW" envDefault:"0s"`
+	DuplicatePolicy    string         `env:"DUPLICATE_POLICY" envDefault:"last"` // last or first
+	ReadDownsample     bool           `env:"READ_HINTS_DOWNSAMPLE" envDefault:"false"`
+	ReadLookbackDelta  time.Duration  `env:"READ_LOOKBACK_DELTA" envDefault:"5m"`
+	QueryTimeout       time.Duration  `env:"QUERY_TIMEOUT" envDefault:"2m"`
+	QueryMaxSamples    int            `env:"QUERY_MAX_SAMPLES" envDefault:"50000000"`
+	QueryLookbackDelta time.Duration  `env:"QUERY_LOOKBACK_DELTA" envDefault:"5m"`
+	EnableAdminAPI     bool           `env:"ENABLE_ADMIN_API" envDefault:"false"`
+	BlocksPath         string         `env:"BLOCKS_PATH"` // empty keeps all data in memory
+	BlockDuration      time.Duration  `env:"BLOCK_DURATION" envDefault:"2h"`
+	CompactionWorkers  int            `env:"COMPACTION_CONCURRENCY" envDefault:"1"`
+	CompressPostings   bool           `env:"COMPRESS_POSTINGS" envDefault:"false"`
+	HeadStripes        int            `env:"HEAD_STRIPES" envDefault:"64"`
+	MaxSeries          int            `env:"MAX_SERIES" envDefault:"0"`
+	MaxSeriesPerMetric int            `env:"MAX_SERIES_PER_METRIC" envDefault:"0"`
+	MaxLabelNames      int            `env:"MAX_LABEL_NAMES_PER_SERIES" envDefault:"0"`
+	MaxLabelValueLen   int            `env:"MAX_LABEL_VALUE_LENGTH" envDefault:"0"`
+	SnapshotPath       string         `env:"SNAPSHOT_PATH" envDefault:"head.snapshot"` // empty disables snapshots
+	Addr               string         `env:"PORT" envDefault:":9201"`
 }
 
 func main() {
@@ -35,38 +67,113 @@ func main() {
 		os.Exit(1)
 	}
 
-	rootCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	syncMode, err := wal.ParseSyncMode(cfg.WALSyncMode)
+	if err != nil {
+		logger.Error("failed to parse app config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	duplicatePolicy, err := domain.ParseDuplicatePolicy(cfg.DuplicatePolicy)
+	if err != nil {
+		logger.Error("failed to parse app config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	rootCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
 	// Make sure the WAL partitions directory exists
 	os.MkdirAll(cfg.WALPartitionsPath, 0755)
 
-	storage := storage.NewInMemory()
 	w := wal.New(logger, wal.Opts{
 		PartitionSizeInSec: cfg.PartitionSizeInSec,
 		PartitionsPath:     cfg.WALPartitionsPath,
 		TimeNow:            time.Now,
+		SyncMode:           syncMode,
+		SyncInterval:       cfg.WALSyncInterval,
+		CheckpointInterval: cfg.WALCheckpointEvery,
+		ReplayWorkers:      cfg.WALReplayWorkers,
+		Retention:          time.Duration(cfg.Retention),
+		OutOfOrderWindow:   cfg.OutOfOrderWindow,
+		DuplicatePolicy:    duplicatePolicy,
+		Registerer:         prometheus.DefaultRegisterer,
 	})
 
-	// Init storage state
-	logger.Info("init state from WAL")
-	entities, err := w.Replay()
-	if err != nil {
-		panic(err)
-	}
-	for _, e := range entities {
-		storage.WriteMultiple(e.TimeSeries)
-	}
+	storage := storage.NewInMemory(storage.Opts{
+		Retention:        time.Duration(cfg.Retention),
+		TimeNow:          time.Now,
+		OutOfOrderWindow: cfg.OutOfOrderWindow,
+		DuplicatePolicy:  duplicatePolicy,
+		DownsampleReads:  cfg.ReadDownsample,
+		LookbackDelta:    cfg.ReadLookbackDelta,
+		Log:              logger,
+		BlocksPath:       cfg.BlocksPath,
+		BlockDuration:    cfg.BlockDuration,
+		OnBlockCut: func(maxtMs int64) {
+			// Drop the oldest WAL files as long as all their samples are
+			// persisted in blocks
+			if err := w.TruncateSamplesBefore(maxtMs); err != nil {
+				logger.Error("failed to truncate WAL", slog.Any("error", err))
+			}
+		},
+		CompactionConcurrency: cfg.CompactionWorkers,
+		Registerer:            prometheus.DefaultRegisterer,
+		CompressPostings:      cfg.CompressPostings,
+		Stripes:               cfg.HeadStripes,
+		Limits: storage.Limits{
+			MaxSeries:              cfg.MaxSeries,
+			MaxSeriesPerMetric:     cfg.MaxSeriesPerMetric,
+			MaxLabelNamesPerSeries: cfg.MaxLabelNames,
+			MaxLabelValueLength:    cfg.MaxLabelValueLen,
+		},
+	})
 
+	readiness := api.NewReadiness()
 	r := http.NewServeMux()
 
-	api.InitRoutesV1(r, logger, storage, w)
+	engine := query.NewEngine(logger, storage, query.Opts{
+		Timeout:       cfg.QueryTimeout,
+		MaxSamples:    cfg.QueryMaxSamples,
+		LookbackDelta: cfg.QueryLookbackDelta,
+	})
+
+	// Persist the head and drop the WAL it covers, the WAL is kept if the
+	// snapshot can't be written or read back
+	var snapshot func() error
+	if cfg.SnapshotPath != "" {
+		snapshot = func() error {
+			position, err := w.Cut()
+			if err != nil {
+				return fmt.Errorf("failed to cut WAL: %w", err)
+			}
+
+			if err := storage.WriteSnapshot(cfg.SnapshotPath, position); err != nil {
+				return err
+			}
+
+			return w.Truncate(position)
+		}
+	}
+
+	// Snapshots wait for the appends in flight
+	var appendMu sync.RWMutex
+	api.InitRoutesV1(r, logger, storage, w, engine, prometheus.DefaultRegisterer, &appendMu)
+	if cfg.EnableAdminAPI {
+		api.InitAdminRoutesV1(r, logger, storage, w, snapshot, &appendMu)
+	}
+
+	// Health, readiness and metrics are served while the storage is loading,
+	// the API only once it's ready
+	root := http.NewServeMux()
+	api.InitLifecycleRoutes(root, readiness)
+	api.InitMetricsRoute(root, prometheus.DefaultGatherer)
+	root.Handle("/", readiness.Gate(r))
 
 	baseCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	srv := &http.Server{
 		Addr:    cfg.Addr,
-		Handler: r,
+		Handler: root,
 		BaseContext: func(net.Listener) context.Context {
 			return baseCtx
 		},
@@ -79,8 +186,82 @@ func main() {
 		}
 	}()
 
+	// Load persisted blocks first, so the WAL only fills in the head
+	readiness.NotReady("loading blocks")
+	if err := storage.LoadBlocks(); err != nil {
+		logger.Error("failed to load blocks", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Restore the head from the snapshot, the WAL fills in what came after it
+	walPosition := int64(math.MinInt64)
+	if cfg.SnapshotPath != "" {
+		readiness.NotReady("loading snapshot")
+		position, err := storage.LoadSnapshot(cfg.SnapshotPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			// Keep the damaged snapshot for analysis and rebuild the head from
+			// the WAL that's left, the snapshot only replaces what it covers
+			logger.Error("failed to load snapshot, replaying the WAL without it",
+				slog.String("path", cfg.SnapshotPath),
+				slog.String("error", err.Error()))
+			if err := os.Rename(cfg.SnapshotPath, cfg.SnapshotPath+".bad"); err != nil {
+				logger.Error("failed to move snapshot aside", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+		default:
+			logger.Info("snapshot loaded", slog.String("path", cfg.SnapshotPath))
+			walPosition = position
+		}
+	}
+
+	// Init storage state
+	logger.Info("init state from WAL")
+	readiness.NotReady("replaying WAL")
+	stats, err := w.ReplayAfter(walPosition, func(e domain.WalEntity) error {
+		storage.WriteMultiple(e.TimeSeries)
+
+		// Tombstones only apply to the data that existed when they were
+		// written, the WAL keeps their time in seconds
+		for _, t := range e.Tombstones {
+			if _, err := storage.ReplayDelete(t, time.Unix(e.Timestamp, 0)); err != nil {
+				return fmt.Errorf("failed to apply tombstone: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if !stats.Repairs.Empty() {
+		logger.Warn("repaired damaged WAL partitions",
+			slog.Int("truncated", len(stats.Repairs.Truncated)),
+			slog.Int("quarantined", len(stats.Repairs.Quarantined)))
+	}
+	logger.Info("WAL replayed",
+		slog.Int("files", stats.Files),
+		slog.Int("records", stats.Records),
+		slog.Int64("bytes", stats.Bytes),
+		slog.Duration("duration", stats.Duration))
+
+	// Drop samples out of retention and deleted ones in the background
+	go storage.Run(rootCtx)
+
+	walCtx, stopWAL := context.WithCancel(context.Background())
+	walDone := make(chan struct{})
+	go func() {
+		defer close(walDone)
+		w.Run(walCtx)
+	}()
+
+	readiness.SetReady()
+	logger.Info("Server is ready")
+
 	<-rootCtx.Done()
 	stop()
+	readiness.NotReady("shutting down")
 	cancel()
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -91,4 +272,20 @@ func main() {
 	} else {
 		logger.Info("Server shutdown gracefully")
 	}
+
+	// Flush and close the WAL once no more writes are coming
+	stopWAL()
+	<-walDone
+
+	if snapshot != nil {
+		if err := snapshot(); err != nil {
+			logger.Error("failed to take snapshot", slog.String("error", err.Error()))
+		} else {
+			logger.Info("snapshot taken", slog.String("path", cfg.SnapshotPath))
+		}
+	}
+
+	if err := storage.Close(); err != nil {
+		logger.Error("failed to close storage", slog.String("error", err.Error()))
+	}
 }